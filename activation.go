@@ -0,0 +1,176 @@
+package netssh
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultActivationTimeout is used if Proxier.ServerCommand is set
+// but Proxier.WaitTimeout is zero.
+const DefaultActivationTimeout = 10 * time.Second
+
+// activationPollInterval is how often Proxy retries connecting to the server.
+const activationPollInterval = 50 * time.Millisecond
+
+// isServerDown returns true if err from connecting to the server socket
+// indicates that the server is not running, as opposed to e.g. a permission problem.
+func isServerDown(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	if !ok {
+		return false
+	}
+	return sysErr.Err == syscall.ENOENT || sysErr.Err == syscall.ECONNREFUSED
+}
+
+// activate is called if the server is down.
+// It starts p.ServerCommand, if set, and waits for the server to accept connections.
+func (p *Proxier) activate(ctx context.Context, log *slog.Logger, server string, mode ProxyMode, peer peerInfo) (*net.UnixConn, error) {
+
+	log = log.With(LogKeyPhase, phaseActivation)
+	timeout := p.WaitTimeout
+	if len(p.ServerCommand) > 0 {
+		if timeout == 0 {
+			timeout = DefaultActivationTimeout
+		}
+		if err := startServer(log, p.ServerCommand); err != nil {
+			return nil, err
+		}
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("server is not running")
+	}
+
+	log.Info("waiting for server", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(activationPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("server did not start: %s", ctx.Err())
+		case <-ticker.C:
+		}
+		conn, err := connectServer(log, server, mode, peer)
+		if err == nil {
+			return conn, nil
+		}
+		if !isServerDown(err) {
+			return nil, err
+		}
+	}
+}
+
+// startServer starts the server daemon in its own session so that it
+// outlives the proxy and the ssh connection.
+// Concurrent proxies may start multiple servers, all but one of
+// which are expected to fail to listen on the socket and exit.
+func startServer(log *slog.Logger, command []string) error {
+	log.Info("starting server", "command", command)
+	devnull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer devnull.Close()
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = devnull
+	cmd.Stdout = devnull
+	cmd.Stderr = devnull
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cannot start server: %s", err)
+	}
+	// the daemon is reparented to init once we exit
+	return cmd.Process.Release()
+}
+
+// serveInline serves the connection from stdin and stdout using p.Handler.
+func (p *Proxier) serveInline(ctx context.Context, log *slog.Logger, peer peerInfo, audit *AuditRecord) error {
+
+	log.Info("serving connection inline", LogKeyPhase, phaseServe)
+	audit.Mode = "inline"
+	started := time.Now()
+	stdin, restoreStdin, err := nonblockingDup(os.Stdin)
+	if err != nil {
+		return err
+	}
+	defer restoreStdin()
+	stdout, restoreStdout, err := nonblockingDup(os.Stdout)
+	if err != nil {
+		stdin.Close()
+		return err
+	}
+	defer restoreStdout()
+	conn := &ServeConn{t: &fdTransport{stdin, stdout, nil}, mode: ProxyModeFD, accepted: time.Now(), peer: peer.Peer, id: peer.ConnID, log: log}
+	if err := serverHandshake(log, conn, CompressionPolicy{}, nil); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.stats = newConnStats(started, os.Getpid())
+	// close the originals so that conn.CloseWrite results in EOF for the client
+	os.Stdin.Close()
+	os.Stdout.Close()
+	err = p.Handler(ctx, conn)
+	conn.Close()
+	stats := conn.Stats()
+	audit.setStats(&sessionStats{stats.BytesRead, stats.BytesWritten})
+	return err
+}
+
+// nonblockingDup returns a pollable copy of f, see comment at top of serve.go.
+// The copy shares f's open file description, which may be shared with other
+// processes, e.g. our parent's tty. Hence, only pipes and sockets are put in
+// non-blocking mode (deadlines are unsupported for other files), and restore
+// resets the mode, also if the copy has been closed meanwhile.
+func nonblockingDup(f *os.File) (dup *os.File, restore func(), err error) {
+	restore = func() {}
+	fd, err := unix.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, restore, err
+	}
+	unix.CloseOnExec(fd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return nil, restore, err
+	}
+	if t := st.Mode & unix.S_IFMT; t == unix.S_IFIFO || t == unix.S_IFSOCK {
+		flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+		if err != nil {
+			unix.Close(fd)
+			return nil, restore, err
+		}
+		if flags&unix.O_NONBLOCK == 0 {
+			// kept open to restore the mode after dup is closed
+			saved, err := unix.Dup(fd)
+			if err != nil {
+				unix.Close(fd)
+				return nil, restore, err
+			}
+			unix.CloseOnExec(saved)
+			restore = func() {
+				unix.FcntlInt(uintptr(saved), unix.F_SETFL, flags)
+				unix.Close(saved)
+			}
+			if err := unix.SetNonblock(fd, true); err != nil {
+				unix.Close(fd)
+				restore()
+				return nil, func() {}, err
+			}
+		}
+	}
+	return os.NewFile(uintptr(fd), f.Name()), restore, nil
+}
@@ -0,0 +1,70 @@
+package netssh
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestNonblockingDupRestores(t *testing.T) {
+	var fds [2]int
+	require.NoError(t, unix.Pipe2(fds[:], unix.O_CLOEXEC))
+	r := os.NewFile(uintptr(fds[0]), "r")
+	defer r.Close()
+	defer unix.Close(fds[1])
+	nonblocking := func() bool {
+		flags, err := unix.FcntlInt(r.Fd(), unix.F_GETFL, 0)
+		require.NoError(t, err)
+		return flags&unix.O_NONBLOCK != 0
+	}
+
+	dup, restore, err := nonblockingDup(r)
+	require.NoError(t, err)
+	assert.True(t, nonblocking(), "the open file description is shared")
+	require.NoError(t, dup.SetReadDeadline(time.Now()))
+	dup.Close()
+	restore()
+	assert.False(t, nonblocking())
+
+	// regular files are left alone
+	f, err := ioutil.TempFile("", "netssh")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	dup, restore, err = nonblockingDup(f)
+	require.NoError(t, err)
+	flags, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0)
+	require.NoError(t, err)
+	assert.Zero(t, flags&unix.O_NONBLOCK)
+	dup.Close()
+	restore()
+}
+
+func TestProxyActivationErrorWrapsConnectError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netssh")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Proxy writes the proxy error message to stdout
+	stdout := os.Stdout
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	defer devnull.Close()
+	os.Stdout = devnull
+	defer func() { os.Stdout = stdout }()
+
+	p := Proxier{Mode: ProxyModeRelay, WaitTimeout: 10 * time.Millisecond}
+	err = p.Proxy(context.Background(), filepath.Join(dir, "missing.sock"))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, syscall.ENOENT), "%s", err)
+	assert.Contains(t, err.Error(), "server did not start")
+}
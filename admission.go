@@ -0,0 +1,216 @@
+package netssh
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// DefaultHandshakeTimeout is used if AdmissionPolicy.HandshakeTimeout is zero.
+const DefaultHandshakeTimeout = 30 * time.Second
+
+// AdmissionPolicy limits the connections accepted by a Listener.
+// Connections that exceed a limit wait up to QueueTimeout for admission,
+// Dial returns BusyError for those that are rejected.
+// The zero value admits all connections, but limits the handshake
+// to DefaultHandshakeTimeout.
+type AdmissionPolicy struct {
+	// MaxConns, if > 0, limits the number of open connections.
+	// Connections count from the moment they are accepted, i.e., also
+	// while the server waits for the peer info that admission is based on.
+	// If MaxConns and QueueTimeout are reached by those, further connections
+	// are rejected right away.
+	MaxConns int
+	// MaxConnsPerPeer, if > 0, limits the number of open connections per Peer.ID.
+	MaxConnsPerPeer int
+	// Rate, if > 0, limits the rate of new connections per second,
+	// allowing bursts of up to Burst connections (at least 1).
+	Rate  float64
+	Burst int
+	// QueueTimeout is how long a connection may wait for admission.
+	// If zero, connections exceeding a limit are rejected immediately.
+	QueueTimeout time.Duration
+	// MaxQueue, if > 0, limits the number of waiting connections.
+	MaxQueue int
+	// HandshakeTimeout limits how long the server waits for the client
+	// during the handshake, including fd passing and encryption, but
+	// excluding the time spent waiting for admission.
+	// DefaultHandshakeTimeout is used if zero, there is no limit if negative.
+	HandshakeTimeout time.Duration
+}
+
+// handshakeTimeout returns the effective HandshakeTimeout, or 0 if there is none.
+func (p AdmissionPolicy) handshakeTimeout() time.Duration {
+	switch {
+	case p.HandshakeTimeout == 0:
+		return DefaultHandshakeTimeout
+	case p.HandshakeTimeout < 0:
+		return 0
+	default:
+		return p.HandshakeTimeout
+	}
+}
+
+// BusyError is returned by Dial if the server rejected the connection
+// because of its AdmissionPolicy. The connection attempt should be retried later.
+type BusyError struct{}
+
+func (BusyError) Error() string { return "netssh: server busy" }
+
+// Temporary implements net.Error.
+func (BusyError) Temporary() bool { return true }
+
+// Timeout implements net.Error.
+func (BusyError) Timeout() bool { return false }
+
+var errServerBusy = errors.New("server busy")
+
+type admission struct {
+	policy  AdmissionPolicy
+	limiter *rate.Limiter // nil if policy.Rate is zero
+
+	mtx     sync.Mutex
+	conns   int
+	perPeer map[string]int
+	queued  int
+	// pending is the number of connections between beginHandshake and admit
+	pending int
+	// released is closed and replaced whenever a connection is released
+	released chan struct{}
+}
+
+func newAdmission(p AdmissionPolicy) *admission {
+	a := &admission{
+		policy:   p,
+		perPeer:  make(map[string]int),
+		released: make(chan struct{}),
+	}
+	if p.Rate > 0 {
+		burst := p.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		a.limiter = rate.NewLimiter(rate.Limit(p.Rate), burst)
+	}
+	return a
+}
+
+// beginHandshake counts a connection whose peer is not yet known against
+// MaxConns. It returns errServerBusy if the connection would have to be
+// rejected by admit anyway, even after waiting in the queue.
+// Otherwise, end must be called before admit or once the handshake failed.
+func (a *admission) beginHandshake() (end func(), err error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if max := a.policy.MaxConns; max > 0 {
+		if a.policy.QueueTimeout > 0 {
+			if a.policy.MaxQueue <= 0 {
+				max = -1 // the queue is unlimited
+			} else {
+				max += a.policy.MaxQueue
+			}
+		}
+		if max >= 0 && a.conns+a.pending+a.queued >= max {
+			return nil, errServerBusy
+		}
+	}
+	a.pending++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mtx.Lock()
+			defer a.mtx.Unlock()
+			a.pending--
+			a.notify()
+		})
+	}, nil
+}
+
+// notify wakes up connections waiting in admit. a.mtx must be held.
+func (a *admission) notify() {
+	close(a.released)
+	a.released = make(chan struct{})
+}
+
+// admit returns errServerBusy if peer is not admitted.
+// Otherwise, release must be called once the connection is closed.
+// ctx aborts waiting, e.g. if the Listener is closed.
+func (a *admission) admit(ctx context.Context, peer Peer) (release func(), err error) {
+	if a.policy.QueueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.policy.QueueTimeout)
+		defer cancel()
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	queued := false
+	defer func() {
+		if queued {
+			a.queued--
+		}
+	}()
+	wait := func() bool {
+		if a.policy.QueueTimeout <= 0 {
+			return false
+		}
+		if !queued {
+			if a.policy.MaxQueue > 0 && a.queued >= a.policy.MaxQueue {
+				return false
+			}
+			a.queued++
+			queued = true
+		}
+		return true
+	}
+
+	if a.limiter != nil && !a.limiter.Allow() {
+		if !wait() {
+			return nil, errServerBusy
+		}
+		a.mtx.Unlock()
+		err := a.limiter.Wait(ctx) // fails immediately if ctx expires earlier
+		a.mtx.Lock()
+		if err != nil {
+			return nil, errServerBusy
+		}
+	}
+
+	id := peer.ID()
+	for {
+		if (a.policy.MaxConns <= 0 || a.conns+a.pending < a.policy.MaxConns) &&
+			(a.policy.MaxConnsPerPeer <= 0 || a.perPeer[id] < a.policy.MaxConnsPerPeer) {
+			break
+		}
+		if !wait() {
+			return nil, errServerBusy
+		}
+		released := a.released
+		a.mtx.Unlock()
+		select {
+		case <-released:
+			a.mtx.Lock()
+		case <-ctx.Done():
+			a.mtx.Lock()
+			return nil, errServerBusy
+		}
+	}
+
+	a.conns++
+	a.perPeer[id]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mtx.Lock()
+			defer a.mtx.Unlock()
+			a.conns--
+			if a.perPeer[id]--; a.perPeer[id] == 0 {
+				delete(a.perPeer, id)
+			}
+			a.notify()
+		})
+	}, nil
+}
@@ -0,0 +1,126 @@
+package netssh
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmissionLimits(t *testing.T) {
+	a := newAdmission(AdmissionPolicy{MaxConns: 2, MaxConnsPerPeer: 1})
+	ctx := context.Background()
+	alice, bob, carol := Peer{KeyID: "alice"}, Peer{KeyID: "bob"}, Peer{KeyID: "carol"}
+
+	releaseAlice, err := a.admit(ctx, alice)
+	require.NoError(t, err)
+	_, err = a.admit(ctx, alice)
+	assert.Equal(t, errServerBusy, err, "per peer limit")
+	releaseBob, err := a.admit(ctx, bob)
+	require.NoError(t, err)
+	_, err = a.admit(ctx, carol)
+	assert.Equal(t, errServerBusy, err, "overall limit")
+
+	releaseAlice()
+	releaseAlice() // idempotent
+	releaseCarol, err := a.admit(ctx, carol)
+	require.NoError(t, err)
+	releaseBob()
+	releaseCarol()
+	assert.Empty(t, a.perPeer)
+	assert.Equal(t, 0, a.conns)
+}
+
+func TestAdmissionQueue(t *testing.T) {
+	a := newAdmission(AdmissionPolicy{MaxConns: 1, QueueTimeout: 5 * time.Second, MaxQueue: 1})
+	ctx := context.Background()
+
+	release, err := a.admit(ctx, Peer{})
+	require.NoError(t, err)
+
+	admitted := make(chan error, 1)
+	go func() {
+		release, err := a.admit(ctx, Peer{})
+		if err == nil {
+			release()
+		}
+		admitted <- err
+	}()
+	for {
+		a.mtx.Lock()
+		queued := a.queued
+		a.mtx.Unlock()
+		if queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_, err = a.admit(ctx, Peer{})
+	assert.Equal(t, errServerBusy, err, "queue is full")
+
+	release()
+	assert.NoError(t, <-admitted)
+}
+
+func TestAdmissionQueueTimeout(t *testing.T) {
+	a := newAdmission(AdmissionPolicy{MaxConns: 1, QueueTimeout: 50 * time.Millisecond})
+	_, err := a.admit(context.Background(), Peer{})
+	require.NoError(t, err)
+	pre := time.Now()
+	_, err = a.admit(context.Background(), Peer{})
+	assert.Equal(t, errServerBusy, err)
+	assert.True(t, time.Since(pre) >= 50*time.Millisecond)
+}
+
+func TestAdmissionPendingHandshakes(t *testing.T) {
+	a := newAdmission(AdmissionPolicy{MaxConns: 1})
+	end, err := a.beginHandshake()
+	require.NoError(t, err)
+	_, err = a.beginHandshake()
+	assert.Equal(t, errServerBusy, err, "pending handshake counts")
+	_, err = a.admit(context.Background(), Peer{})
+	assert.Equal(t, errServerBusy, err)
+	end()
+	end() // idempotent
+	release, err := a.admit(context.Background(), Peer{})
+	require.NoError(t, err)
+	release()
+	assert.Equal(t, 0, a.pending)
+
+	// pending handshakes may wait in the queue
+	a = newAdmission(AdmissionPolicy{MaxConns: 1, QueueTimeout: time.Second, MaxQueue: 1})
+	for i := 0; i < 2; i++ {
+		_, err := a.beginHandshake()
+		require.NoError(t, err)
+	}
+	_, err = a.beginHandshake()
+	assert.Equal(t, errServerBusy, err, "queue is full")
+}
+
+func TestAdmissionRate(t *testing.T) {
+	a := newAdmission(AdmissionPolicy{Rate: 1, Burst: 2})
+	for i := 0; i < 2; i++ {
+		release, err := a.admit(context.Background(), Peer{})
+		require.NoError(t, err)
+		release()
+	}
+	_, err := a.admit(context.Background(), Peer{})
+	assert.Equal(t, errServerBusy, err)
+
+	// waiting for a token
+	a = newAdmission(AdmissionPolicy{Rate: 20, QueueTimeout: time.Second})
+	for i := 0; i < 3; i++ {
+		release, err := a.admit(context.Background(), Peer{})
+		require.NoError(t, err)
+		release()
+	}
+}
+
+func TestPeerID(t *testing.T) {
+	assert.Equal(t, "key:k", Peer{KeyID: "k", SSHConnection: "192.0.2.1 5000 192.0.2.2 22"}.ID())
+	assert.Equal(t, "addr:192.0.2.1", Peer{SSHConnection: "192.0.2.1 5000 192.0.2.2 22"}.ID())
+	assert.Equal(t, "", Peer{}.ID())
+	assert.Equal(t, "192.0.2.1:5000", peerAddr{Peer{SSHConnection: "192.0.2.1 5000 192.0.2.2 22"}}.String())
+}
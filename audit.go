@@ -0,0 +1,176 @@
+package netssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// AuditRecord describes a session handled by Proxy, see Proxier.AuditLog.
+type AuditRecord struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// ConnID is shared with the server's log records, see LogKeyConn.
+	ConnID string `json:"conn_id"`
+	Peer
+	// User is the local user running Proxy, i.e., the owner of the
+	// authorized_keys file.
+	User string `json:"user"`
+	// Server is the path of the server socket.
+	Server string `json:"server"`
+	// Mode is the ProxyMode used, "inline" for Proxier.Handler,
+	// or empty if Proxy could not connect to the server.
+	Mode string `json:"mode,omitempty"`
+	// BytesFromClient and BytesToClient are nil if unknown,
+	// e.g. with servers of older versions in ProxyModeFD.
+	// In ProxyModeRelay, they include the bytes of the handshake.
+	BytesFromClient *int64 `json:"bytes_from_client,omitempty"`
+	BytesToClient   *int64 `json:"bytes_to_client,omitempty"`
+	// ExitStatus is the exit status that Proxy's caller exits with,
+	// 0 if Proxy succeeded, 1 otherwise.
+	ExitStatus int    `json:"exit_status"`
+	Error      string `json:"error,omitempty"`
+}
+
+func newAuditRecord(start time.Time, server string, peer peerInfo) *AuditRecord {
+	return &AuditRecord{
+		Start:  start,
+		ConnID: peer.ConnID,
+		Peer:   peer.Peer,
+		Server: server,
+	}
+}
+
+func (r *AuditRecord) setStats(stats *sessionStats) {
+	if stats == nil {
+		return
+	}
+	r.BytesFromClient = &stats.BytesRead
+	r.BytesToClient = &stats.BytesWritten
+}
+
+// writeAuditRecord writes r as a JSON line with a single Write.
+func writeAuditRecord(w io.Writer, r *AuditRecord, err error) error {
+	r.End = time.Now()
+	r.User = strconv.Itoa(os.Getuid())
+	if u, err := user.Current(); err == nil {
+		r.User = u.Username
+	}
+	if err != nil {
+		r.ExitStatus = 1
+		r.Error = err.Error()
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// sessionStats are sent by the server after the feedback byte in ProxyModeFD,
+// see writeJSONMessage. Proxy counts the bytes itself in ProxyModeRelay.
+type sessionStats struct {
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+}
+
+// AuditFile is an io.Writer for Proxier.AuditLog that appends to a file
+// and rotates it. It is safe for use by concurrent Proxy processes:
+// writes and rotation are serialized using an flock(2) on Path + LockSuffix.
+// Each Write opens and closes the file, such that it can be rotated or
+// removed by other processes, too.
+type AuditFile struct {
+	Path string
+	// MaxSize, if > 0, makes Write rotate the file before writing if the
+	// write would make it larger than MaxSize bytes.
+	MaxSize int64
+	// MaxBackups is the number of rotated files that are kept as Path.1
+	// (the most recent), Path.2, and so on. If zero, all rotated files are
+	// kept. If negative, the file is removed on rotation, i.e., records
+	// are discarded.
+	MaxBackups int
+	// Mode is the permission of the file, 0600 if zero.
+	Mode os.FileMode
+}
+
+// Write appends p to the file.
+func (f *AuditFile) Write(p []byte) (int, error) {
+	mode := f.Mode
+	if mode == 0 {
+		mode = 0600
+	}
+	lock, err := os.OpenFile(f.Path+LockSuffix, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return 0, err
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	if f.MaxSize > 0 {
+		fi, err := os.Stat(f.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		if err == nil && fi.Size() > 0 && fi.Size()+int64(len(p)) > f.MaxSize {
+			if err := f.rotate(); err != nil {
+				return 0, fmt.Errorf("rotate audit file: %s", err)
+			}
+		}
+	}
+
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, mode)
+	if err != nil {
+		return 0, err
+	}
+	n, err := file.Write(p)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// rotate must be called with the lock held.
+func (f *AuditFile) rotate() error {
+	if f.MaxBackups < 0 {
+		return os.Remove(f.Path)
+	}
+	backups := f.MaxBackups
+	if backups == 0 {
+		// one more than exist, such that none is overwritten
+		for backups = 1; ; backups++ {
+			if _, err := os.Lstat(fmt.Sprintf("%s.%d", f.Path, backups)); os.IsNotExist(err) {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	for i := backups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.Path, i), fmt.Sprintf("%s.%d", f.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.Path, f.Path+".1")
+}
+
+// NewSyslogAuditWriter returns an io.Writer for Proxier.AuditLog that sends
+// each record as a message to the local syslog daemon, or journald's syslog
+// socket, with facility LOG_AUTHPRIV and the given tag.
+func NewSyslogAuditWriter(tag string) (io.Writer, error) {
+	return syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, tag)
+}
@@ -0,0 +1,149 @@
+package netssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAuditRecord(t *testing.T) {
+	start := time.Now()
+	rec := newAuditRecord(start, "/tmp/sock", peerInfo{Peer: Peer{KeyID: "alice"}, ConnID: "0123"})
+	rec.setStats(&sessionStats{BytesRead: 1, BytesWritten: 2})
+	var buf bytes.Buffer
+	require.NoError(t, writeAuditRecord(&buf, rec, errors.New("failed")))
+
+	line := buf.String()
+	assert.True(t, strings.HasSuffix(line, "}\n"))
+	assert.Equal(t, 1, strings.Count(line, "\n"))
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &m))
+	assert.Equal(t, "alice", m["key_id"])
+	assert.Equal(t, "0123", m["conn_id"])
+	assert.Equal(t, "/tmp/sock", m["server"])
+	assert.Equal(t, float64(1), m["bytes_from_client"])
+	assert.Equal(t, float64(2), m["bytes_to_client"])
+	assert.Equal(t, float64(1), m["exit_status"])
+	assert.Equal(t, "failed", m["error"])
+	assert.NotEmpty(t, m["user"])
+	assert.NotContains(t, m, "mode")
+}
+
+func TestAuditFileRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netssh")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	f := &AuditFile{Path: path, MaxSize: 10, MaxBackups: 2}
+	for _, line := range []string{"1111\n", "2222\n", "3333\n", "4444\n", "5555\n", "6666\n", "7777\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	content := func(path string) string {
+		b, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		return string(b)
+	}
+	assert.Equal(t, "7777\n", content(path))
+	assert.Equal(t, "5555\n6666\n", content(path+".1"))
+	assert.Equal(t, "3333\n4444\n", content(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+}
+
+func TestAuditFileNoBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netssh")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	f := &AuditFile{Path: path, MaxSize: 6, MaxBackups: -1}
+	for _, line := range []string{"1111\n", "2222\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "2222\n", string(b))
+	_, err = os.Stat(path + ".1")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAuditFileUnlimitedBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netssh")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	f := &AuditFile{Path: path, MaxSize: 6}
+	for _, line := range []string{"1111\n", "2222\n", "3333\n", "4444\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	for suffix, want := range map[string]string{"": "4444\n", ".1": "3333\n", ".2": "2222\n", ".3": "1111\n"} {
+		b, err := ioutil.ReadFile(path + suffix)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(b), "%s", suffix)
+	}
+}
+
+// Concurrent Proxy processes use distinct AuditFiles for the same path.
+func TestAuditFileConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netssh")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	const writers, records = 8, 50
+	line := strings.Repeat("x", 99) + "\n"
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f := &AuditFile{Path: path, MaxSize: 1000, MaxBackups: writers * records}
+			for j := 0; j < records; j++ {
+				_, err := f.Write([]byte(line))
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	files, err := filepath.Glob(path + "*")
+	require.NoError(t, err)
+	total := 0
+	for _, name := range files {
+		if name == path+LockSuffix {
+			continue
+		}
+		file, err := os.Open(name)
+		require.NoError(t, err)
+		s := bufio.NewScanner(file)
+		n := 0
+		for s.Scan() {
+			assert.Equal(t, line, s.Text()+"\n")
+			n++
+		}
+		file.Close()
+		assert.True(t, n <= 10, "%s has %d lines", name, n)
+		total += n
+	}
+	assert.Equal(t, writers*records, total)
+}
@@ -0,0 +1,153 @@
+// Package authorizedkeys generates authorized_keys(5) entries that force
+// a netssh Proxy invocation, and installs them idempotently.
+//
+// Entries managed by this package are identified by a marker in the key's
+// comment field that is derived from the entry's Service and KeyID.
+// Install and Remove only ever modify lines carrying the marker
+// and leave all other lines untouched.
+package authorizedkeys
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/problame/go-netssh/internal/shellquote"
+)
+
+// Entry describes an authorized_keys line for a program that calls netssh.Proxy.
+//
+// The forced command is ProxyCommand followed by the flags
+// --socket, --service, --key-id and --log, each only if the corresponding
+// field is set. The program must accept those flags, see example/cmd/proxy.go.
+type Entry struct {
+	// ProxyCommand is the argv prefix of the forced command,
+	// e.g. []string{"/usr/local/bin/myapp", "proxy"}.
+	ProxyCommand []string
+	// Socket is the path of the netssh.Listener's unix socket.
+	Socket string
+	// Service and KeyID identify the entry, see package comment.
+	Service string
+	KeyID   string
+	// LogFile is a log file for the proxy command.
+	LogFile string
+	// From restricts the client addresses, see from="pattern-list" in sshd(8).
+	From []string
+	// PublicKey is the client's key.
+	PublicKey ssh.PublicKey
+}
+
+var identifierRE = regexp.MustCompile(`^[A-Za-z0-9_.@+-]+$`)
+
+// marker is stored as the comment of the entry.
+func marker(service, keyID string) string {
+	return fmt.Sprintf("netssh:%s:%s", service, keyID)
+}
+
+func (e Entry) validate() error {
+	if len(e.ProxyCommand) == 0 {
+		return fmt.Errorf("proxy command must not be empty")
+	}
+	if !identifierRE.MatchString(e.Service) {
+		return fmt.Errorf("invalid service %q: must match %s", e.Service, identifierRE)
+	}
+	if !identifierRE.MatchString(e.KeyID) {
+		return fmt.Errorf("invalid key id %q: must match %s", e.KeyID, identifierRE)
+	}
+	for _, from := range e.From {
+		if from == "" || strings.ContainsAny(from, "\",\n\r\t ") {
+			return fmt.Errorf("invalid from pattern %q", from)
+		}
+	}
+	if e.PublicKey == nil {
+		return fmt.Errorf("public key must be set")
+	}
+	for _, arg := range e.Command() {
+		if strings.ContainsAny(arg, "\n\r") {
+			return fmt.Errorf("command arguments must not contain newlines: %q", arg)
+		}
+	}
+	return nil
+}
+
+// Command returns the argv of the forced command.
+func (e Entry) Command() []string {
+	argv := append([]string(nil), e.ProxyCommand...)
+	flag := func(name, value string) {
+		if value != "" {
+			argv = append(argv, "--"+name, value)
+		}
+	}
+	flag("socket", e.Socket)
+	flag("service", e.Service)
+	flag("key-id", e.KeyID)
+	flag("log", e.LogFile)
+	return argv
+}
+
+// Line returns the authorized_keys line for e, without trailing newline.
+func (e Entry) Line() (string, error) {
+	if err := e.validate(); err != nil {
+		return "", err
+	}
+
+	// sshd passes the command to the user's shell, and only unescapes \"
+	// when parsing the option's double-quoted value.
+	words := make([]string, len(e.Command()))
+	for i, arg := range e.Command() {
+		words[i] = shellquote.Quote(arg)
+	}
+	command := strings.Replace(strings.Join(words, " "), `"`, `\"`, -1)
+
+	options := []string{"restrict", fmt.Sprintf(`command="%s"`, command)}
+	if len(e.From) > 0 {
+		options = append(options, fmt.Sprintf(`from="%s"`, strings.Join(e.From, ",")))
+	}
+	key := bytes.TrimSpace(ssh.MarshalAuthorizedKey(e.PublicKey))
+	return fmt.Sprintf("%s %s %s", strings.Join(options, ","), key, marker(e.Service, e.KeyID)), nil
+}
+
+// update replaces the line(s) carrying marker m in content with line,
+// or appends line if there is none. If line is empty, lines carrying m are removed.
+func update(content []byte, m, line string) (updated []byte, changed bool, err error) {
+	var buf bytes.Buffer
+	found := false
+	s := bufio.NewScanner(bytes.NewReader(content))
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		l := s.Text()
+		if hasMarker(l, m) {
+			if line != "" && !found {
+				buf.WriteString(line)
+				buf.WriteString("\n")
+			}
+			found = true
+			continue
+		}
+		buf.WriteString(l)
+		buf.WriteString("\n")
+	}
+	if err := s.Err(); err != nil {
+		return nil, false, err
+	}
+	if !found {
+		if line == "" {
+			return content, false, nil
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	return buf.Bytes(), !bytes.Equal(buf.Bytes(), content), nil
+}
+
+func hasMarker(line, m string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return false
+	}
+	return strings.HasSuffix(line, " "+m)
+}
@@ -0,0 +1,151 @@
+package authorizedkeys_test
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/problame/go-netssh/authorizedkeys"
+)
+
+func testKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	return key
+}
+
+func TestEntryLine(t *testing.T) {
+	e := authorizedkeys.Entry{
+		ProxyCommand: []string{"/opt/my app/bin", "proxy"},
+		Socket:       "/run/my\"app\".sock",
+		Service:      "svc",
+		KeyID:        "host1",
+		From:         []string{"10.0.0.0/8", "*.example.com"},
+		PublicKey:    testKey(t),
+	}
+	line, err := e.Line()
+	require.NoError(t, err)
+	t.Log(line)
+
+	assert.True(t, strings.HasPrefix(line, `restrict,command="'/opt/my app/bin' proxy --socket '/run/my\"app\".sock' --service svc --key-id host1",from="10.0.0.0/8,*.example.com" ssh-ed25519 `))
+	assert.True(t, strings.HasSuffix(line, " netssh:svc:host1"))
+
+	// the forced command as parsed by sshd must evaluate to our argv in the shell
+	e.ProxyCommand = []string{"printf", `%s\n`, `it's "quoted"`}
+	line, err = e.Line()
+	require.NoError(t, err)
+	m := regexp.MustCompile(`command="((?:[^"\\]|\\.)*)"`).FindStringSubmatch(line)
+	require.NotNil(t, m)
+	command := strings.Replace(m[1], `\"`, `"`, -1)
+	out, err := exec.Command("/bin/sh", "-c", command).Output()
+	require.NoError(t, err)
+	assert.Equal(t, strings.Join(e.Command()[2:], "\n")+"\n", string(out))
+
+	e.KeyID = "has space"
+	_, err = e.Line()
+	assert.Error(t, err)
+}
+
+func TestInstallRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorizedkeys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "authorized_keys")
+
+	other := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHf0FvG5hSVq1pcZBx5ZDbt5ZuRwXHnc2T3EJ9lJYb9n someone\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(other), 0640))
+
+	e := authorizedkeys.Entry{
+		ProxyCommand: []string{"/bin/proxy"},
+		Service:      "svc",
+		KeyID:        "k1",
+		PublicKey:    testKey(t),
+	}
+	line, err := e.Line()
+	require.NoError(t, err)
+
+	readFile := func() string {
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	require.NoError(t, authorizedkeys.Install(path, e))
+	assert.Equal(t, other+line+"\n", readFile())
+	backup, err := ioutil.ReadFile(path + authorizedkeys.BackupSuffix)
+	require.NoError(t, err)
+	assert.Equal(t, other, string(backup))
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+
+	// idempotent
+	require.NoError(t, authorizedkeys.Install(path, e))
+	assert.Equal(t, other+line+"\n", readFile())
+
+	// update in place
+	e.From = []string{"192.168.0.1"}
+	updatedLine, err := e.Line()
+	require.NoError(t, err)
+	require.NoError(t, authorizedkeys.Install(path, e))
+	assert.Equal(t, other+updatedLine+"\n", readFile())
+
+	require.NoError(t, authorizedkeys.Remove(path, "svc", "k1"))
+	assert.Equal(t, other, readFile())
+	require.NoError(t, authorizedkeys.Remove(path, "svc", "k1"))
+	assert.Equal(t, other, readFile())
+}
+
+func TestInstallKeepsOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to change file ownership")
+	}
+	dir, err := ioutil.TempDir("", "authorizedkeys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	const uid, gid = 4242, 4343
+	require.NoError(t, os.Chown(dir, uid, gid))
+	path := filepath.Join(dir, "authorized_keys")
+
+	e := authorizedkeys.Entry{
+		ProxyCommand: []string{"/bin/proxy"},
+		Service:      "svc",
+		KeyID:        "k1",
+		PublicKey:    testKey(t),
+	}
+	owner := func(path string) (int, int) {
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		st := fi.Sys().(*syscall.Stat_t)
+		return int(st.Uid), int(st.Gid)
+	}
+
+	// a new file is owned by the directory's owner
+	require.NoError(t, authorizedkeys.Install(path, e))
+	u, g := owner(path)
+	assert.Equal(t, uid, u)
+	assert.Equal(t, gid, g)
+
+	// an existing file keeps its owner
+	require.NoError(t, os.Chown(path, uid+1, gid+1))
+	e.KeyID = "k2"
+	require.NoError(t, authorizedkeys.Install(path, e))
+	u, g = owner(path)
+	assert.Equal(t, uid+1, u)
+	assert.Equal(t, gid+1, g)
+	u, _ = owner(path + authorizedkeys.BackupSuffix)
+	assert.Equal(t, uid+1, u)
+}
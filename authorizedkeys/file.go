@@ -0,0 +1,146 @@
+package authorizedkeys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// BackupSuffix is appended to the authorized_keys file's path
+// to get the path of the copy made before modifying it.
+const BackupSuffix = ".netssh-backup"
+
+// lockSuffix is appended to the authorized_keys file's path to get the path
+// of the lock file. We cannot lock the authorized_keys file itself because
+// it is replaced on modification.
+const lockSuffix = ".netssh-lock"
+
+// Install adds e to the authorized_keys file at path, replacing an existing
+// entry with the same Service and KeyID. The file is created with mode 0600
+// if it does not exist. The file is not touched if it already contains the
+// entry as is.
+func Install(path string, e Entry) error {
+	line, err := e.Line()
+	if err != nil {
+		return err
+	}
+	return modify(path, marker(e.Service, e.KeyID), line)
+}
+
+// Remove removes the entry identified by service and keyID from the
+// authorized_keys file at path. It is not an error if there is no such entry.
+func Remove(path string, service, keyID string) error {
+	return modify(path, marker(service, keyID), "")
+}
+
+// modify updates the file at path under an exclusive lock, using a
+// temporary file and rename(2) so that sshd never sees a partially written
+// file, and keeps a backup of the previous version.
+//
+// The new file gets the mode and owner of the previous version, or, if there
+// is none, mode 0600 and the owner of the containing directory, so that sshd's
+// StrictModes accepts it if root manages another user's keys.
+func modify(path string, m, line string) error {
+	lock, err := os.OpenFile(path+lockSuffix, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	mode := os.FileMode(0600)
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exists := err == nil
+	owner := filepath.Dir(path)
+	if exists {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		mode = fi.Mode().Perm()
+		owner = path
+	}
+	fi, err := os.Stat(owner)
+	if err != nil {
+		return err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	uid, gid := int(st.Uid), int(st.Gid)
+
+	updated, changed, err := update(content, m, line)
+	if err != nil || !changed {
+		return err
+	}
+
+	if exists {
+		if err := writeFileSync(path+BackupSuffix, content, mode, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails after successful rename
+	if err := chown(tmp, uid, gid); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(updated); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func writeFileSync(path string, data []byte, mode os.FileMode, uid, gid int) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	err = chown(f, uid, gid)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// chown changes f's owner to uid and gid unless it already has them,
+// which only requires privileges if they differ.
+func chown(f *os.File, uid, gid int) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if st := fi.Sys().(*syscall.Stat_t); int(st.Uid) == uid && int(st.Gid) == gid {
+		return nil
+	}
+	return f.Chown(uid, gid)
+}
@@ -0,0 +1,89 @@
+package netssh
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultCertificateValidity is used if Dialer.CertificateValidity is zero.
+const DefaultCertificateValidity = 5 * time.Minute
+
+// certificateClockSkew backdates ValidAfter to tolerate clock differences
+// between us and the ssh server.
+const certificateClockSkew = 1 * time.Minute
+
+// CertificateSigner signs cert, an OpenSSH user certificate for a key pair
+// that Dialer.Dial generated for connecting to endpoint, typically by calling
+// cert.SignCert with the CA's key.
+// The signer may modify cert before signing it, e.g. to restrict
+// ValidPrincipals or to add critical options.
+type CertificateSigner func(ctx context.Context, endpoint Endpoint, cert *ssh.Certificate) error
+
+// CASigner returns a CertificateSigner that signs certificates with ca.
+func CASigner(ca ssh.Signer) CertificateSigner {
+	return func(_ context.Context, _ Endpoint, cert *ssh.Certificate) error {
+		return cert.SignCert(rand.Reader, ca)
+	}
+}
+
+// issueCertificate generates a key pair, has it signed by d.CertificateSigner
+// and adds both to endpoint as an identity, using ssh's convention of
+// loading the certificate from the identity file's path + "-cert.pub".
+// The identity is the first one ssh tries, such that other identities
+// don't use up the server's MaxAuthTries before it is offered.
+func (d *Dialer) issueCertificate(ctx context.Context, keys *tempKeys, endpoint Endpoint) (Endpoint, error) {
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return endpoint, err
+	}
+	pub, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		return endpoint, err
+	}
+
+	validity := d.CertificateValidity
+	if validity == 0 {
+		validity = DefaultCertificateValidity
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		KeyId:           fmt.Sprintf("netssh:%s@%s:%d", endpoint.User, endpoint.Host, now.Unix()),
+		ValidPrincipals: []string{endpoint.User},
+		ValidAfter:      uint64(now.Add(-certificateClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+	}
+	if err := d.CertificateSigner(ctx, endpoint, cert); err != nil {
+		return endpoint, fmt.Errorf("netssh: sign certificate: %s", err)
+	}
+	if cert.Signature == nil {
+		return endpoint, fmt.Errorf("netssh: sign certificate: CertificateSigner did not sign the certificate")
+	}
+
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return endpoint, err
+	}
+	path := keys.newName()
+	if err := keys.write(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return endpoint, err
+	}
+	if err := keys.write(path+"-cert.pub", ssh.MarshalAuthorizedKey(cert)); err != nil {
+		return endpoint, err
+	}
+
+	// IdentityFile precedes IdentityFiles, see identityFiles
+	endpoint.IdentityFiles = append([]string{path}, endpoint.identityFiles()...)
+	endpoint.IdentityFile = ""
+	return endpoint, nil
+}
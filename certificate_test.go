@@ -0,0 +1,69 @@
+package netssh
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDialerIssueCertificate(t *testing.T) {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+
+	d := Dialer{CertificateSigner: CASigner(ca), CertificateValidity: time.Hour}
+	keys, e, err := writeTempKeys(Endpoint{Host: "h", User: "u", IdentityFile: "/id0", IdentityFiles: []string{"/id"}}, true)
+	require.NoError(t, err)
+	defer keys.remove()
+
+	e, err = d.issueCertificate(context.Background(), keys, e)
+	require.NoError(t, err)
+	// the certificate is offered first
+	require.Len(t, e.IdentityFiles, 3)
+	assert.Equal(t, []string{"/id0", "/id"}, e.IdentityFiles[1:])
+	assert.Empty(t, e.IdentityFile)
+
+	certData, err := ioutil.ReadFile(e.IdentityFiles[0] + "-cert.pub")
+	require.NoError(t, err)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certData)
+	require.NoError(t, err)
+	cert, ok := pub.(*ssh.Certificate)
+	require.True(t, ok)
+
+	checker := ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return string(auth.Marshal()) == string(ca.PublicKey().Marshal())
+		},
+	}
+	assert.NoError(t, checker.CheckCert("u", cert))
+	assert.Error(t, checker.CheckCert("root", cert))
+	assert.True(t, time.Unix(int64(cert.ValidBefore), 0).Before(time.Now().Add(time.Hour+time.Minute)))
+
+	keyData, err := ioutil.ReadFile(e.IdentityFiles[0])
+	require.NoError(t, err)
+	signer, err := ssh.ParsePrivateKey(keyData)
+	require.NoError(t, err)
+	assert.Equal(t, cert.Key.Marshal(), signer.PublicKey().Marshal())
+
+	t.Run("signer-error", func(t *testing.T) {
+		d := Dialer{CertificateSigner: func(context.Context, Endpoint, *ssh.Certificate) error {
+			return errors.New("ca unavailable")
+		}}
+		_, err := d.Dial(context.Background(), Endpoint{Host: "h", User: "u"})
+		assert.EqualError(t, err, "netssh: sign certificate: ca unavailable")
+	})
+
+	t.Run("no-user", func(t *testing.T) {
+		_, err := d.Dial(context.Background(), Endpoint{Host: "h"})
+		assert.EqualError(t, err, "netssh: CertificateSigner requires Endpoint.User")
+	})
+}
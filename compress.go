@@ -0,0 +1,449 @@
+package netssh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression algorithms, see CompressionPolicy.
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+	CompressionLZ4  = "lz4"
+)
+
+var compressionAlgorithms = []string{CompressionNone, CompressionZstd, CompressionLZ4}
+
+// CompressionPolicy configures the compression of a connection's payload,
+// see Dialer.Compression and Listener.SetCompression.
+//
+// Compression is negotiated during the handshake, separately for each
+// direction: each side compresses the data it sends using its Send algorithm
+// if the peer accepts it, and sends it uncompressed otherwise.
+// The zero value sends uncompressed data and accepts all algorithms.
+//
+// Each Write is compressed and flushed on its own, such that interactive
+// exchanges don't stall, at the expense of the ratio achieved for small writes.
+// Use a bufio.Writer to batch small writes.
+type CompressionPolicy struct {
+	// Send is the algorithm for the data sent by this side, one of the
+	// Compression* constants. Empty is CompressionNone.
+	Send string
+	// Level is the compression level of Send, zero selects the default.
+	// For zstd, it is a zstd level from 1 to 22, which is mapped to the
+	// closest of the levels supported by the implementation.
+	// For lz4, it is 1 to 9 for the slower high compression mode.
+	Level int
+	// Accept lists the algorithms accepted for the data sent by the peer.
+	// If nil, all algorithms are accepted.
+	Accept []string
+}
+
+func (p CompressionPolicy) send() string {
+	if p.Send == "" {
+		return CompressionNone
+	}
+	return p.Send
+}
+
+func (p CompressionPolicy) accept() []string {
+	if p.Accept == nil {
+		return compressionAlgorithms
+	}
+	return p.Accept
+}
+
+func (p CompressionPolicy) validate() error {
+	for _, alg := range append([]string{p.send()}, p.Accept...) {
+		if !containsString(compressionAlgorithms, alg) {
+			return fmt.Errorf("netssh: unknown compression algorithm %q", alg)
+		}
+	}
+	if p.Level < 0 || (p.send() == CompressionLZ4 && p.Level > 9) || p.Level > 22 {
+		return fmt.Errorf("netssh: invalid %s compression level %d", p.send(), p.Level)
+	}
+	return nil
+}
+
+func containsString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+type compressionOffer struct {
+	Send   string   `json:"send"`
+	Accept []string `json:"accept"`
+}
+
+// compressionChoice is the server's choice of algorithms, each direction
+// is compressed using its own algorithm or CompressionNone.
+type compressionChoice struct {
+	ToServer string `json:"to_server"`
+	ToClient string `json:"to_client"`
+}
+
+// choose returns the server's choice for a client's offer.
+func (p CompressionPolicy) choose(offer compressionOffer) compressionChoice {
+	c := compressionChoice{ToServer: CompressionNone, ToClient: CompressionNone}
+	if containsString(compressionAlgorithms, offer.Send) && containsString(p.accept(), offer.Send) {
+		c.ToServer = offer.Send
+	}
+	if containsString(offer.Accept, p.send()) {
+		c.ToClient = p.send()
+	}
+	return c
+}
+
+// check validates the server's choice for the client's policy p.
+func (p CompressionPolicy) check(c compressionChoice) error {
+	if c.ToServer != CompressionNone && c.ToServer != p.send() {
+		return ProtocolError{fmt.Sprintf("server chose compression %q that was not offered", c.ToServer)}
+	}
+	if c.ToClient != CompressionNone && !containsString(p.accept(), c.ToClient) {
+		return ProtocolError{fmt.Sprintf("server chose compression %q that is not accepted", c.ToClient)}
+	}
+	return nil
+}
+
+// Compressed data is sent in frames, one or more per Write.
+// A frame consists of a header and the block:
+//
+//	kind (1 byte) | uncompressed length (4 bytes) | block length (4 bytes) | block
+//
+// The lengths are big endian. Each block is compressed independently.
+// Blocks that don't compress are sent as is.
+const (
+	compressFrameHeaderLen = 9
+	compressFrameStored    = 0
+	compressFrameBlock     = 1
+	// maxCompressBlock is the maximum uncompressed length of a frame.
+	maxCompressBlock = 64 * 1024
+)
+
+type blockCompressor interface {
+	// compress appends the compressed src to dst.
+	// It returns dst unmodified if src does not compress.
+	compress(dst, src []byte) []byte
+}
+
+type blockDecompressor interface {
+	// decompress decompresses src into dst, which has the uncompressed length.
+	decompress(dst, src []byte) error
+}
+
+func newBlockCompressor(alg string, level int) (blockCompressor, error) {
+	switch alg {
+	case CompressionZstd:
+		zlevel := zstd.SpeedDefault
+		if level > 0 {
+			zlevel = zstd.EncoderLevelFromZstd(level)
+		}
+		enc, err := zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zlevel),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(maxCompressBlock),
+			zstd.WithEncoderCRC(false))
+		if err != nil {
+			return nil, err
+		}
+		return zstdCompressor{enc}, nil
+	case CompressionLZ4:
+		if level > 0 {
+			return &lz4Compressor{hc: &lz4.CompressorHC{Level: lz4.Level1 << uint(level-1)}}, nil
+		}
+		return &lz4Compressor{fast: &lz4.Compressor{}}, nil
+	default:
+		return nil, fmt.Errorf("netssh: unknown compression algorithm %q", alg)
+	}
+}
+
+func newBlockDecompressor(alg string) (blockDecompressor, error) {
+	switch alg {
+	case CompressionZstd:
+		dec, err := zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(maxCompressBlock))
+		if err != nil {
+			return nil, err
+		}
+		return zstdDecompressor{dec}, nil
+	case CompressionLZ4:
+		return lz4Decompressor{}, nil
+	default:
+		return nil, fmt.Errorf("netssh: unknown compression algorithm %q", alg)
+	}
+}
+
+type zstdCompressor struct{ enc *zstd.Encoder }
+
+func (c zstdCompressor) compress(dst, src []byte) []byte {
+	out := c.enc.EncodeAll(src, dst)
+	if len(out)-len(dst) >= len(src) {
+		return dst
+	}
+	return out
+}
+
+type zstdDecompressor struct{ dec *zstd.Decoder }
+
+func (d zstdDecompressor) decompress(dst, src []byte) error {
+	out, err := d.dec.DecodeAll(src, dst[:0])
+	if err != nil {
+		return err
+	}
+	if len(out) != len(dst) || (len(out) > 0 && &out[0] != &dst[0]) {
+		return fmt.Errorf("zstd block has unexpected length %d", len(out))
+	}
+	return nil
+}
+
+type lz4Compressor struct {
+	fast *lz4.Compressor
+	hc   *lz4.CompressorHC
+}
+
+func (c *lz4Compressor) compress(dst, src []byte) []byte {
+	start := len(dst)
+	bound := lz4.CompressBlockBound(len(src))
+	for cap(dst)-start < bound {
+		dst = append(dst[:cap(dst)], 0)
+	}
+	block := dst[start : start+bound]
+	var n int
+	var err error
+	if c.hc != nil {
+		n, err = c.hc.CompressBlock(src, block)
+	} else {
+		n, err = c.fast.CompressBlock(src, block)
+	}
+	if err != nil || n == 0 || n >= len(src) {
+		return dst[:start]
+	}
+	return dst[:start+n]
+}
+
+type lz4Decompressor struct{}
+
+func (lz4Decompressor) decompress(dst, src []byte) error {
+	n, err := lz4.UncompressBlock(src, dst)
+	if err != nil {
+		return err
+	}
+	if n != len(dst) {
+		return fmt.Errorf("lz4 block has unexpected length %d", n)
+	}
+	return nil
+}
+
+// compressWriter compresses each Write into frames written to w.
+type compressWriter struct {
+	w    io.Writer
+	c    blockCompressor
+	buf  []byte
+	wire int64 // bytes written to w, atomic
+	err  error // sticky after a partially written frame
+}
+
+func (cw *compressWriter) Write(p []byte) (n int, err error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxCompressBlock {
+			chunk = chunk[:maxCompressBlock]
+		}
+		cw.buf = append(cw.buf[:0], make([]byte, compressFrameHeaderLen)...)
+		cw.buf = cw.c.compress(cw.buf, chunk)
+		kind := byte(compressFrameBlock)
+		if len(cw.buf) == compressFrameHeaderLen {
+			kind = compressFrameStored
+			cw.buf = append(cw.buf, chunk...)
+		}
+		cw.buf[0] = kind
+		binary.BigEndian.PutUint32(cw.buf[1:], uint32(len(chunk)))
+		binary.BigEndian.PutUint32(cw.buf[5:], uint32(len(cw.buf)-compressFrameHeaderLen))
+
+		wn, err := cw.w.Write(cw.buf)
+		atomic.AddInt64(&cw.wire, int64(wn))
+		if err != nil {
+			if wn > 0 {
+				cw.err = err
+			}
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// decompressReader reads the frames written by compressWriter.
+// A frame that is partially read when a read deadline expires
+// is continued by the next Read.
+type decompressReader struct {
+	r    partialReader
+	d    blockDecompressor
+	hdr  [compressFrameHeaderLen]byte
+	in   []byte // block of the current frame, nil until hdr is complete
+	out  []byte // decompressed data not yet returned by Read
+	buf  []byte // reused for in
+	obuf []byte // reused for out
+	wire int64  // bytes read from r, atomic
+}
+
+func newDecompressReader(r io.Reader, d blockDecompressor) *decompressReader {
+	dr := &decompressReader{d: d}
+	dr.r.r = &countingReader{r, &dr.wire}
+	return dr
+}
+
+func (dr *decompressReader) Read(p []byte) (int, error) {
+	for len(dr.out) == 0 {
+		if err := dr.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.out)
+	dr.out = dr.out[n:]
+	return n, nil
+}
+
+// next reads and decompresses the next frame into dr.out.
+func (dr *decompressReader) next() error {
+	if dr.in == nil {
+		if err := dr.r.readFull(dr.hdr[:]); err != nil {
+			return err
+		}
+		rawLen := binary.BigEndian.Uint32(dr.hdr[1:])
+		blockLen := binary.BigEndian.Uint32(dr.hdr[5:])
+		if rawLen > maxCompressBlock || blockLen > rawLen {
+			dr.r.err = ProtocolError{fmt.Sprintf("invalid compressed frame lengths %d, %d", rawLen, blockLen)}
+			return dr.r.err
+		}
+		if cap(dr.buf) < int(blockLen) {
+			dr.buf = make([]byte, maxCompressBlock)
+		}
+		dr.in = dr.buf[:blockLen]
+	}
+	if err := dr.r.readFull(dr.in); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	in := dr.in
+	dr.in = nil
+
+	rawLen := int(binary.BigEndian.Uint32(dr.hdr[1:]))
+	switch dr.hdr[0] {
+	case compressFrameStored:
+		if len(in) != rawLen {
+			dr.r.err = ProtocolError{"invalid stored frame length"}
+			return dr.r.err
+		}
+		dr.out = in
+	case compressFrameBlock:
+		if cap(dr.obuf) < rawLen {
+			dr.obuf = make([]byte, maxCompressBlock)
+		}
+		dr.out = dr.obuf[:rawLen]
+		if err := dr.d.decompress(dr.out, in); err != nil {
+			dr.out = nil
+			dr.r.err = ProtocolError{fmt.Sprintf("cannot decompress frame: %s", err)}
+			return dr.r.err
+		}
+	default:
+		dr.r.err = ProtocolError{fmt.Sprintf("unknown compressed frame kind %d", dr.hdr[0])}
+		return dr.r.err
+	}
+	return nil
+}
+
+// compression is the negotiated compression of a connection.
+// A nil *compression means no compression in either direction.
+type compression struct {
+	send, recv string
+	w          *compressWriter   // nil if the sent data is not compressed
+	r          *decompressReader // nil if the received data is not compressed
+}
+
+func newCompression(r io.Reader, w io.Writer, send, recv string, level int) (*compression, error) {
+	if send == CompressionNone && recv == CompressionNone {
+		return nil, nil
+	}
+	c := &compression{send: send, recv: recv}
+	if send != CompressionNone {
+		bc, err := newBlockCompressor(send, level)
+		if err != nil {
+			return nil, err
+		}
+		c.w = &compressWriter{w: w, c: bc}
+	}
+	if recv != CompressionNone {
+		bd, err := newBlockDecompressor(recv)
+		if err != nil {
+			return nil, err
+		}
+		c.r = newDecompressReader(r, bd)
+	}
+	return c, nil
+}
+
+// reader returns the reader for the received data, raw if it is not compressed.
+func (c *compression) reader(raw io.Reader) io.Reader {
+	if c == nil || c.r == nil {
+		return raw
+	}
+	return c.r
+}
+
+// writer returns the writer for the sent data, raw if it is not compressed.
+func (c *compression) writer(raw io.Writer) io.Writer {
+	if c == nil || c.w == nil {
+		return raw
+	}
+	return c.w
+}
+
+func (c *compression) algorithms() (send, recv string) {
+	if c == nil {
+		return CompressionNone, CompressionNone
+	}
+	return c.send, c.recv
+}
+
+// stats sets the wire byte counts of s for the compressed directions.
+func (c *compression) stats(s *ConnStats) {
+	s.WireBytesRead = s.BytesRead
+	s.WireBytesWritten = s.BytesWritten
+	if c == nil {
+		return
+	}
+	if c.r != nil {
+		s.WireBytesRead = atomic.LoadInt64(&c.r.wire)
+	}
+	if c.w != nil {
+		s.WireBytesWritten = atomic.LoadInt64(&c.w.wire)
+	}
+}
+
+// Compression returns the negotiated compression algorithms
+// of the data sent and received by conn, see CompressionPolicy.
+func (conn *SSHConn) Compression() (send, recv string) {
+	return conn.compression.algorithms()
+}
+
+// Compression is like SSHConn.Compression.
+func (f *ServeConn) Compression() (send, recv string) {
+	return f.compression.algorithms()
+}
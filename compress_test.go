@@ -0,0 +1,146 @@
+package netssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.Read(random)
+	compressible := bytes.Repeat([]byte("netssh compresses well "), 10000)
+	tcs := []struct {
+		alg   string
+		level int
+	}{
+		{CompressionZstd, 0},
+		{CompressionZstd, 1},
+		{CompressionZstd, 19},
+		{CompressionLZ4, 0},
+		{CompressionLZ4, 9},
+	}
+	for _, tc := range tcs {
+		c, err := newBlockCompressor(tc.alg, tc.level)
+		require.NoError(t, err)
+		d, err := newBlockDecompressor(tc.alg)
+		require.NoError(t, err)
+
+		var wire bytes.Buffer
+		cw := &compressWriter{w: &wire, c: c}
+		for _, data := range [][]byte{compressible, random, []byte("x")} {
+			n, err := cw.Write(data)
+			require.NoError(t, err)
+			assert.Equal(t, len(data), n)
+		}
+		assert.Equal(t, int64(wire.Len()), cw.wire)
+		assert.True(t, wire.Len() < len(compressible)/10+len(random)+1000,
+			"%s %d: %d bytes", tc.alg, tc.level, wire.Len())
+
+		dr := newDecompressReader(&wire, d)
+		got, err := ioutil.ReadAll(dr)
+		require.NoError(t, err)
+		want := append(append(append([]byte(nil), compressible...), random...), 'x')
+		assert.True(t, bytes.Equal(want, got), "%s %d", tc.alg, tc.level)
+	}
+}
+
+func TestDecompressReaderDeadline(t *testing.T) {
+	c, err := newBlockCompressor(CompressionLZ4, 0)
+	require.NoError(t, err)
+	var frame bytes.Buffer
+	msg := bytes.Repeat([]byte("hello"), 100)
+	(&compressWriter{w: &frame, c: c}).Write(msg)
+
+	a, b := net.Pipe()
+	d, _ := newBlockDecompressor(CompressionLZ4)
+	dr := newDecompressReader(b, d)
+	// net.Pipe's Write returns once the bytes have been read
+	go a.Write(frame.Bytes()[:frame.Len()/2])
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = dr.Read(make([]byte, 10))
+	netErr, ok := err.(net.Error)
+	require.True(t, ok, "%T %s", err, err)
+	assert.True(t, netErr.Timeout())
+
+	go func() {
+		a.Write(frame.Bytes()[frame.Len()/2:])
+		a.Close()
+	}()
+	b.SetReadDeadline(time.Time{})
+	got, err := ioutil.ReadAll(dr)
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+}
+
+func TestDecompressReaderInvalid(t *testing.T) {
+	d, _ := newBlockDecompressor(CompressionZstd)
+	for _, frame := range [][]byte{
+		{compressFrameBlock, 0, 0, 0, 3, 0, 0, 0, 3, 1, 2, 3},
+		{compressFrameStored, 0, 0, 0, 3, 0, 0, 0, 2, 1, 2},
+		{7, 0, 0, 0, 1, 0, 0, 0, 1, 1},
+		{compressFrameStored, 0xff, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		dr := newDecompressReader(bytes.NewReader(frame), d)
+		_, err := dr.Read(make([]byte, 10))
+		_, ok := err.(ProtocolError)
+		assert.True(t, ok, "%v: %T %s", frame, err, err)
+	}
+
+	dr := newDecompressReader(bytes.NewReader([]byte{compressFrameStored, 0, 0, 0, 3, 0, 0, 0, 3, 1}), d)
+	_, err := dr.Read(make([]byte, 10))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	none := compressionChoice{CompressionNone, CompressionNone}
+	tcs := []struct {
+		client, server CompressionPolicy
+		choice         compressionChoice
+	}{
+		{CompressionPolicy{}, CompressionPolicy{}, none},
+		{CompressionPolicy{Send: CompressionZstd}, CompressionPolicy{}, compressionChoice{CompressionZstd, CompressionNone}},
+		{CompressionPolicy{Send: CompressionZstd}, CompressionPolicy{Send: CompressionLZ4}, compressionChoice{CompressionZstd, CompressionLZ4}},
+		{CompressionPolicy{Send: CompressionZstd}, CompressionPolicy{Accept: []string{CompressionLZ4}}, none},
+		{CompressionPolicy{Accept: []string{CompressionNone}}, CompressionPolicy{Send: CompressionLZ4}, none},
+	}
+	for _, tc := range tcs {
+		offer := compressionOffer{tc.client.send(), tc.client.accept()}
+		choice := tc.server.choose(offer)
+		assert.Equal(t, tc.choice, choice, "%#v %#v", tc.client, tc.server)
+		assert.NoError(t, tc.client.check(choice))
+	}
+
+	client := CompressionPolicy{Send: CompressionZstd, Accept: []string{CompressionZstd}}
+	assert.Error(t, client.check(compressionChoice{CompressionLZ4, CompressionNone}))
+	assert.Error(t, client.check(compressionChoice{CompressionNone, CompressionLZ4}))
+
+	// future algorithms are declined
+	choice := CompressionPolicy{}.choose(compressionOffer{"brotli", compressionAlgorithms})
+	assert.Equal(t, none, choice)
+}
+
+func TestCompressionPolicyValidate(t *testing.T) {
+	assert.NoError(t, CompressionPolicy{}.validate())
+	assert.NoError(t, CompressionPolicy{Send: CompressionZstd, Level: 22}.validate())
+	assert.Error(t, CompressionPolicy{Send: "gzip"}.validate())
+	assert.Error(t, CompressionPolicy{Accept: []string{"gzip"}}.validate())
+	assert.Error(t, CompressionPolicy{Send: CompressionLZ4, Level: 10}.validate())
+	assert.Error(t, CompressionPolicy{Send: CompressionZstd, Level: -1}.validate())
+}
+
+func TestConnStatsCompressionRatio(t *testing.T) {
+	read, written := ConnStats{}.CompressionRatio()
+	assert.Equal(t, 1.0, read)
+	assert.Equal(t, 1.0, written)
+	read, written = ConnStats{BytesRead: 100, WireBytesRead: 25, BytesWritten: 10, WireBytesWritten: 10}.CompressionRatio()
+	assert.Equal(t, 4.0, read)
+	assert.Equal(t, 1.0, written)
+}
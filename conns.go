@@ -0,0 +1,128 @@
+package netssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// proxyFeedbackShutdown is sent to Proxy for connections closed by Shutdown.
+// Proxy exits with non-zero status for any feedback other than 0.
+const proxyFeedbackShutdown byte = 2
+
+// ErrListenerShutdown is returned by Accept for connections that
+// raced with Shutdown.
+var ErrListenerShutdown = errors.New("netssh: listener shut down")
+
+func newListener(l *net.UnixListener, path string, unlink bool, lock *os.File) *Listener {
+	return &Listener{
+		l:      l,
+		path:   path,
+		unlink: unlink,
+		lock:   lock,
+		// no policy, but the handshake is still limited
+		handshakeTimeout: AdmissionPolicy{}.handshakeTimeout(),
+		conns:            make(map[*ServeConn]struct{}),
+		shutdown:         make(chan struct{}),
+		closed:           make(chan struct{}),
+		accepted:         make(chan acceptResult),
+		loopDone:         make(chan struct{}),
+	}
+}
+
+func (l *Listener) isClosed() bool {
+	select {
+	case <-l.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Listener) track(c *ServeConn) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.shuttingDown {
+		return ErrListenerShutdown
+	}
+	c.l = l
+	c.accepted = time.Now()
+	l.conns[c] = struct{}{}
+	return nil
+}
+
+func (l *Listener) untrack(c *ServeConn) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if _, ok := l.conns[c]; !ok {
+		return
+	}
+	delete(l.conns, c)
+	if len(l.conns) == 0 && l.idle != nil {
+		close(l.idle)
+	}
+}
+
+// Conns returns the connections accepted by l that have not been closed yet,
+// in the order they were accepted.
+func (l *Listener) Conns() []*ServeConn {
+	l.mtx.Lock()
+	conns := make([]*ServeConn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mtx.Unlock()
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].accepted.Before(conns[j].accepted)
+	})
+	return conns
+}
+
+// Shutdown closes the listener, notifies active connections through
+// ServeConn.ShuttingDown and waits for them to be closed.
+// If ctx is done before, Shutdown closes the remaining connections such that
+// Proxy exits with non-zero status and returns ctx.Err().
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.mtx.Lock()
+	if !l.shuttingDown {
+		l.shuttingDown = true
+		close(l.shutdown)
+		l.idle = make(chan struct{})
+		if len(l.conns) == 0 {
+			close(l.idle)
+		}
+	}
+	idle := l.idle
+	l.mtx.Unlock()
+
+	err := l.Close()
+
+	select {
+	case <-idle:
+		return err
+	case <-ctx.Done():
+	}
+	for _, c := range l.Conns() {
+		c.closeWithFeedback(proxyFeedbackShutdown)
+	}
+	return ctx.Err()
+}
+
+// ShuttingDown returns a channel that is closed when Shutdown is called
+// on the Listener that accepted f. Handlers should finish their work and
+// close f.
+// The channel is nil for connections served by Proxier.Handler.
+func (f *ServeConn) ShuttingDown() <-chan struct{} {
+	if f.l == nil {
+		return nil
+	}
+	return f.l.shutdown
+}
+
+// Accepted returns the time at which f was accepted.
+func (f *ServeConn) Accepted() time.Time {
+	return f.accepted
+}
@@ -0,0 +1,227 @@
+package netssh
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ftrvxmtrx/fd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// relayClient plays Proxy in ProxyModeRelay and the dialing side,
+// without involving stdio.
+type relayClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func dialRelayClient(t *testing.T, server string) *relayClient {
+	c, resp := dialRelayClientAs(t, server, Peer{})
+	require.Equal(t, proxy_mode_ok_msg, resp)
+	c.handshake()
+	return c
+}
+
+// dialRelayClientAs returns the server's response to the mode request.
+func dialRelayClientAs(t *testing.T, server string, peer Peer) (*relayClient, []byte) {
+	conn, err := net.Dial("unix", server)
+	require.NoError(t, err)
+	c := &relayClient{t, conn}
+	_, err = conn.Write(proxy_mode_relay_msg)
+	require.NoError(t, err)
+	require.NoError(t, writePeerInfo(conn, peerInfo{Peer: peer}))
+	resp := make([]byte, len(proxy_mode_ok_msg))
+	_, err = io.ReadFull(conn, resp)
+	require.NoError(t, err)
+	return c, resp
+}
+
+func (c *relayClient) handshake() {
+	typ, payload := c.readFrame()
+	require.Equal(c.t, relayFrameData, int(typ))
+	require.Equal(c.t, banner_msg, payload)
+	_, err := c.conn.Write(begin_msg)
+	require.NoError(c.t, err)
+}
+
+func (c *relayClient) readFrame() (typ byte, payload []byte) {
+	var hdr [relayFrameHeaderLen]byte
+	_, err := io.ReadFull(c.conn, hdr[:])
+	require.NoError(c.t, err)
+	payload = make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	_, err = io.ReadFull(c.conn, payload)
+	require.NoError(c.t, err)
+	return hdr[0], payload
+}
+
+// feedback skips data frames and returns the feedback byte.
+func (c *relayClient) feedback() byte {
+	for {
+		typ, payload := c.readFrame()
+		if typ == relayFrameExit {
+			return payload[0]
+		}
+	}
+}
+
+// connect returns a connection from c to l, accepted by l.
+func connect(t *testing.T, l *Listener) (*relayClient, *ServeConn) {
+	clients := make(chan *relayClient, 1)
+	go func() {
+		clients <- dialRelayClient(t, l.Addr().String())
+	}()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	return <-clients, conn
+}
+
+func listenTemp(t *testing.T) (*Listener, func()) {
+	path, cleanup := tempSocketPath(t)
+	l, err := Listen(path)
+	require.NoError(t, err)
+	return l, func() {
+		l.Close()
+		cleanup()
+	}
+}
+
+func TestListenerConns(t *testing.T) {
+	l, cleanup := listenTemp(t)
+	defer cleanup()
+
+	var clients []*relayClient
+	var conns []*ServeConn
+	for i := 0; i < 3; i++ {
+		client, conn := connect(t, l)
+		clients = append(clients, client)
+		conns = append(conns, conn)
+	}
+	assert.Equal(t, conns, l.Conns())
+
+	require.NoError(t, conns[1].Close())
+	require.NoError(t, conns[1].Close(), "Close is idempotent")
+	assert.Equal(t, []*ServeConn{conns[0], conns[2]}, l.Conns())
+	assert.Equal(t, byte(0), clients[1].feedback())
+}
+
+func TestListenerShutdownDrains(t *testing.T) {
+	l, cleanup := listenTemp(t)
+	defer cleanup()
+
+	client, conn := connect(t, l)
+
+	go func() {
+		<-conn.ShuttingDown()
+		conn.Write([]byte("bye"))
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, l.Shutdown(ctx))
+	assert.Empty(t, l.Conns())
+	typ, payload := client.readFrame()
+	assert.Equal(t, relayFrameData, int(typ))
+	assert.Equal(t, "bye", string(payload))
+	assert.Equal(t, byte(0), client.feedback())
+
+	_, err := l.Accept()
+	assert.Error(t, err)
+}
+
+func TestListenerShutdownDeadline(t *testing.T) {
+	l, cleanup := listenTemp(t)
+	defer cleanup()
+
+	client, conn := connect(t, l)
+
+	// a handler that ignores the shutdown notification
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, conn)
+		readErr <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, l.Shutdown(ctx))
+	assert.Empty(t, l.Conns())
+	assert.Equal(t, proxyFeedbackShutdown, client.feedback())
+	assert.Error(t, <-readErr, "read must be interrupted")
+}
+
+// TestListenerLegacyProxy plays a Proxy that predates the proxy mode
+// negotiation and passes the fds right away.
+func TestListenerLegacyProxy(t *testing.T) {
+	l, cleanup := listenTemp(t)
+	defer cleanup()
+
+	stdin, clientOut, err := os.Pipe()
+	require.NoError(t, err)
+	clientIn, stdout, err := os.Pipe()
+	require.NoError(t, err)
+	control, err := net.Dial("unix", l.Addr().String())
+	require.NoError(t, err)
+	defer control.Close()
+	require.NoError(t, fd.Put(control.(*net.UnixConn), stdin, stdout))
+	stdin.Close()
+	stdout.Close()
+
+	go func() {
+		banner := make([]byte, len(banner_msg))
+		if _, err := io.ReadFull(clientIn, banner); err == nil {
+			clientOut.Write(begin_msg)
+			clientOut.Write([]byte("hello"))
+		}
+	}()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	assert.Equal(t, ProxyModeFD, conn.ProxyMode())
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	require.NoError(t, conn.Close())
+	var feedback [1]byte
+	_, err = io.ReadFull(control, feedback[:])
+	require.NoError(t, err)
+	assert.Equal(t, byte(0), feedback[0])
+}
+
+func TestListenerHandshakeTimeout(t *testing.T) {
+	l, cleanup := listenTemp(t)
+	defer cleanup()
+	l.SetAdmissionPolicy(AdmissionPolicy{MaxConns: 1, HandshakeTimeout: 250 * time.Millisecond})
+	_, conn := connect(t, l) // starts accepting
+	require.NoError(t, conn.Close())
+
+	// a client that never sends anything is disconnected
+	control, err := net.Dial("unix", l.Addr().String())
+	require.NoError(t, err)
+	defer control.Close()
+	_, err = l.Accept()
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.NoError(t, control.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = control.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	// its handshake no longer counts towards MaxConns,
+	// and the deadline doesn't outlive the handshake
+	c, conn := connect(t, l)
+	defer conn.Close()
+	time.Sleep(400 * time.Millisecond)
+	_, err = c.conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
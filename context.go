@@ -2,29 +2,36 @@ package netssh
 
 import (
 	"context"
+	"log/slog"
 )
 
 type contextKey int
 
 const (
 	contextKeyLog contextKey = iota
+	contextKeyDialTrace
 )
 
+// Logger is a Printf-style logger such as *log.Logger,
+// see NewPrintfHandler.
 type Logger interface {
 	Printf(format string, args ...interface{})
 }
 
-type discardLog struct {}
-func (d discardLog) Printf(format string, args ...interface{}) {}
-
-func contextLog(ctx context.Context) (log Logger) {
-	log, ok := ctx.Value(contextKeyLog).(Logger)
+func contextLog(ctx context.Context) *slog.Logger {
+	log, ok := ctx.Value(contextKeyLog).(*slog.Logger)
 	if !ok {
-		log = discardLog{}
+		return discardLogger
 	}
 	return log
 }
 
-func ContextWithLog(ctx context.Context, log Logger) context.Context {
+// ContextWithLogger returns a context that makes Dial and Proxy log to log.
+func ContextWithLogger(ctx context.Context, log *slog.Logger) context.Context {
 	return context.WithValue(ctx, contextKeyLog, log)
-}
\ No newline at end of file
+}
+
+// ContextWithLog is ContextWithLogger with a NewPrintfHandler for log.
+func ContextWithLog(ctx context.Context, log Logger) context.Context {
+	return ContextWithLogger(ctx, slog.New(NewPrintfHandler(log)))
+}
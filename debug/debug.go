@@ -0,0 +1,228 @@
+// Package debug provides an http.Handler that lists the live connections
+// of netssh, similar to net/http/pprof:
+//
+//	h := debug.NewHandler()
+//	dialer := &netssh.Dialer{Hooks: h.DialerHooks()}
+//	h.AddListener(listener)
+//	http.Handle("/debug/netssh", h)
+//
+// GET lists the connections as text, or as JSON with ?format=json.
+// POST with form value close=<connection ID> closes the connection.
+// The POST must carry the CloseHeader, e.g.
+//
+//	curl -H 'X-Netssh-Close: 1' -d close=<connection ID> http://localhost:6060/debug/netssh
+//
+// A web page cannot make a browser send a custom header to another origin
+// without a CORS preflight, which the handler doesn't answer, so the header
+// protects against cross-site requests forged by pages the operator visits.
+//
+// The handler exposes peer identities and ssh's stderr and must not be
+// reachable by untrusted clients.
+package debug
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/problame/go-netssh"
+)
+
+// CloseHeader must be set, to any value, on POST requests that close a connection.
+const CloseHeader = "X-Netssh-Close"
+
+// stderrTailLines is the number of lines of ssh's stderr shown in the text output.
+const stderrTailLines = 5
+
+// Handler is the http.Handler, see the package documentation.
+type Handler struct {
+	mtx       sync.Mutex
+	dialed    map[*netssh.SSHConn]struct{}
+	listeners map[*netssh.Listener]struct{}
+}
+
+func NewHandler() *Handler {
+	return &Handler{
+		dialed:    make(map[*netssh.SSHConn]struct{}),
+		listeners: make(map[*netssh.Listener]struct{}),
+	}
+}
+
+// DialerHooks returns the hooks that make h list the connections of a Dialer,
+// see netssh.CombineDialerHooks for using them alongside other hooks.
+// Connections are listed until their ssh process exited.
+func (h *Handler) DialerHooks() netssh.DialerHooks {
+	return netssh.DialerHooks{
+		OnHandshakeDone: func(_ context.Context, conn *netssh.SSHConn) {
+			h.mtx.Lock()
+			h.dialed[conn] = struct{}{}
+			h.mtx.Unlock()
+		},
+		OnClose: func(conn *netssh.SSHConn, exit netssh.SSHExit) {
+			h.mtx.Lock()
+			delete(h.dialed, conn)
+			h.mtx.Unlock()
+		},
+	}
+}
+
+// AddListener makes h list the connections returned by l.Conns.
+func (h *Handler) AddListener(l *netssh.Listener) {
+	h.mtx.Lock()
+	h.listeners[l] = struct{}{}
+	h.mtx.Unlock()
+}
+
+// RemoveListener undoes AddListener.
+func (h *Handler) RemoveListener(l *netssh.Listener) {
+	h.mtx.Lock()
+	delete(h.listeners, l)
+	h.mtx.Unlock()
+}
+
+// Conn describes a connection in the JSON output.
+type Conn struct {
+	// Kind is "dial" for SSHConns and "serve" for ServeConns.
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+	PID  int    `json:"pid"`
+	// Endpoint is the ssh destination for SSHConns
+	// and the Listener's socket for ServeConns.
+	Endpoint     string        `json:"endpoint"`
+	Peer         *netssh.Peer  `json:"peer,omitempty"`
+	ProxyMode    string        `json:"proxy_mode,omitempty"`
+	Age          time.Duration `json:"age"`
+	BytesRead    int64         `json:"bytes_read"`
+	BytesWritten int64         `json:"bytes_written"`
+	LastActivity time.Time     `json:"last_activity"`
+	Stderr       string        `json:"stderr,omitempty"`
+
+	close func() error
+}
+
+// conns returns the live connections, dialed first, then oldest first.
+func (h *Handler) conns() []Conn {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	now := time.Now()
+	var conns []Conn
+	for c := range h.dialed {
+		stats := c.Stats()
+		conns = append(conns, Conn{
+			Kind:         "dial",
+			ID:           c.ID(),
+			PID:          stats.PID,
+			Endpoint:     c.Endpoint().String(),
+			Age:          now.Sub(stats.ProcessStarted),
+			BytesRead:    stats.BytesRead,
+			BytesWritten: stats.BytesWritten,
+			LastActivity: stats.LastActivity,
+			Stderr:       c.Stderr(),
+			close:        c.Close,
+		})
+	}
+	for l := range h.listeners {
+		for _, c := range l.Conns() {
+			stats := c.Stats()
+			peer := c.Peer()
+			conns = append(conns, Conn{
+				Kind:         "serve",
+				ID:           c.ID(),
+				PID:          stats.PID,
+				Endpoint:     l.Addr().String(),
+				Peer:         &peer,
+				ProxyMode:    c.ProxyMode().String(),
+				Age:          now.Sub(c.Accepted()),
+				BytesRead:    stats.BytesRead,
+				BytesWritten: stats.BytesWritten,
+				LastActivity: stats.LastActivity,
+				close:        c.Close,
+			})
+		}
+	}
+	sort.SliceStable(conns, func(i, j int) bool {
+		if conns[i].Kind != conns[j].Kind {
+			return conns[i].Kind == "dial"
+		}
+		return conns[i].Age > conns[j].Age
+	})
+	return conns
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if r.FormValue("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(h.conns())
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeText(w, h.conns())
+	case http.MethodPost:
+		if r.Header.Get(CloseHeader) == "" {
+			http.Error(w, "missing header "+CloseHeader, http.StatusForbidden)
+			return
+		}
+		id := r.FormValue("close")
+		if id == "" {
+			http.Error(w, "missing form value close", http.StatusBadRequest)
+			return
+		}
+		for _, c := range h.conns() {
+			if c.ID == id {
+				if err := c.close(); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				fmt.Fprintf(w, "closed %s connection %s\n", c.Kind, c.ID)
+				return
+			}
+		}
+		http.Error(w, "no such connection", http.StatusNotFound)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeText(w http.ResponseWriter, conns []Conn) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "KIND\tID\tPID\tENDPOINT\tPEER\tAGE\tREAD\tWRITTEN\tIDLE\n")
+	now := time.Now()
+	for _, c := range conns {
+		peer := "-"
+		if c.Peer != nil && c.Peer.ID() != "" {
+			peer = c.Peer.ID()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%d\t%d\t%s\n",
+			c.Kind, c.ID, c.PID, c.Endpoint, peer,
+			c.Age.Round(time.Second), c.BytesRead, c.BytesWritten,
+			now.Sub(c.LastActivity).Round(time.Second))
+	}
+	tw.Flush()
+	for _, c := range conns {
+		if c.Stderr == "" {
+			continue
+		}
+		fmt.Fprintf(w, "\nstderr of %s (last %d lines):\n", c.ID, stderrTailLines)
+		for _, line := range tail(c.Stderr, stderrTailLines) {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+}
+
+// tail returns the last n lines of s.
+func tail(s string, n int) []string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
@@ -0,0 +1,118 @@
+package debug_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/problame/go-netssh"
+	"github.com/problame/go-netssh/debug"
+	"github.com/problame/go-netssh/netsshtest"
+)
+
+func TestMain(m *testing.M) {
+	netsshtest.Main()
+	os.Exit(m.Run())
+}
+
+func TestHandler(t *testing.T) {
+	s, err := netsshtest.NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+	h := debug.NewHandler()
+	h.AddListener(s.Listener)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	served := make(chan *netssh.ServeConn, 2)
+	go func() {
+		for {
+			conn, err := s.Accept()
+			if err != nil {
+				return
+			}
+			served <- conn
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+	list := func() (conns []debug.Conn) {
+		resp, err := http.Get(srv.URL + "?format=json")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&conns))
+		return conns
+	}
+	d := netssh.Dialer{Hooks: h.DialerHooks()}
+	conn, err := d.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{}))
+	require.NoError(t, err)
+	defer conn.Close()
+	serveConn := <-served
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	require.NoError(t, err)
+
+	conns := list()
+	require.Len(t, conns, 2)
+	assert.Equal(t, "dial", conns[0].Kind)
+	assert.Equal(t, conn.ID(), conns[0].ID)
+	assert.Equal(t, conn.Cmd().Process.Pid, conns[0].PID)
+	assert.Equal(t, int64(5), conns[0].BytesWritten)
+	assert.Equal(t, "serve", conns[1].Kind)
+	assert.Equal(t, serveConn.ID(), conns[1].ID)
+	assert.Equal(t, int64(5), conns[1].BytesRead)
+	assert.Equal(t, s.Socket(), conns[1].Endpoint)
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	text, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(text), "KIND"), "%s", text)
+	assert.Contains(t, string(text), serveConn.ID())
+
+	resp, err = http.PostForm(srv.URL, url.Values{"close": {serveConn.ID()}})
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "no %s header", debug.CloseHeader)
+	assert.Len(t, list(), 2)
+
+	resp = postClose(t, srv.URL, serveConn.ID())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "server closed the connection")
+	// ssh exits on its own, which ends the listing of conn
+	assert.Eventually(t, func() bool { return len(list()) == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	conn, err = d.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{}))
+	require.NoError(t, err)
+	defer conn.Close()
+	<-served
+	resp = postClose(t, srv.URL, conn.ID())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// the server notices shortly after ssh was terminated
+	assert.Eventually(t, func() bool { return len(list()) == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func postClose(t *testing.T, target, id string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(url.Values{"close": {id}}.Encode()))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(debug.CloseHeader, "1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
@@ -3,9 +3,13 @@ package netssh
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"os"
 	"os/exec"
 	"sync"
 	"syscall"
@@ -15,14 +19,76 @@ import (
 )
 
 type Endpoint struct {
-	Host         string
-	User         string
-	Port         uint16
+	Host string
+	User string
+	// Port is omitted from the ssh command line if zero, i.e., ssh uses its default.
+	Port uint16
+	// IdentityFile is equivalent to a one-element IdentityFiles and may be empty.
 	IdentityFile string
 	SSHCommand   string
 	Options      []string
+
+	// IdentityFiles are passed to ssh in order using -i.
+	IdentityFiles []string
+	// CertificateFile is an OpenSSH user certificate matching one of the identities.
+	CertificateFile string
+	// IdentitiesOnly restricts ssh to the configured identities,
+	// even if the authentication agent offers more.
+	IdentitiesOnly bool
+	// PrivateKeys are in-memory private keys in a format understood by ssh.
+	// CmdArgs ignores them: Dial writes them to temporary files with mode 0600
+	// and passes them as identity files after IdentityFiles.
+	// The files are removed when the connection is closed.
+	PrivateKeys [][]byte
+	// Via lists jump hosts, in the order in which they are traversed
+	// to reach Host. See CmdArgs for how they are passed to ssh.
+	Via []Endpoint
+
+	// The ssh process runs with an empty environment unless configured
+	// otherwise through the following fields. See CmdArgs for precedence.
+	// Jump hosts in Via share the environment of the Endpoint passed to Dial,
+	// the fields are ignored for hops, except for ForwardAgent, which
+	// applies to each hop on its own.
+
+	// InheritEnv passes the entire environment of the calling process.
+	InheritEnv bool
+	// PassEnv names variables to pass from the calling process's environment.
+	PassEnv []string
+	// Env contains explicit variables in KEY=value form.
+	Env []string
+	// AgentSocket is the path to the ssh-agent socket used for authentication,
+	// passed as SSH_AUTH_SOCK.
+	AgentSocket string
+	// ForwardAgent enables forwarding of the authentication agent connection.
+	// Unlike the other fields above, it is honored for jump hosts in Via.
+	ForwardAgent bool
+
+	// ServerKey, if set, makes Dial encrypt the connection end-to-end
+	// using TLS 1.3 and authenticate the server by this key, such that the
+	// data cannot be read or modified by Proxy's host or the server's socket,
+	// see EncryptionPolicy. Dial fails with ServerKeyMismatchError if the
+	// server presents another key. The client's key is Dialer.ClientKey.
+	// Connections served by Proxier.Handler cannot be encrypted.
+	// A Write that times out breaks encrypted connections.
+	// Jump hosts in Via ignore it.
+	// Servers running a version of this package without support for
+	// encryption receive the options of Dial as data of the connection,
+	// see Dialer.NegotiateOptions. Dial sends no data of the application
+	// before the TLS handshake completed.
+	ServerKey ed25519.PublicKey
 }
 
+// CmdArgs returns the ssh command line used to connect to the endpoint.
+//
+// If e.Via is non-empty, the jump hosts are rendered as a ProxyJump chain.
+// Since ProxyJump cannot express per-hop settings, the chain is rendered as
+// nested ProxyCommand invocations of ssh -W instead if any hop sets
+// identities, SSHCommand, Options or ForwardAgent.
+// The Via field of hops is ignored.
+//
+// The returned env is built from the calling process's environment
+// (all of it if e.InheritEnv, otherwise only the variables in e.PassEnv),
+// overridden by e.Env, overridden by e.AgentSocket.
 func (e Endpoint) CmdArgs() (cmd string, args []string, env []string) {
 
 	if e.SSHCommand != "" {
@@ -32,22 +98,56 @@ func (e Endpoint) CmdArgs() (cmd string, args []string, env []string) {
 	}
 
 	args = make([]string, 0, 2*len(e.Options)+4)
-	args = append(args,
-		"-p", fmt.Sprintf("%d", e.Port),
-		"-T",
-		"-i", e.IdentityFile,
-		"-o", "BatchMode=yes",
-	)
+	if e.Port != 0 {
+		args = append(args, "-p", fmt.Sprintf("%d", e.Port))
+	}
+	args = append(args, "-T")
+	for _, identityFile := range e.identityFiles() {
+		args = append(args, "-i", identityFile)
+	}
+	if e.CertificateFile != "" {
+		args = append(args, "-o", "CertificateFile="+e.CertificateFile)
+	}
+	if e.IdentitiesOnly {
+		args = append(args, "-o", "IdentitiesOnly=yes")
+	}
+	args = append(args, "-o", "BatchMode=yes")
+	if e.ForwardAgent {
+		args = append(args, "-o", "ForwardAgent=yes")
+	}
 	for _, option := range e.Options {
 		args = append(args, "-o", option)
 	}
-	args = append(args, fmt.Sprintf("%s@%s", e.User, e.Host))
+	args = append(args, e.viaArgs()...)
+	args = append(args, e.destination())
 
-	env = []string{}
+	env = e.environ(os.Environ())
 
 	return
 }
 
+// String returns the destination as [user@]host[:port].
+// The jump hosts in Via are not included.
+func (e Endpoint) String() string {
+	return e.proxyJumpSpec()
+}
+
+func (e Endpoint) identityFiles() []string {
+	files := make([]string, 0, len(e.IdentityFiles)+1)
+	if e.IdentityFile != "" {
+		files = append(files, e.IdentityFile)
+	}
+	return append(files, e.IdentityFiles...)
+}
+
+func (e Endpoint) destination() string {
+	if e.User == "" {
+		// hops in Via commonly rely on ssh's default
+		return e.Host
+	}
+	return fmt.Sprintf("%s@%s", e.User, e.Host)
+}
+
 type SSHConn struct {
 	cmd    *exec.Cmd
 	stdin  io.WriteCloser
@@ -56,6 +156,29 @@ type SSHConn struct {
 	shutdownMtx    sync.Mutex
 	shutdownResult *shutdownResult // TODO not used anywhere
 	cmdCancel      context.CancelFunc
+
+	// waitProcess sets exit and closes exited once ssh exited
+	exited   chan struct{}
+	exitMtx  sync.Mutex
+	exit     SSHExit
+	closing  bool // protected by exitMtx
+	signaled bool // protected by exitMtx
+
+	closeGracePeriod time.Duration // see Dialer.CloseGracePeriod
+
+	keys *tempKeys // may be nil
+
+	shaper      shaper
+	stats       *connStats
+	compression *compression // nil if not compressed
+	tls         *tls.Conn    // nil if not encrypted
+
+	id    string
+	log   *slog.Logger
+	hooks DialerHooks
+
+	endpoint Endpoint // as passed to Dial
+	stderr   *circlog.CircularLog
 }
 
 const go_network string = "netssh"
@@ -87,7 +210,10 @@ func (conn *SSHConn) RemoteAddr() net.Addr {
 // Read implements io.Reader.
 // It returns *IOError for any non-nil error that is != io.EOF.
 func (conn *SSHConn) Read(p []byte) (int, error) {
-	n, err := conn.stdout.Read(p)
+	began := time.Now()
+	n, err := conn.compression.reader(conn.reader()).Read(conn.shaper.limitRead(p))
+	conn.shaper.afterRead(n)
+	conn.stats.read(int64(n), began)
 	if err != nil && err != io.EOF {
 		return n, &IOError{err}
 	}
@@ -97,28 +223,93 @@ func (conn *SSHConn) Read(p []byte) (int, error) {
 // Write implements io.Writer.
 // It returns *IOError for any error != nil.
 func (conn *SSHConn) Write(p []byte) (int, error) {
-	n, err := conn.stdin.Write(p)
+	began := time.Now()
+	n, err := conn.shaper.writeShaped(p, conn.compression.writer(conn.writer()).Write)
+	conn.stats.write(int64(n), began)
 	if err != nil {
 		return n, &IOError{err}
 	}
 	return n, err
 }
 
+// ReadFrom implements io.ReaderFrom.
+// If r is a pipe, socket or regular file (or an *io.LimitedReader wrapping
+// one), the data is spliced to the ssh process without copying it to
+// userspace on Linux, unless the connection is compressed or encrypted.
+// Errors are returned as *IOError.
+func (conn *SSHConn) ReadFrom(r io.Reader) (int64, error) {
+	if conn.shaper.limited() || conn.compression != nil || conn.tls != nil {
+		return io.Copy(writerOnly{conn}, r)
+	}
+	began := time.Now()
+	n, handled, err := spliceCopy(conn.stdin, r)
+	if !handled {
+		return io.Copy(writerOnly{conn}, r)
+	}
+	conn.stats.write(n, began)
+	if err != nil {
+		return n, &IOError{err}
+	}
+	return n, nil
+}
+
+// WriteTo implements io.WriterTo, see ReadFrom.
+func (conn *SSHConn) WriteTo(w io.Writer) (int64, error) {
+	if conn.shaper.limited() || conn.compression != nil || conn.tls != nil {
+		return io.Copy(w, readerOnly{conn})
+	}
+	began := time.Now()
+	n, handled, err := spliceCopy(w, conn.stdout)
+	if !handled {
+		return io.Copy(w, readerOnly{conn})
+	}
+	conn.stats.read(n, began)
+	if err != nil {
+		return n, &IOError{err}
+	}
+	return n, nil
+}
+
+// writerOnly and readerOnly hide ReadFrom and WriteTo from io.Copy
+type writerOnly struct{ io.Writer }
+type readerOnly struct{ io.Reader }
+
 func (conn *SSHConn) CloseWrite() error {
+	if conn.tls != nil {
+		// lets the server's Read return io.EOF rather than io.ErrUnexpectedEOF
+		conn.tls.CloseWrite()
+	}
 	return conn.stdin.Close()
 }
 
+// reader and writer return the stream below compression.
+func (conn *SSHConn) reader() io.Reader {
+	if conn.tls != nil {
+		return conn.tls
+	}
+	return conn.stdout
+}
+
+func (conn *SSHConn) writer() io.Writer {
+	if conn.tls != nil {
+		return conn.tls
+	}
+	return conn.stdin
+}
+
 type deadliner interface {
 	SetReadDeadline(time.Time) error
 	SetWriteDeadline(time.Time) error
 }
 
 func (conn *SSHConn) SetReadDeadline(t time.Time) error {
+	conn.shaper.setDeadlines(&t, nil)
 	// type assertion is covered by test TestExecCmdPipesDeadlineBehavior
 	return conn.stdout.(deadliner).SetReadDeadline(t)
 }
 
 func (conn *SSHConn) SetWriteDeadline(t time.Time) error {
+	conn.shaper.setDeadlines(nil, &t)
 	// type assertion is covered by test TestExecCmdPipesDeadlineBehavior
 	return conn.stdin.(deadliner).SetWriteDeadline(t)
 }
@@ -136,15 +327,44 @@ func (conn *SSHConn) SetDeadline(t time.Time) error {
 	return nil
 }
 
+// Close closes the ssh process's stdin and terminates it with SIGTERM,
+// after waiting up to Dialer.CloseGracePeriod for it to exit on its own.
+// ssh is killed if it doesn't exit within a second after SIGTERM.
+// The exit is reported to DialerHooks.OnClose.
 func (conn *SSHConn) Close() error {
+	conn.shaper.close()
 	conn.shutdownProcess()
-	return nil // FIXME: waitError will be non-zero because we signaled it, shutdownProcess needs to distinguish that
+	return nil
 }
 
 type shutdownResult struct {
 	waitErr error
 }
 
+// waitProcess waits for ssh to exit, which it may do without Close,
+// e.g. if the server closed the connection.
+// Its stdio are plain pipes, such that Wait doesn't close them while conn
+// still reads buffered output.
+func (conn *SSHConn) waitProcess() {
+	err := conn.cmd.Wait()
+	conn.exitMtx.Lock()
+	conn.exit = SSHExit{
+		Err:      err,
+		Status:   conn.cmd.ProcessState.ExitCode(),
+		Closed:   conn.closing,
+		Signaled: conn.signaled,
+	}
+	exit := conn.exit
+	conn.exitMtx.Unlock()
+	conn.logger().Debug("ssh process exited", LogKeyPhase, phaseClose, "err", err,
+		"closed", exit.Closed, "signaled", exit.Signaled)
+	// before OnClose, which may call Close
+	close(conn.exited)
+	if conn.hooks.OnClose != nil {
+		conn.hooks.OnClose(conn, exit)
+	}
+}
+
 func (conn *SSHConn) shutdownProcess() *shutdownResult {
 	conn.shutdownMtx.Lock()
 	defer conn.shutdownMtx.Unlock()
@@ -153,27 +373,73 @@ func (conn *SSHConn) shutdownProcess() *shutdownResult {
 		return conn.shutdownResult
 	}
 
-	wait := make(chan error, 1)
-	go func() {
+	conn.exitMtx.Lock()
+	conn.closing = true
+	conn.exitMtx.Unlock()
+	// ssh exits once the remote command does, which is Proxy
+	// exiting after the server closed the connection
+	conn.stdin.Close()
+	if !conn.awaitExit(conn.closeGracePeriod) {
+		conn.exitMtx.Lock()
+		conn.signaled = true
+		conn.exitMtx.Unlock()
 		if err := conn.cmd.Process.Signal(syscall.SIGTERM); err != nil {
-			// TODO log error
-			return
+			conn.logger().Debug("cannot terminate ssh", LogKeyPhase, phaseClose, "err", err)
 		}
-		wait <- conn.cmd.Wait()
-	}()
-
-	timeout := time.NewTimer(1 * time.Second) // FIXME const
-	defer timeout.Stop()
+		if !conn.awaitExit(sshTerminateGracePeriod) {
+			conn.cmdCancel()
+			<-conn.exited
+		}
+	}
+	conn.cmdCancel() // releases the context
+	conn.stdout.Close()
+	conn.keys.remove()
+	conn.shutdownResult = &shutdownResult{conn.exit.Err}
+	return conn.shutdownResult
+}
 
+// awaitExit returns true if ssh exited within timeout.
+func (conn *SSHConn) awaitExit(timeout time.Duration) bool {
 	select {
-	case waitErr := <-wait:
-		conn.shutdownResult = &shutdownResult{waitErr}
-	case <-timeout.C:
-		conn.cmdCancel()
-		waitErr := <-wait // reuse existing Wait invocation, must not call twice
-		conn.shutdownResult = &shutdownResult{waitErr}
+	case <-conn.exited:
+		return true
+	default:
 	}
-	return conn.shutdownResult
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-conn.exited:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func (conn *SSHConn) logger() *slog.Logger {
+	if conn.log == nil {
+		return discardLogger
+	}
+	return conn.log
+}
+
+// ID returns a random ID for the connection, see LogKeyConn.
+// It is unrelated to ServeConn.ID of the other end.
+func (conn *SSHConn) ID() string {
+	return conn.id
+}
+
+// Endpoint returns the endpoint passed to Dial.
+func (conn *SSHConn) Endpoint() Endpoint {
+	return conn.endpoint
+}
+
+// Stderr returns the most recent output of the ssh process on stderr,
+// up to 32KiB.
+func (conn *SSHConn) Stderr() string {
+	if conn.stderr == nil {
+		return ""
+	}
+	return conn.stderr.String()
 }
 
 // Cmd returns the underlying *exec.Cmd (the ssh client process)
@@ -190,6 +456,15 @@ func (conn *SSHConn) CmdCancel() {
 	conn.cmdCancel()
 }
 
+// sshExitGracePeriod is how long Dial waits for the ssh process to exit
+// on its own after a failed handshake before killing it. Without it, Dial
+// would hang if ssh kept running after its stdout was closed.
+const sshExitGracePeriod = 1 * time.Second
+
+// sshTerminateGracePeriod is how long Close waits after SIGTERM before
+// killing ssh.
+const sshTerminateGracePeriod = 1 * time.Second
+
 const bannerMessageLen = 31
 
 var messages = make(map[string][]byte)
@@ -214,6 +489,29 @@ var banner_msg = mustMessage("SSHCON_HELO")
 var proxy_error_msg = mustMessage("SSHCON_PROXY_ERROR")
 var begin_msg = mustMessage("SSHCON_BEGIN")
 
+// begin_opts_msg replaces begin_msg if Dialer.NegotiateOptions, Dialer.Compression
+// or Endpoint.ServerKey is set, it is followed by beginOptions, to which the
+// server responds with beginReply.
+// Servers that predate it take any message of bannerMessageLen for begin_msg.
+var begin_opts_msg = mustMessage("SSHCON_BEGIN_OPTS")
+
+// beginOptions follows begin_opts_msg as a JSON message if Dial requests
+// options that the server must acknowledge with a beginReply.
+type beginOptions struct {
+	TraceCarrier map[string]string `json:"trace_carrier,omitempty"`
+	Compression  *compressionOffer `json:"compression,omitempty"`
+	Encryption   bool              `json:"encryption,omitempty"`
+}
+
+type beginReply struct {
+	Compression compressionChoice `json:"compression"`
+	Encryption  bool              `json:"encryption"`
+	// Error is set if the server rejects the options, it closes the connection afterwards.
+	Error string `json:"error,omitempty"`
+}
+
+var busy_msg = mustMessage("SSHCON_BUSY")
+
 type SSHError struct {
 	RWCError      error
 	WhileActivity string
@@ -267,22 +565,144 @@ func (e ProtocolError) Error() string {
 // If the handshake cannot be completed before dialCtx is Done(), the underlying ssh command is killed
 // and the dialCtx.Err() returned.
 // If the handshake completes, dialCtx's deadline does not affect the returned connection.
+// If the handshake fails, Dial waits for the ssh command to exit, but kills it
+// if it has not exited on its own after one second.
 //
-// Errors returned are either dialCtx.Err(), or intances of ProtocolError or *SSHError
+// Errors returned are either dialCtx.Err(), or intances of ProtocolError, BusyError, *SSHError
+// or *JumpHostError (if the ssh failure can be attributed to a hop in endpoint.Via).
 func Dial(dialCtx context.Context, endpoint Endpoint) (*SSHConn, error) {
+	var d Dialer
+	return d.Dial(dialCtx, endpoint)
+}
+
+// Dialer contains options for connecting to an Endpoint.
+// The zero value is valid and equivalent to calling Dial.
+type Dialer struct {
+	// CertificateSigner, if not nil, is asked for a fresh user certificate
+	// on each Dial. See CertificateSigner. Endpoint.User must be set,
+	// it is the certificate's principal.
+	CertificateSigner CertificateSigner
+	// CertificateValidity is the lifetime of certificates issued through
+	// CertificateSigner. Defaults to DefaultCertificateValidity.
+	CertificateValidity time.Duration
+	// Hooks are called for all connections dialed by d, see DialerHooks.
+	Hooks DialerHooks
+	// CloseGracePeriod is how long SSHConn.Close waits for ssh to exit
+	// after closing its stdin, before terminating it with SIGTERM.
+	// ssh exits once the server closed the connection and the session is
+	// torn down, which takes a few round trips. Zero terminates ssh right
+	// away, DialerHooks.OnClose then reports SSHExit.Signaled.
+	CloseGracePeriod time.Duration
+	// Compression, if not nil, is negotiated with the server, see
+	// CompressionPolicy and NegotiateOptions.
+	// On encrypted connections, compression leaks information through the
+	// size of the ciphertext if attacker-controlled data is mixed with
+	// secrets in the same stream. Don't compress such streams.
+	Compression *CompressionPolicy
+	// ClientKey is the client's static key for connections to endpoints
+	// with Endpoint.ServerKey, the server sees its public key through
+	// ServeConn.ClientKey. If nil, a new key is generated for each Dial.
+	ClientKey ed25519.PrivateKey
+	// NegotiateOptions makes Dial negotiate options with the server even if
+	// neither Compression nor Endpoint.ServerKey is set, such that
+	// DialTrace.Carrier is sent to the server.
+	//
+	// Options require a server running a version of this package with
+	// support for them. Older servers pass the options on to the application
+	// as the first bytes of the connection. Dial then waits for the server's
+	// reply until dialCtx is done, or takes data sent by the application for
+	// the reply and fails. Don't negotiate options with such servers.
+	NegotiateOptions bool
+}
+
+// Dial is like the package-level Dial function, but uses the options in d.
+func (d *Dialer) Dial(dialCtx context.Context, endpoint Endpoint) (*SSHConn, error) {
+	if d.Hooks.OnDial != nil {
+		dialCtx = d.Hooks.OnDial(dialCtx, endpoint)
+	}
+	conn, err := d.dial(dialCtx, endpoint)
+	if err != nil {
+		if d.Hooks.OnFailure != nil {
+			d.Hooks.OnFailure(dialCtx, endpoint, err)
+		}
+		return nil, err
+	}
+	conn.endpoint = endpoint
+	if d.Hooks.OnHandshakeDone != nil {
+		d.Hooks.OnHandshakeDone(dialCtx, conn)
+	}
+	return conn, nil
+}
+
+func (d *Dialer) dial(dialCtx context.Context, endpoint Endpoint) (*SSHConn, error) {
+	if d.Compression != nil {
+		if err := d.Compression.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if n := len(endpoint.ServerKey); n != 0 && n != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("netssh: invalid Ed25519 server key of %d bytes", n)
+	}
+	if n := len(d.ClientKey); n != 0 && n != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("netssh: invalid Ed25519 client key of %d bytes", n)
+	}
+	if d.CertificateSigner != nil && endpoint.User == "" {
+		return nil, fmt.Errorf("netssh: CertificateSigner requires Endpoint.User")
+	}
+
+	keys, endpoint, err := writeTempKeys(endpoint, d.CertificateSigner != nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.CertificateSigner != nil {
+		if endpoint, err = d.issueCertificate(dialCtx, keys, endpoint); err != nil {
+			keys.remove()
+			return nil, err
+		}
+	}
+	conn, err := dial(dialCtx, endpoint, d)
+	if err != nil {
+		keys.remove() // dial waited for the ssh process
+		return nil, err
+	}
+	conn.keys = keys
+	return conn, nil
+}
+
+// dial performs the handshake using the options of d.
+func dial(dialCtx context.Context, endpoint Endpoint, d *Dialer) (*SSHConn, error) {
+	hooks := d.Hooks
+	encrypt := len(endpoint.ServerKey) > 0
+	withOptions := d.NegotiateOptions || d.Compression != nil || encrypt
+	policy := d.Compression
+	if policy == nil {
+		policy = &CompressionPolicy{Accept: []string{CompressionNone}}
+	}
 
 	sshCmd, sshArgs, sshEnv := endpoint.CmdArgs()
 	commandCtx, commandCancel := context.WithCancel(context.Background())
 	cmd := exec.CommandContext(commandCtx, sshCmd, sshArgs...)
 	cmd.Env = sshEnv
-	stdin, err := cmd.StdinPipe()
+	// not cmd.StdinPipe and cmd.StdoutPipe, which are closed by cmd.Wait,
+	// see SSHConn.waitProcess
+	sshStdin, stdin, err := os.Pipe()
 	if err != nil {
+		commandCancel()
 		return nil, err
 	}
-	stdout, err := cmd.StdoutPipe()
+	stdout, sshStdout, err := os.Pipe()
 	if err != nil {
+		sshStdin.Close()
+		stdin.Close()
+		commandCancel()
 		return nil, err
 	}
+	cmd.Stdin = sshStdin
+	cmd.Stdout = sshStdout
+	closePipes := func() {
+		stdin.Close()
+		stdout.Close()
+	}
 
 	stderrBuf, err := circlog.NewCircularLog(1 << 15)
 	if err != nil {
@@ -290,11 +710,35 @@ func Dial(dialCtx context.Context, endpoint Endpoint) (*SSHConn, error) {
 	}
 	cmd.Stderr = stderrBuf
 
-	if err = cmd.Start(); err != nil {
+	id := newConnID()
+	log := contextLog(dialCtx).With(
+		slog.String(LogKeyConn, id),
+		slog.String(LogKeyEndpoint, endpoint.String()),
+	)
+	trace := contextDialTrace(dialCtx)
+	started := time.Now()
+	log.Debug("starting ssh", LogKeyPhase, PhaseSSHStart, "args", sshArgs)
+	if hooks.OnStart != nil {
+		hooks.OnStart(cmd.Args)
+	}
+	err = cmd.Start()
+	sshStdin.Close()
+	sshStdout.Close()
+	if err != nil {
+		log.Error("cannot start ssh", LogKeyPhase, PhaseSSHStart, "err", err)
+		trace.phaseDone(PhaseSSHStart, started, err)
+		closePipes()
+		commandCancel()
 		return nil, err
 	}
+	connectStart := trace.phaseDone(PhaseSSHStart, started, nil)
+	log.Debug("waiting for banner", LogKeyPhase, PhaseConnect, "pid", cmd.Process.Pid)
 	cmdWaitErrOrIOErr := func(ioErr error, what string) *SSHError {
+		// ssh usually exits after an I/O error on its stdio, but if it
+		// doesn't (e.g. stdout closed by a misbehaving remote), kill it
+		killTimer := time.AfterFunc(sshExitGracePeriod, commandCancel)
 		werr := cmd.Wait()
+		killTimer.Stop()
 		if werr, ok := werr.(*exec.ExitError); ok {
 			werr.Stderr = []byte(stderrBuf.String())
 			return &SSHError{werr, what}
@@ -302,33 +746,114 @@ func Dial(dialCtx context.Context, endpoint Endpoint) (*SSHConn, error) {
 		return &SSHError{ioErr, what}
 	}
 
-	confErrChan := make(chan error, 1)
-	go func() {
-		defer close(confErrChan)
+	// readBanner and sendBegin run in a goroutine so that Dial can be cancelled
+	readBanner := func() error {
 		var buf bytes.Buffer
 		if _, err := io.CopyN(&buf, stdout, int64(len(banner_msg))); err != nil {
-			confErrChan <- cmdWaitErrOrIOErr(err, "read banner")
-			return
+			return cmdWaitErrOrIOErr(err, "read banner")
 		}
 		resp := buf.Bytes()
 		switch {
 		case bytes.Equal(resp, banner_msg):
-			break
+			return nil
 		case bytes.Equal(resp, proxy_error_msg):
 			_ = cmdWaitErrOrIOErr(nil, "")
-			confErrChan <- ProtocolError{"proxy error, check remote configuration"}
-			return
+			return ProtocolError{"proxy error, check remote configuration"}
+		case bytes.Equal(resp, busy_msg):
+			_ = cmdWaitErrOrIOErr(nil, "")
+			return BusyError{}
 		default:
+			// the remote end waits for our begin message, don't wait for it to exit
+			commandCancel()
 			_ = cmdWaitErrOrIOErr(nil, "")
-			confErrChan <- ProtocolError{fmt.Sprintf("unknown banner message: %v", resp)}
-			return
+			return ProtocolError{fmt.Sprintf("unknown banner message: %v", resp)}
+		}
+	}
+	sendBegin := func() error {
+		var buf bytes.Buffer
+		if withOptions {
+			buf.Write(begin_opts_msg)
+			opts := beginOptions{
+				TraceCarrier: trace.carrier(),
+				Compression:  &compressionOffer{Send: policy.send(), Accept: policy.accept()},
+				Encryption:   encrypt,
+			}
+			if err := writeJSONMessage(&buf, opts); err != nil {
+				return err
+			}
+		} else {
+			buf.Write(begin_msg)
 		}
-		buf.Reset()
-		buf.Write(begin_msg)
 		if _, err := io.Copy(stdin, &buf); err != nil {
-			confErrChan <- cmdWaitErrOrIOErr(err, "send begin message")
+			return cmdWaitErrOrIOErr(err, "send begin message")
+		}
+		return nil
+	}
+	var comp *compression
+	var tlsConn *tls.Conn
+	readBeginReply := func() error {
+		if !withOptions {
+			return nil
+		}
+		var reply beginReply
+		if err := readJSONMessage(stdout, &reply, "begin reply"); err != nil {
+			if _, ok := err.(ProtocolError); ok {
+				commandCancel()
+				_ = cmdWaitErrOrIOErr(nil, "")
+				return err
+			}
+			return cmdWaitErrOrIOErr(err, "read begin reply")
+		}
+		choice := reply.Compression
+		var err error
+		switch {
+		case reply.Error != "":
+			err = ProtocolError{fmt.Sprintf("server rejected the handshake: %s", reply.Error)}
+		case encrypt && !reply.Encryption:
+			err = ProtocolError{"server does not support encryption"}
+		case !encrypt && reply.Encryption:
+			err = ProtocolError{"server enabled encryption that was not requested"}
+		default:
+			err = policy.check(choice)
+		}
+		var r io.Reader = stdout
+		var w io.Writer = stdin
+		if err == nil && encrypt {
+			tlsConn, err = clientTLS(stdout, stdin, endpoint.ServerKey, d.ClientKey)
+			r, w = tlsConn, tlsConn
+		}
+		if err == nil {
+			comp, err = newCompression(r, w, choice.ToServer, choice.ToClient, policy.Level)
+		}
+		if err != nil {
+			commandCancel()
+			_ = cmdWaitErrOrIOErr(nil, "")
+			return err
+		}
+		log.Debug("negotiated options", LogKeyPhase, PhaseBegin, "encrypted", encrypt,
+			"compression_send", choice.ToServer, "compression_recv", choice.ToClient)
+		return nil
+	}
+
+	confErrChan := make(chan error, 1)
+	go func() {
+		defer close(confErrChan)
+		err := readBanner()
+		beginStart := trace.phaseDone(PhaseConnect, connectStart, err)
+		if err != nil {
+			log.Warn("handshake failed", LogKeyPhase, PhaseConnect, "err", err)
+			confErrChan <- err
 			return
 		}
+		err = sendBegin()
+		if err == nil {
+			err = readBeginReply()
+		}
+		trace.phaseDone(PhaseBegin, beginStart, err)
+		if err != nil {
+			log.Warn("handshake failed", LogKeyPhase, PhaseBegin, "err", err)
+			confErrChan <- err
+		}
 	}()
 
 	select {
@@ -343,6 +868,8 @@ func Dial(dialCtx context.Context, endpoint Endpoint) (*SSHConn, error) {
 		// draining always terminates because we know the channel is always closed
 		for _ = range confErrChan {
 		}
+		log.Info("dial cancelled", LogKeyPhase, PhaseConnect, "err", dialCtx.Err())
+		closePipes()
 
 		// TODO collect stderr in this case
 		// can probably extend *SSHError for this but need to implement net.Error
@@ -352,14 +879,33 @@ func Dial(dialCtx context.Context, endpoint Endpoint) (*SSHConn, error) {
 	case err := <-confErrChan:
 		if err != nil {
 			commandCancel()
+			closePipes()
+			if sshErr, ok := err.(*SSHError); ok {
+				return nil, endpoint.jumpHostError(sshErr)
+			}
 			return nil, err
 		}
 	}
 
-	return &SSHConn{
-		cmd:       cmd,
-		stdin:     stdin,
-		stdout:    stdout,
-		cmdCancel: commandCancel,
-	}, nil
+	log.Debug("handshake complete", LogKeyPhase, PhaseBegin)
+	stats := newConnStats(started, cmd.Process.Pid)
+	stats.processStarted = started
+	conn := &SSHConn{
+		cmd:         cmd,
+		stdin:       stdin,
+		stdout:      stdout,
+		cmdCancel:   commandCancel,
+		exited:      make(chan struct{}),
+		stats:       stats,
+		compression: comp,
+		tls:         tlsConn,
+		id:          id,
+		log:         log,
+		hooks:       hooks,
+		stderr:      stderrBuf,
+
+		closeGracePeriod: d.CloseGracePeriod,
+	}
+	go conn.waitProcess()
+	return conn, nil
 }
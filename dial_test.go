@@ -0,0 +1,105 @@
+package netssh
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointCmdArgsIdentities(t *testing.T) {
+	tcs := []struct {
+		name     string
+		endpoint Endpoint
+		args     []string
+	}{
+		{
+			"no-identity",
+			Endpoint{Host: "h", User: "u", Port: 22},
+			[]string{"-p", "22", "-T", "-o", "BatchMode=yes", "u@h"},
+		},
+		{
+			"legacy-identity",
+			Endpoint{Host: "h", User: "u", Port: 22, IdentityFile: "/id"},
+			[]string{"-p", "22", "-T", "-i", "/id", "-o", "BatchMode=yes", "u@h"},
+		},
+		{
+			"multiple-identities-and-certificate",
+			Endpoint{
+				Host: "h", User: "u", Port: 22,
+				IdentityFile:    "/id",
+				IdentityFiles:   []string{"/id2", "/id3"},
+				CertificateFile: "/id2-cert.pub",
+				IdentitiesOnly:  true,
+				PrivateKeys:     [][]byte{[]byte("ignored")},
+			},
+			[]string{
+				"-p", "22", "-T", "-i", "/id", "-i", "/id2", "-i", "/id3",
+				"-o", "CertificateFile=/id2-cert.pub", "-o", "IdentitiesOnly=yes",
+				"-o", "BatchMode=yes", "u@h",
+			},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, args, _ := tc.endpoint.CmdArgs()
+			assert.Equal(t, tc.args, args)
+		})
+	}
+}
+
+func TestWriteTempKeys(t *testing.T) {
+	keys, e, err := writeTempKeys(Endpoint{IdentityFile: "/id"}, false)
+	require.NoError(t, err)
+	assert.Nil(t, keys)
+	keys.remove()
+
+	in := Endpoint{
+		IdentityFiles: []string{"/id"},
+		PrivateKeys:   [][]byte{[]byte("key0\n"), []byte("key1")},
+		Via:           []Endpoint{{PrivateKeys: [][]byte{[]byte("hopkey")}}},
+	}
+	keys, e, err = writeTempKeys(in, false)
+	require.NoError(t, err)
+	require.NotNil(t, keys)
+	assert.Len(t, in.IdentityFiles, 1, "must not modify caller's slices")
+
+	require.Len(t, e.IdentityFiles, 3)
+	assert.Equal(t, "/id", e.IdentityFiles[0])
+	assert.Nil(t, e.PrivateKeys)
+	for i, content := range []string{"key0\n", "key1\n"} {
+		fi, err := os.Stat(e.IdentityFiles[i+1])
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+		data, err := ioutil.ReadFile(e.IdentityFiles[i+1])
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	}
+	require.Len(t, e.Via[0].IdentityFiles, 1)
+	assert.Nil(t, e.Via[0].PrivateKeys)
+
+	keys.remove()
+	_, err = os.Stat(e.IdentityFiles[1])
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDialKillsSSHAfterHandshakeFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netssh")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// closes stdout without exiting, like ssh with a misbehaving remote
+	ssh := filepath.Join(dir, "ssh")
+	require.NoError(t, ioutil.WriteFile(ssh, []byte("#!/bin/sh\nexec >&-\nexec sleep 60\n"), 0755))
+
+	began := time.Now()
+	_, err = Dial(context.Background(), Endpoint{Host: "h", SSHCommand: ssh})
+	sshErr, ok := err.(*SSHError)
+	require.True(t, ok, "%T %s", err, err)
+	assert.Equal(t, "read banner", sshErr.WhileActivity)
+	assert.True(t, time.Since(began) < sshExitGracePeriod+5*time.Second, "%s", time.Since(began))
+}
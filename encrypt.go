@@ -0,0 +1,229 @@
+package netssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Connections are encrypted end-to-end using TLS 1.3 if requested through
+// Endpoint.ServerKey. The TLS handshake follows the begin message and the
+// server's beginReply. Both sides present self-signed certificates for their
+// static Ed25519 keys, which are authenticated by the keys alone:
+// the client compares the server's key with Endpoint.ServerKey, and the
+// server exposes the client's key through ServeConn.ClientKey.
+// Compression, if negotiated, is applied before encryption: data is
+// compressed and the compressed stream is sent over the TLS connection.
+// The size of the ciphertext thus depends on the content of the plaintext,
+// which lets an observer who can influence part of the data learn other
+// parts of it, as in the CRIME attack on TLS compression. See
+// Dialer.Compression.
+
+// EncryptionPolicy configures end-to-end encryption for Listener.SetEncryption.
+type EncryptionPolicy struct {
+	// Key is the server's static key. Clients authenticate the server
+	// by its public key, see Endpoint.ServerKey.
+	Key ed25519.PrivateKey
+	// Required makes the server reject clients that don't request encryption.
+	// Dial only reports the rejection if it negotiates options, i.e., if
+	// Dialer.Compression is set; otherwise the connection is closed after Dial.
+	Required bool
+}
+
+// serverEncryption is the validated EncryptionPolicy of a Listener.
+type serverEncryption struct {
+	cert     tls.Certificate
+	required bool
+}
+
+func newServerEncryption(p EncryptionPolicy) (*serverEncryption, error) {
+	if len(p.Key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("netssh: invalid Ed25519 private key of %d bytes", len(p.Key))
+	}
+	cert, err := selfSignedCertificate(p.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &serverEncryption{cert: cert, required: p.Required}, nil
+}
+
+// SetEncryption sets the policy for end-to-end encryption requested by clients
+// through Endpoint.ServerKey. It must be called before Accept.
+// Without a call, clients requesting encryption fail the handshake.
+func (l *Listener) SetEncryption(p EncryptionPolicy) error {
+	enc, err := newServerEncryption(p)
+	if err != nil {
+		return err
+	}
+	l.encryption = enc
+	return nil
+}
+
+// ClientKey returns the client's static key if the connection is encrypted,
+// see Endpoint.ServerKey, or nil. The client proved possession of the
+// corresponding private key during the handshake, so the key identifies
+// the client independently of Peer, which is set by Proxy.
+func (f *ServeConn) ClientKey() ed25519.PublicKey {
+	return f.clientKey
+}
+
+// Encrypted returns true if the connection is encrypted end-to-end,
+// see Endpoint.ServerKey.
+func (conn *SSHConn) Encrypted() bool {
+	return conn.tls != nil
+}
+
+func selfSignedCertificate(key ed25519.PrivateKey) (tls.Certificate, error) {
+	// the certificate only conveys the key, its fields are not checked
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// peerKey returns the Ed25519 key of the leaf certificate in rawCerts.
+func peerKey(rawCerts [][]byte) (ed25519.PublicKey, error) {
+	if len(rawCerts) == 0 {
+		return nil, fmt.Errorf("netssh: peer sent no certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("netssh: peer key is not an Ed25519 key")
+	}
+	return key, nil
+}
+
+// ServerKeyMismatchError is returned by Dial if the server's key
+// does not match Endpoint.ServerKey.
+type ServerKeyMismatchError struct {
+	Key ed25519.PublicKey
+}
+
+func (e ServerKeyMismatchError) Error() string {
+	return fmt.Sprintf("netssh: server key %x does not match Endpoint.ServerKey", []byte(e.Key))
+}
+
+// clientTLS performs the client side of the TLS handshake over r and w.
+// clientKey may be nil, in which case a new key is generated.
+func clientTLS(r io.Reader, w io.Writer, serverKey ed25519.PublicKey, clientKey ed25519.PrivateKey) (*tls.Conn, error) {
+	if clientKey == nil {
+		var err error
+		if _, clientKey, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			return nil, err
+		}
+	}
+	cert, err := selfSignedCertificate(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	var mismatch error
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		// the server is authenticated by its key in VerifyPeerCertificate
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			key, err := peerKey(rawCerts)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(key, serverKey) {
+				mismatch = ServerKeyMismatchError{key}
+				return mismatch
+			}
+			return nil
+		},
+	}
+	conn := tls.Client(tlsTransport{r, w}, config)
+	if err := conn.Handshake(); err != nil {
+		if mismatch != nil {
+			return nil, mismatch
+		}
+		return nil, ProtocolError{fmt.Sprintf("encryption handshake failed: %s", err)}
+	}
+	return conn, nil
+}
+
+// serverTLS performs the server side of the TLS handshake over r and w.
+// It returns the client's key.
+func serverTLS(r io.Reader, w io.Writer, enc *serverEncryption) (*tls.Conn, ed25519.PublicKey, error) {
+	var clientKey ed25519.PublicKey
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{enc.cert},
+		// the client is identified by its key, see ServeConn.ClientKey
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			key, err := peerKey(rawCerts)
+			clientKey = key
+			return err
+		},
+	}
+	conn := tls.Server(tlsTransport{r, w}, config)
+	if err := conn.Handshake(); err != nil {
+		return nil, nil, ProtocolError{fmt.Sprintf("encryption handshake failed: %s", err)}
+	}
+	return conn, clientKey, nil
+}
+
+// tlsTransport is the net.Conn below tls.Conn. Deadlines are set
+// on the underlying stream by SSHConn and ServeConn, and the stream
+// is closed by them.
+//
+// Timeouts are reported as temporary errors, which makes tls.Conn continue
+// a Read after a read deadline expired. Write timeouts break tls.Conn.
+type tlsTransport struct {
+	r io.Reader
+	w io.Writer
+}
+
+func (t tlsTransport) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	return n, temporaryTimeout(err)
+}
+
+func (t tlsTransport) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	return n, temporaryTimeout(err)
+}
+
+func (tlsTransport) Close() error                       { return nil }
+func (tlsTransport) LocalAddr() net.Addr                { return tlsAddr{} }
+func (tlsTransport) RemoteAddr() net.Addr               { return tlsAddr{} }
+func (tlsTransport) SetDeadline(t time.Time) error      { return nil }
+func (tlsTransport) SetReadDeadline(t time.Time) error  { return nil }
+func (tlsTransport) SetWriteDeadline(t time.Time) error { return nil }
+
+type tlsAddr struct{}
+
+func (tlsAddr) Network() string { return go_network }
+func (tlsAddr) String() string  { return "tls" }
+
+type temporaryTimeoutError struct{ error }
+
+func (temporaryTimeoutError) Timeout() bool   { return true }
+func (temporaryTimeoutError) Temporary() bool { return true }
+
+func temporaryTimeout(err error) error {
+	if to, ok := err.(timeouter); ok && to.Timeout() {
+		return temporaryTimeoutError{err}
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package netssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// socketPair returns connected sockets, which unlike net.Pipe buffer writes
+// as the ssh process does.
+func socketPair(t *testing.T) (a, b net.Conn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	for i, c := range []*net.Conn{&a, &b} {
+		f := os.NewFile(uintptr(fds[i]), "socketpair")
+		*c, err = net.FileConn(f)
+		f.Close()
+		require.NoError(t, err)
+	}
+	return a, b
+}
+
+func newTLSPipe(t *testing.T) (client, server net.Conn, clientConn, serverConn io.ReadWriter, clientPub ed25519.PublicKey) {
+	serverPub, serverKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	clientPub, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	enc, err := newServerEncryption(EncryptionPolicy{Key: serverKey})
+	require.NoError(t, err)
+
+	client, server = socketPair(t)
+	type result struct {
+		conn io.ReadWriter
+		key  ed25519.PublicKey
+		err  error
+	}
+	served := make(chan result, 1)
+	go func() {
+		conn, key, err := serverTLS(server, server, enc)
+		served <- result{conn, key, err}
+	}()
+	c, err := clientTLS(client, client, serverPub, clientKey)
+	require.NoError(t, err)
+	r := <-served
+	require.NoError(t, r.err)
+	assert.Equal(t, clientPub, r.key)
+	return client, server, c, r.conn, clientPub
+}
+
+func TestTLSRoundTrip(t *testing.T) {
+	_, _, c, s, _ := newTLSPipe(t)
+	go c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(s, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestTLSReadDeadlineResumes(t *testing.T) {
+	_, server, c, s, _ := newTLSPipe(t)
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err := s.Read(make([]byte, 5))
+	netErr, ok := err.(net.Error)
+	require.True(t, ok, "%T %s", err, err)
+	assert.True(t, netErr.Timeout())
+
+	require.NoError(t, server.SetReadDeadline(time.Time{}))
+	go c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(s, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestTLSServerKeyMismatch(t *testing.T) {
+	serverPub, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	enc, err := newServerEncryption(EncryptionPolicy{Key: serverKey})
+	require.NoError(t, err)
+
+	client, server := socketPair(t)
+	defer client.Close()
+	go func() {
+		serverTLS(server, server, enc)
+		server.Close()
+	}()
+	_, err = clientTLS(client, client, otherPub, nil)
+	assert.Equal(t, ServerKeyMismatchError{serverPub}, err)
+}
+
+func TestNewServerEncryptionInvalidKey(t *testing.T) {
+	_, err := newServerEncryption(EncryptionPolicy{Key: make([]byte, 10)})
+	assert.Error(t, err)
+}
@@ -0,0 +1,69 @@
+package netssh
+
+import (
+	"strings"
+)
+
+const envAuthSock = "SSH_AUTH_SOCK"
+
+// environ computes the ssh process's environment from the calling
+// process's environment parent, see Endpoint.CmdArgs.
+func (e Endpoint) environ(parent []string) []string {
+	var env envList
+	if e.InheritEnv {
+		for _, kv := range parent {
+			env.set(kv)
+		}
+	} else {
+		passed := make(map[string]bool, len(e.PassEnv))
+		for _, k := range e.PassEnv {
+			passed[k] = true
+		}
+		for _, kv := range parent {
+			if passed[envKey(kv)] {
+				env.set(kv)
+			}
+		}
+	}
+	for _, kv := range e.Env {
+		env.set(kv)
+	}
+	if e.AgentSocket != "" {
+		env.set(envAuthSock + "=" + e.AgentSocket)
+	}
+	return env.list()
+}
+
+// envList is a list of KEY=value pairs where a later set replaces
+// an earlier one in-place.
+type envList struct {
+	kvs []string
+	idx map[string]int
+}
+
+func (l *envList) set(kv string) {
+	if l.idx == nil {
+		l.idx = make(map[string]int)
+	}
+	k := envKey(kv)
+	if i, ok := l.idx[k]; ok {
+		l.kvs[i] = kv
+		return
+	}
+	l.idx[k] = len(l.kvs)
+	l.kvs = append(l.kvs, kv)
+}
+
+func (l *envList) list() []string {
+	if l.kvs == nil {
+		return []string{}
+	}
+	return l.kvs
+}
+
+func envKey(kv string) string {
+	if i := strings.Index(kv, "="); i >= 0 {
+		return kv[:i]
+	}
+	return kv
+}
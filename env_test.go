@@ -0,0 +1,26 @@
+package netssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointEnviron(t *testing.T) {
+	parent := []string{"HOME=/home/u", "PATH=/bin", "SSH_AUTH_SOCK=/parent.sock", "LANG=C"}
+
+	assert.Equal(t, []string{}, Endpoint{}.environ(parent))
+
+	e := Endpoint{
+		PassEnv: []string{"HOME", "SSH_AUTH_SOCK", "UNSET"},
+		Env:     []string{"LANG=en_US.UTF-8", "FOO=bar"},
+	}
+	assert.Equal(t, []string{"HOME=/home/u", "SSH_AUTH_SOCK=/parent.sock", "LANG=en_US.UTF-8", "FOO=bar"}, e.environ(parent))
+
+	e = Endpoint{
+		InheritEnv:  true,
+		Env:         []string{"PATH=/usr/bin"},
+		AgentSocket: "/agent.sock",
+	}
+	assert.Equal(t, []string{"HOME=/home/u", "PATH=/usr/bin", "SSH_AUTH_SOCK=/agent.sock", "LANG=C"}, e.environ(parent))
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/problame/go-netssh/authorizedkeys"
+)
+
+var authorizedKeysArgs struct {
+	pubkey  string
+	service string
+	keyID   string
+	from    []string
+	log     string
+	install string
+	remove  string
+}
+
+var authorizedKeysCmd = &cobra.Command{
+	Use:   "authorized-keys",
+	Short: "print, install or remove the authorized_keys entry for the proxy command",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if authorizedKeysArgs.remove != "" {
+			err := authorizedkeys.Remove(authorizedKeysArgs.remove, authorizedKeysArgs.service, authorizedKeysArgs.keyID)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		pubkeyData, err := ioutil.ReadFile(authorizedKeysArgs.pubkey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pubkey, _, _, _, err := ssh.ParseAuthorizedKey(pubkeyData)
+		if err != nil {
+			log.Fatalf("cannot parse public key: %s", err)
+		}
+		executable, err := os.Executable()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		entry := authorizedkeys.Entry{
+			ProxyCommand: []string{executable, "proxy"},
+			Socket:       sock,
+			Service:      authorizedKeysArgs.service,
+			KeyID:        authorizedKeysArgs.keyID,
+			LogFile:      authorizedKeysArgs.log,
+			From:         authorizedKeysArgs.from,
+			PublicKey:    pubkey,
+		}
+
+		if authorizedKeysArgs.install != "" {
+			if err := authorizedkeys.Install(authorizedKeysArgs.install, entry); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		line, err := entry.Line()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(line)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(authorizedKeysCmd)
+	authorizedKeysCmd.Flags().StringVar(&authorizedKeysArgs.pubkey, "pubkey", "exampleident.pub", "client's public key file")
+	authorizedKeysCmd.Flags().StringVar(&authorizedKeysArgs.service, "service", "example", "")
+	authorizedKeysCmd.Flags().StringVar(&authorizedKeysArgs.keyID, "key-id", "exampleident", "")
+	authorizedKeysCmd.Flags().StringSliceVar(&authorizedKeysArgs.from, "from", nil, "restrict client addresses (from= option)")
+	authorizedKeysCmd.Flags().StringVar(&authorizedKeysArgs.log, "log", "", "log file for the proxy command")
+	authorizedKeysCmd.Flags().StringVar(&authorizedKeysArgs.install, "install", "", "install or update the entry in this authorized_keys file")
+	authorizedKeysCmd.Flags().StringVar(&authorizedKeysArgs.remove, "remove", "", "remove the entry from this authorized_keys file")
+}
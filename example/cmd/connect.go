@@ -3,6 +3,7 @@ package cmd
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -23,6 +24,8 @@ var connectArgs struct {
 	endpoint                  netssh.Endpoint
 	numAttempts               int
 	attemptInterval           time.Duration
+	compress                  string
+	serverKey                 string
 }
 
 func init() {
@@ -35,8 +38,11 @@ func init() {
 	connectCmd.Flags().StringVar(&connectArgs.endpoint.User, "ssh.user", "", "")
 	connectCmd.Flags().StringVar(&connectArgs.endpoint.IdentityFile, "ssh.identity", "", "")
 	connectCmd.Flags().Uint16Var(&connectArgs.endpoint.Port, "ssh.port", 22, "")
+	connectCmd.Flags().BoolVar(&connectArgs.endpoint.InheritEnv, "ssh.inheritEnv", false, "pass our environment (e.g. SSH_AUTH_SOCK) to ssh")
 	connectCmd.Flags().IntVar(&connectArgs.numAttempts, "attempts.count", 1, "number of connection attempts, 0 for infinite")
 	connectCmd.Flags().DurationVar(&connectArgs.attemptInterval, "attempts.interval", 1*time.Second, "sleep between connection attempts")
+	connectCmd.Flags().StringVar(&connectArgs.compress, "compress", "", "negotiate compression of sent data: none, zstd or lz4 (requires a server with compression support)")
+	connectCmd.Flags().StringVar(&connectArgs.serverKey, "server-key", "", "encrypt end-to-end and authenticate the server by this hex-encoded Ed25519 public key")
 }
 
 var connectCmd = &cobra.Command{
@@ -68,7 +74,18 @@ func connectAttempt(log *log.Logger) {
 	log.Printf("timeout %s", connectArgs.dialTimeout)
 	ctx := netssh.ContextWithLog(context.TODO(), log)
 	dialCtx, dialCancel := context.WithTimeout(ctx, connectArgs.dialTimeout)
-	outstream, err := netssh.Dial(dialCtx, connectArgs.endpoint)
+	var dialer netssh.Dialer
+	if connectArgs.compress != "" {
+		dialer.Compression = &netssh.CompressionPolicy{Send: connectArgs.compress}
+	}
+	if connectArgs.serverKey != "" {
+		key, err := hex.DecodeString(connectArgs.serverKey)
+		if err != nil {
+			log.Panic(err)
+		}
+		connectArgs.endpoint.ServerKey = key
+	}
+	outstream, err := dialer.Dial(dialCtx, connectArgs.endpoint)
 	dialCancel()
 	if err == context.DeadlineExceeded {
 		log.Panic("dial timeout exceeded")
@@ -120,4 +137,8 @@ func connectAttempt(log *log.Logger) {
 		log.Panicf("unexpected close message: %v", resp)
 	}
 	log.Printf("received close message")
+	if connectArgs.compress != "" {
+		read, written := outstream.Stats().CompressionRatio()
+		log.Printf("compression ratio: read %.2f, written %.2f", read, written)
+	}
 }
@@ -4,14 +4,26 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"io"
 	"log"
 	"os"
 	"github.com/problame/go-netssh"
 	"context"
+	"time"
 )
 
 var proxyArgs struct {
-	log string
+	log     string
+	socket  string
+	service string
+	keyID   string
+	mode    string
+	wait    time.Duration
+	start   []string
+
+	auditFile    string
+	auditMaxSize int64
+	auditSyslog  bool
 }
 
 var proxyCmd= &cobra.Command{
@@ -29,7 +41,38 @@ var proxyCmd= &cobra.Command{
 			ctx = netssh.ContextWithLog(ctx, log)
 		}
 
-		err := netssh.Proxy(ctx, sock)
+		proxier := netssh.Proxier{
+			WaitTimeout:   proxyArgs.wait,
+			ServerCommand: proxyArgs.start,
+			KeyID:         proxyArgs.keyID,
+			Service:       proxyArgs.service,
+		}
+		var audit []io.Writer
+		if proxyArgs.auditFile != "" {
+			audit = append(audit, &netssh.AuditFile{Path: proxyArgs.auditFile, MaxSize: proxyArgs.auditMaxSize, MaxBackups: 5})
+		}
+		if proxyArgs.auditSyslog {
+			w, err := netssh.NewSyslogAuditWriter("netssh-proxy")
+			if err != nil {
+				log.Panic(err)
+			}
+			audit = append(audit, w)
+		}
+		if len(audit) > 0 {
+			proxier.AuditLog = io.MultiWriter(audit...)
+		}
+		switch proxyArgs.mode {
+		case "auto":
+			proxier.Mode = netssh.ProxyModeAuto
+		case "fd":
+			proxier.Mode = netssh.ProxyModeFD
+		case "relay":
+			proxier.Mode = netssh.ProxyModeRelay
+		default:
+			log.Panicf("invalid --mode %q", proxyArgs.mode)
+		}
+
+		err := proxier.Proxy(ctx, proxyArgs.socket)
 		if err != nil {
 			os.Exit(1)
 		}
@@ -41,4 +84,13 @@ var proxyCmd= &cobra.Command{
 func init() {
 	RootCmd.AddCommand(proxyCmd)
 	proxyCmd.Flags().StringVar(&proxyArgs.log, "log", "", "log file (proxy must not log to stdio)")
+	proxyCmd.Flags().StringVar(&proxyArgs.socket, "socket", sock, "server socket")
+	proxyCmd.Flags().StringVar(&proxyArgs.service, "service", "", "service name passed to the server as Peer.Service for admission control (set by the authorized-keys command)")
+	proxyCmd.Flags().StringVar(&proxyArgs.keyID, "key-id", "", "key id passed to the server as Peer.KeyID for admission control (set by the authorized-keys command)")
+	proxyCmd.Flags().StringVar(&proxyArgs.mode, "mode", "auto", "how to hand the connection to the server: auto, fd or relay")
+	proxyCmd.Flags().DurationVar(&proxyArgs.wait, "wait", 0, "wait for the server to start if it is not running")
+	proxyCmd.Flags().StringSliceVar(&proxyArgs.start, "start-server", nil, "command (comma-separated argv) that starts the server if it is not running")
+	proxyCmd.Flags().StringVar(&proxyArgs.auditFile, "audit-file", "", "append an audit record (JSON line) per session to this file")
+	proxyCmd.Flags().Int64Var(&proxyArgs.auditMaxSize, "audit-max-size", 10<<20, "rotate --audit-file at this size in bytes, keeping 5 backups")
+	proxyCmd.Flags().BoolVar(&proxyArgs.auditSyslog, "audit-syslog", false, "send audit records to syslog (LOG_AUTHPRIV)")
 }
@@ -4,39 +4,98 @@ import (
 
 	"github.com/spf13/cobra"
 	"io"
+	"io/ioutil"
 	"os"
+	"strings"
+	"crypto/ed25519"
+	"encoding/hex"
 	"log"
+	"log/slog"
 	"time"
+	"context"
+	"os/signal"
+	"syscall"
+	"net/http"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/problame/go-netssh"
+	"github.com/problame/go-netssh/debug"
+	"github.com/problame/go-netssh/metrics"
 )
 
+var serveArgs struct {
+	systemd         bool
+	maxConns        int
+	shutdownTimeout time.Duration
+	admission       netssh.AdmissionPolicy
+	httpAddr        string
+	compression     netssh.CompressionPolicy
+	keyFile         string
+	requireEncrypt  bool
+}
+
 // serveCmd represents the remotesrv command
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "run server in foreground",
 	Run: func(cmd *cobra.Command, args []string) {
 
-		if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
-			log.Fatalf("cannot remove (stale?) socket we want to bind to: %s", err)
-		}
-
 		log.Print("listening")
-		listener, err := netssh.Listen(sock)
+		var listener *netssh.Listener
+		var err error
+		if serveArgs.systemd {
+			listener, err = netssh.ListenFromSystemd("")
+		} else {
+			c := netssh.ListenConfig{RemoveStale: true}
+			listener, err = c.Listen(sock)
+		}
 		if err != nil {
 			log.Panic(err)
 		}
+		logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+		listener.SetLogger(logger)
+		listener.SetAdmissionPolicy(serveArgs.admission)
+		if err := listener.SetCompression(serveArgs.compression); err != nil {
+			log.Panic(err)
+		}
+		if serveArgs.keyFile != "" {
+			hexSeed, err := ioutil.ReadFile(serveArgs.keyFile)
+			if err != nil {
+				log.Panic(err)
+			}
+			seed, err := hex.DecodeString(strings.TrimSpace(string(hexSeed)))
+			if err != nil || len(seed) != ed25519.SeedSize {
+				log.Panicf("%s must contain a hex-encoded %d byte Ed25519 seed", serveArgs.keyFile, ed25519.SeedSize)
+			}
+			key := ed25519.NewKeyFromSeed(seed)
+			policy := netssh.EncryptionPolicy{Key: key, Required: serveArgs.requireEncrypt}
+			if err := listener.SetEncryption(policy); err != nil {
+				log.Panic(err)
+			}
+			log.Printf("server key %x", []byte(key.Public().(ed25519.PublicKey)))
+		}
 
-		handleConn := func() {
-
-			log.Print("accepting")
+		if serveArgs.httpAddr != "" {
+			collector := metrics.NewListenerCollector()
+			prometheus.MustRegister(collector)
+			listener.SetHooks(collector.Hooks())
+			debugHandler := debug.NewHandler()
+			debugHandler.AddListener(listener)
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			mux.Handle("/debug/netssh", debugHandler)
+			go func() {
+				log.Print(http.ListenAndServe(serveArgs.httpAddr, mux))
+			}()
+		}
 
-			rwc, err := listener.Accept()
-			defer rwc.Close()
+		handleConn := func(ctx context.Context, rwc *netssh.ServeConn) {
 
 			log.Print("urandom")
 			rand, err := os.Open("/dev/urandom")
 			if err != nil {
-				log.Panic(err)
+				log.Print(err)
+				return
 			}
 			defer rand.Close()
 
@@ -70,7 +129,12 @@ var serveCmd = &cobra.Command{
 							break out
 						}
 						i += int(n)
-						time.Sleep(time.Second)
+						select {
+						case <-time.After(time.Second):
+						case <-ctx.Done():
+							log.Print("server shutting down")
+							break out
+						}
 					}
 				}
 
@@ -78,8 +142,26 @@ var serveCmd = &cobra.Command{
 
 		}
 
-		for {
-			handleConn()
+		server := &netssh.Server{
+			Handler:  netssh.HandlerFunc(handleConn),
+			MaxConns: serveArgs.maxConns,
+			Logger:   logger,
+		}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			log.Print("shutting down")
+			ctx, cancel := context.WithTimeout(context.Background(), serveArgs.shutdownTimeout)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("shutdown: %s", err)
+			}
+		}()
+
+		if err := server.Serve(context.Background(), listener); err != netssh.ErrServerClosed {
+			log.Panic(err)
 		}
 
 		log.Print("exiting")
@@ -88,4 +170,16 @@ var serveCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().BoolVar(&serveArgs.systemd, "systemd", false, "use the socket passed by systemd socket activation")
+	serveCmd.Flags().IntVar(&serveArgs.maxConns, "max-conns", 0, "maximum number of concurrent connections (0 = unlimited)")
+	serveCmd.Flags().IntVar(&serveArgs.admission.MaxConnsPerPeer, "max-conns-per-peer", 0, "reject connections above this number per peer (0 = unlimited)")
+	serveCmd.Flags().Float64Var(&serveArgs.admission.Rate, "rate", 0, "maximum new connections per second (0 = unlimited)")
+	serveCmd.Flags().IntVar(&serveArgs.admission.Burst, "burst", 1, "burst size for --rate")
+	serveCmd.Flags().DurationVar(&serveArgs.admission.QueueTimeout, "queue-timeout", 0, "how long connections wait for admission before being rejected")
+	serveCmd.Flags().StringVar(&serveArgs.compression.Send, "compress", "", "compress data sent to clients that accept it: zstd or lz4")
+	serveCmd.Flags().IntVar(&serveArgs.compression.Level, "compress-level", 0, "compression level for --compress (0 = default)")
+	serveCmd.Flags().StringVar(&serveArgs.keyFile, "key-file", "", "accept end-to-end encryption using the hex-encoded Ed25519 seed in this file")
+	serveCmd.Flags().BoolVar(&serveArgs.requireEncrypt, "require-encryption", false, "reject clients that don't request encryption (requires --key-file)")
+	serveCmd.Flags().StringVar(&serveArgs.httpAddr, "http-addr", "", "serve prometheus metrics (/metrics) and live connections (/debug/netssh) on this address")
+	serveCmd.Flags().DurationVar(&serveArgs.shutdownTimeout, "shutdown-timeout", 10*time.Second, "time to drain connections on SIGINT / SIGTERM")
 }
@@ -0,0 +1,410 @@
+// Package faultinject wraps netssh connections to inject transport faults
+// for resilience testing: latency, bandwidth limits, fragmented I/O,
+// random and scheduled disconnects, stalls, corruption and truncation.
+//
+// All randomness is derived from Config.Seed, so a test that drives a
+// Conn from a single goroutine per direction sees the same faults on
+// every run.
+//
+// Use Wrap on a *netssh.SSHConn or *netssh.ServeConn, or configure
+// netsshtest.Behavior.Faults to inject faults below the netssh handshake.
+package faultinject
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Direction selects a stream of a Conn.
+type Direction int
+
+const (
+	// Read is the stream of data returned by Conn.Read.
+	Read Direction = iota
+	// Write is the stream of data passed to Conn.Write.
+	Write
+)
+
+// Kind is the type of a Fault.
+type Kind int
+
+const (
+	// Disconnect calls Config.Disconnect (by default: closes the wrapped
+	// connection). All subsequent operations fail with ErrDisconnected.
+	Disconnect Kind = iota
+	// Stall blocks operations in the fault's direction until their deadline
+	// expires or the Conn is closed.
+	Stall
+	// Corrupt inverts the bits of the byte at offset AfterBytes.
+	Corrupt
+	// Truncate ends the stream at offset AfterBytes:
+	// Read returns io.EOF, the wrapped connection's write side is closed
+	// and Write silently discards data.
+	Truncate
+)
+
+// Fault is a scheduled fault.
+type Fault struct {
+	Kind      Kind
+	Direction Direction
+	// AfterBytes is the offset in the stream at which the fault triggers.
+	AfterBytes int64
+	// AfterTime, if not zero, triggers the fault this long after Wrap
+	// instead of at AfterBytes. It is ignored for Corrupt.
+	AfterTime time.Duration
+}
+
+// Config describes the faults injected by a Conn.
+// The zero value injects no faults.
+type Config struct {
+	// Seed initializes the random number generator.
+	Seed int64
+
+	// Latency delays every Read and Write, plus a random duration of up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// ReadBandwidth and WriteBandwidth limit the throughput in bytes per second.
+	ReadBandwidth  int64
+	WriteBandwidth int64
+
+	// MaxChunk, if not zero, splits Writes into chunks and limits Reads
+	// to a random size between 1 and MaxChunk bytes.
+	MaxChunk int
+
+	// DisconnectProbability is the probability for each Read and Write
+	// call to disconnect, see Kind Disconnect.
+	DisconnectProbability float64
+
+	Faults []Fault
+
+	// Disconnect is called to tear down the connection for Disconnect faults.
+	// If nil, the wrapped connection is closed. For a *netssh.SSHConn,
+	// set it to CmdCancel to simulate the ssh process dying.
+	Disconnect func() `json:"-"`
+}
+
+// ErrDisconnected is returned by operations after a Disconnect fault.
+var ErrDisconnected = errors.New("faultinject: disconnected")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "faultinject: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+// Wrapped is the interface implemented by *netssh.SSHConn and *netssh.ServeConn.
+type Wrapped interface {
+	net.Conn
+	CloseWrite() error
+}
+
+type stream struct {
+	offset    int64
+	start     time.Time // for bandwidth calculation
+	deadline  time.Time
+	bandwidth int64
+	truncated bool
+}
+
+// Conn injects faults into the Read and Write streams of the wrapped connection.
+type Conn struct {
+	conn    Wrapped
+	config  Config
+	started time.Time
+
+	mtx          sync.Mutex
+	rng          *rand.Rand
+	streams      [2]stream
+	disconnected bool
+	closed       chan struct{}
+	closeOnce    sync.Once
+	timers       []*time.Timer
+}
+
+// Wrap returns a Conn that injects the faults described by config into conn.
+func Wrap(conn Wrapped, config Config) *Conn {
+	c := &Conn{
+		conn:    conn,
+		config:  config,
+		started: time.Now(),
+		rng:     rand.New(rand.NewSource(config.Seed)),
+		closed:  make(chan struct{}),
+	}
+	c.streams[Read].bandwidth = config.ReadBandwidth
+	c.streams[Write].bandwidth = config.WriteBandwidth
+	for _, f := range config.Faults {
+		if f.Kind == Disconnect && f.AfterTime != 0 {
+			// disconnect even if the connection is idle
+			c.timers = append(c.timers, time.AfterFunc(f.AfterTime, c.disconnect))
+		}
+	}
+	return c
+}
+
+func (c *Conn) disconnect() {
+	c.mtx.Lock()
+	if c.disconnected {
+		c.mtx.Unlock()
+		return
+	}
+	c.disconnected = true
+	c.mtx.Unlock()
+	if c.config.Disconnect != nil {
+		c.config.Disconnect()
+	} else {
+		c.conn.Close()
+	}
+}
+
+// triggered returns the first fault of one of the given kinds in dir
+// that has triggered at the stream's current offset or time.
+func (c *Conn) triggered(dir Direction, kinds ...Kind) (Fault, bool) {
+	s := &c.streams[dir]
+	for _, f := range c.config.Faults {
+		if f.Direction != dir || f.Kind == Corrupt {
+			continue
+		}
+		match := false
+		for _, k := range kinds {
+			match = match || f.Kind == k
+		}
+		if !match {
+			continue
+		}
+		if f.AfterTime != 0 {
+			if time.Since(c.started) >= f.AfterTime {
+				return f, true
+			}
+		} else if s.offset >= f.AfterBytes {
+			return f, true
+		}
+	}
+	return Fault{}, false
+}
+
+// limit returns the maximum number of bytes that may be transferred in dir
+// without crossing the offset of a pending fault or exceeding MaxChunk.
+func (c *Conn) limit(dir Direction, n int) int {
+	s := &c.streams[dir]
+	for _, f := range c.config.Faults {
+		if f.Direction != dir || f.Kind == Corrupt || f.AfterTime != 0 || f.AfterBytes <= s.offset {
+			continue
+		}
+		if rem := f.AfterBytes - s.offset; int64(n) > rem {
+			n = int(rem)
+		}
+	}
+	if c.config.MaxChunk > 0 && n > 0 {
+		max := c.rng.Intn(c.config.MaxChunk) + 1
+		if n > max {
+			n = max
+		}
+	}
+	return n
+}
+
+// before performs the checks common to Read and Write and returns the
+// maximum number of bytes to transfer. Must be called without c.mtx held.
+func (c *Conn) before(dir Direction, n int) (int, error) {
+	c.mtx.Lock()
+	if c.disconnected {
+		c.mtx.Unlock()
+		return 0, ErrDisconnected
+	}
+	if c.config.DisconnectProbability > 0 && c.rng.Float64() < c.config.DisconnectProbability {
+		c.mtx.Unlock()
+		c.disconnect()
+		return 0, ErrDisconnected
+	}
+	if _, ok := c.triggered(dir, Disconnect); ok {
+		c.mtx.Unlock()
+		c.disconnect()
+		return 0, ErrDisconnected
+	}
+	_, stall := c.triggered(dir, Stall)
+	delay := c.config.Latency
+	if c.config.Jitter > 0 {
+		delay += time.Duration(c.rng.Int63n(int64(c.config.Jitter)))
+	}
+	n = c.limit(dir, n)
+	c.mtx.Unlock()
+
+	if stall {
+		return 0, c.sleep(dir, -1)
+	}
+	if err := c.sleep(dir, delay); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// after accounts for n transferred bytes and enforces the bandwidth limit.
+func (c *Conn) after(dir Direction, n int) error {
+	c.mtx.Lock()
+	s := &c.streams[dir]
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	s.offset += int64(n)
+	var delay time.Duration
+	if s.bandwidth > 0 {
+		due := s.start.Add(time.Duration(s.offset * int64(time.Second) / s.bandwidth))
+		delay = time.Until(due)
+	}
+	c.mtx.Unlock()
+	return c.sleep(dir, delay)
+}
+
+// sleep waits for d (forever if d < 0), but at most until the deadline
+// for dir or until the Conn is closed.
+func (c *Conn) sleep(dir Direction, d time.Duration) error {
+	if d == 0 {
+		return nil
+	}
+	var until time.Time
+	if d > 0 {
+		until = time.Now().Add(d)
+	}
+	for {
+		c.mtx.Lock()
+		deadline := c.streams[dir].deadline
+		c.mtx.Unlock()
+
+		now := time.Now()
+		if !deadline.IsZero() && !now.Before(deadline) {
+			return timeoutError{}
+		}
+		if !until.IsZero() && !now.Before(until) {
+			return nil
+		}
+		// re-check periodically in case the deadline is changed
+		wait := 50 * time.Millisecond
+		if !until.IsZero() && until.Sub(now) < wait {
+			wait = until.Sub(now)
+		}
+		if !deadline.IsZero() && deadline.Sub(now) < wait {
+			wait = deadline.Sub(now)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-c.closed:
+			t.Stop()
+			return ErrDisconnected
+		case <-t.C:
+		}
+	}
+}
+
+// corrupt flips the bytes of p (located at offset in dir) that are
+// subject to a Corrupt fault.
+func (c *Conn) corrupt(dir Direction, offset int64, p []byte) {
+	for _, f := range c.config.Faults {
+		if f.Kind == Corrupt && f.Direction == dir && f.AfterBytes >= offset && f.AfterBytes < offset+int64(len(p)) {
+			p[f.AfterBytes-offset] ^= 0xff
+		}
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.before(Read, len(p))
+	if err != nil {
+		return 0, err
+	}
+	c.mtx.Lock()
+	_, truncated := c.triggered(Read, Truncate)
+	offset := c.streams[Read].offset
+	c.mtx.Unlock()
+	if truncated {
+		return 0, io.EOF
+	}
+
+	n, err = c.conn.Read(p[:n])
+	c.corrupt(Read, offset, p[:n])
+	if aerr := c.after(Read, n); err == nil {
+		err = aerr
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := c.before(Write, len(p)-written)
+		if err != nil {
+			return written, err
+		}
+
+		c.mtx.Lock()
+		s := &c.streams[Write]
+		_, truncate := c.triggered(Write, Truncate)
+		closeWrite := truncate && !s.truncated
+		s.truncated = s.truncated || truncate
+		offset := s.offset
+		c.mtx.Unlock()
+		if closeWrite {
+			c.conn.CloseWrite()
+		}
+		if truncate {
+			return len(p), nil
+		}
+
+		chunk := append([]byte(nil), p[written:written+n]...)
+		c.corrupt(Write, offset, chunk)
+		n, err = c.conn.Write(chunk)
+		written += n
+		if aerr := c.after(Write, n); err == nil {
+			err = aerr
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		for _, t := range c.timers {
+			t.Stop()
+		}
+	})
+	return c.conn.Close()
+}
+
+func (c *Conn) CloseWrite() error {
+	return c.conn.CloseWrite()
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mtx.Lock()
+	c.streams[Read].deadline = t
+	c.mtx.Unlock()
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mtx.Lock()
+	c.streams[Write].deadline = t
+	c.mtx.Unlock()
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	rerr := c.SetReadDeadline(t)
+	werr := c.SetWriteDeadline(t)
+	if rerr != nil {
+		return rerr
+	}
+	return werr
+}
@@ -0,0 +1,196 @@
+package faultinject_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/problame/go-netssh"
+	"github.com/problame/go-netssh/faultinject"
+	"github.com/problame/go-netssh/netsshtest"
+)
+
+func TestMain(m *testing.M) {
+	netsshtest.Main()
+	os.Exit(m.Run())
+}
+
+// unixPair returns a connected pair of *net.UnixConn, which implement faultinject.Wrapped.
+func unixPair(t *testing.T) (a, b *net.UnixConn, cleanup func()) {
+	dir, err := ioutil.TempDir("", "faultinject")
+	require.NoError(t, err)
+	l, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	require.NoError(t, err)
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("unix", l.Addr().String())
+	require.NoError(t, err)
+	b = (<-accepted).(*net.UnixConn)
+	l.Close()
+	return conn.(*net.UnixConn), b, func() {
+		conn.Close()
+		b.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCorruptTruncateChunks(t *testing.T) {
+	a, b, cleanup := unixPair(t)
+	defer cleanup()
+
+	data := []byte("0123456789abcdef")
+	go func() {
+		a.Write(data)
+		a.Close()
+	}()
+
+	conn := faultinject.Wrap(b, faultinject.Config{
+		Seed:     1,
+		MaxChunk: 3,
+		Faults: []faultinject.Fault{
+			{Kind: faultinject.Corrupt, Direction: faultinject.Read, AfterBytes: 2},
+			{Kind: faultinject.Truncate, Direction: faultinject.Read, AfterBytes: 10},
+		},
+	})
+	var buf [16]byte
+	var got []byte
+	for {
+		n, err := conn.Read(buf[:])
+		assert.True(t, n <= 3)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	expect := []byte("0123456789")
+	expect[2] ^= 0xff
+	assert.Equal(t, expect, got)
+}
+
+func TestDeterministicChunks(t *testing.T) {
+	chunks := func() []int {
+		a, b, cleanup := unixPair(t)
+		defer cleanup()
+		_, err := a.Write(bytes.Repeat([]byte{1}, 1000))
+		require.NoError(t, err)
+		a.Close()
+
+		conn := faultinject.Wrap(b, faultinject.Config{Seed: 42, MaxChunk: 100})
+		var sizes []int
+		var buf [1000]byte
+		for {
+			n, err := conn.Read(buf[:])
+			if err != nil {
+				return sizes
+			}
+			sizes = append(sizes, n)
+		}
+	}
+	first := chunks()
+	assert.True(t, len(first) > 10)
+	assert.Equal(t, first, chunks())
+}
+
+func TestStallHonorsDeadline(t *testing.T) {
+	_, b, cleanup := unixPair(t)
+	defer cleanup()
+	conn := faultinject.Wrap(b, faultinject.Config{
+		Faults: []faultinject.Fault{{Kind: faultinject.Stall, Direction: faultinject.Read}},
+	})
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	pre := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	require.True(t, ok)
+	assert.True(t, netErr.Timeout())
+	assert.True(t, time.Since(pre) >= 100*time.Millisecond)
+}
+
+func TestScheduledDisconnectAndBandwidth(t *testing.T) {
+	a, b, cleanup := unixPair(t)
+	defer cleanup()
+	go io.Copy(ioutil.Discard, b)
+
+	conn := faultinject.Wrap(a, faultinject.Config{
+		WriteBandwidth: 100 << 10,
+		Faults: []faultinject.Fault{
+			{Kind: faultinject.Disconnect, Direction: faultinject.Write, AfterBytes: 20 << 10},
+		},
+	})
+	pre := time.Now()
+	n, err := conn.Write(make([]byte, 30<<10))
+	assert.Equal(t, 20<<10, n)
+	assert.Equal(t, faultinject.ErrDisconnected, err)
+	assert.True(t, time.Since(pre) >= 190*time.Millisecond, "%s", time.Since(pre))
+	_, err = conn.Write([]byte{1})
+	assert.Equal(t, faultinject.ErrDisconnected, err)
+}
+
+func TestHandshakeFaults(t *testing.T) {
+	s, err := netsshtest.NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+	go func() {
+		for i := 0; i < 2; i++ {
+			// handshake errors are expected
+			if conn, err := s.Accept(); err == nil {
+				conn.Close()
+			}
+		}
+	}()
+
+	t.Run("corrupted-banner", func(t *testing.T) {
+		b := netsshtest.Behavior{Faults: &faultinject.Config{
+			Faults: []faultinject.Fault{{Kind: faultinject.Corrupt, Direction: faultinject.Write, AfterBytes: 0}},
+		}}
+		_, err := netssh.Dial(context.Background(), s.Endpoint(b))
+		_, ok := err.(netssh.ProtocolError)
+		assert.True(t, ok, "%T %s", err, err)
+	})
+
+	t.Run("truncated-handshake", func(t *testing.T) {
+		b := netsshtest.Behavior{Faults: &faultinject.Config{
+			Faults: []faultinject.Fault{{Kind: faultinject.Truncate, Direction: faultinject.Write, AfterBytes: 10}},
+		}}
+		_, err := netssh.Dial(context.Background(), s.Endpoint(b))
+		sshErr, ok := err.(*netssh.SSHError)
+		require.True(t, ok, "%T %s", err, err)
+		assert.Equal(t, "read banner", sshErr.WhileActivity)
+	})
+}
+
+func TestSSHProcessDies(t *testing.T) {
+	s, err := netsshtest.NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+	go func() {
+		conn, err := s.Accept()
+		if err == nil {
+			io.Copy(ioutil.Discard, conn)
+			conn.Close()
+		}
+	}()
+
+	sshConn, err := netssh.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{}))
+	require.NoError(t, err)
+	defer sshConn.Close()
+	conn := faultinject.Wrap(sshConn, faultinject.Config{
+		Faults:     []faultinject.Fault{{Kind: faultinject.Disconnect, AfterTime: 50 * time.Millisecond}},
+		Disconnect: sshConn.CmdCancel,
+	})
+	_, err = io.Copy(ioutil.Discard, conn)
+	assert.NoError(t, err, "the ssh process's stdout is at EOF")
+}
@@ -0,0 +1,179 @@
+package netssh
+
+import (
+	"context"
+	"os"
+)
+
+// CloseReason tells how a ServeConn was closed, see ListenerHooks.OnClose.
+type CloseReason int
+
+const (
+	// CloseNormal is a regular Close, Proxy exits with zero exit status.
+	CloseNormal CloseReason = iota
+	// CloseAbnormal is a close after a Server handler panicked.
+	CloseAbnormal
+	// CloseShutdown is a close by Listener.Shutdown at its deadline.
+	CloseShutdown
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseNormal:
+		return "normal"
+	case CloseAbnormal:
+		return "abnormal"
+	case CloseShutdown:
+		return "shutdown"
+	default:
+		return "unknown"
+	}
+}
+
+// SSHExit tells how the ssh process of an SSHConn exited,
+// see DialerHooks.OnClose.
+type SSHExit struct {
+	// Err is the error returned by exec.Cmd.Wait, nil for exit status 0.
+	Err error
+	// Status is the exit status, or -1 if ssh was killed by a signal.
+	Status int
+	// Closed is true if ssh exited after SSHConn.Close, false if it exited
+	// on its own, e.g. because the server closed the connection.
+	Closed bool
+	// Signaled is true if netssh signaled ssh because it didn't exit
+	// within Dialer.CloseGracePeriod after Close closed its stdin.
+	// Err and Status reflect the signal then.
+	Signaled bool
+}
+
+func closeReasonFromFeedback(feedback byte) CloseReason {
+	switch feedback {
+	case 0:
+		return CloseNormal
+	case proxyFeedbackShutdown:
+		return CloseShutdown
+	default:
+		return CloseAbnormal
+	}
+}
+
+// DialerHooks are called at points in the lifecycle of the connections
+// of a Dialer, see Dialer.Hooks. Nil hooks are skipped.
+// Hooks are called synchronously and must not block.
+type DialerHooks struct {
+	// OnDial is called when Dial starts. Dial continues with the returned
+	// context, which must be derived from ctx, e.g. to add a DialTrace.
+	// It is passed to OnHandshakeDone or OnFailure at the end of Dial.
+	OnDial func(ctx context.Context, endpoint Endpoint) context.Context
+	// OnStart is called before the ssh process is started, with its argv.
+	OnStart func(argv []string)
+	// OnHandshakeDone is called when conn completed the handshake,
+	// before it is returned by Dial.
+	OnHandshakeDone func(ctx context.Context, conn *SSHConn)
+	// OnFailure is called with the error returned by Dial.
+	OnFailure func(ctx context.Context, endpoint Endpoint, err error)
+	// OnClose is called once the ssh process of conn exited,
+	// after Close or on its own. It may call Close, and may be called
+	// after Close returned.
+	OnClose func(conn *SSHConn, exit SSHExit)
+}
+
+// CombineDialerHooks returns DialerHooks that call each of hooks in order.
+// OnDial of each of hooks is passed the context returned by the previous one.
+func CombineDialerHooks(hooks ...DialerHooks) DialerHooks {
+	return DialerHooks{
+		OnDial: func(ctx context.Context, endpoint Endpoint) context.Context {
+			for _, h := range hooks {
+				if h.OnDial != nil {
+					ctx = h.OnDial(ctx, endpoint)
+				}
+			}
+			return ctx
+		},
+		OnStart: func(argv []string) {
+			for _, h := range hooks {
+				if h.OnStart != nil {
+					h.OnStart(argv)
+				}
+			}
+		},
+		OnHandshakeDone: func(ctx context.Context, conn *SSHConn) {
+			for _, h := range hooks {
+				if h.OnHandshakeDone != nil {
+					h.OnHandshakeDone(ctx, conn)
+				}
+			}
+		},
+		OnFailure: func(ctx context.Context, endpoint Endpoint, err error) {
+			for _, h := range hooks {
+				if h.OnFailure != nil {
+					h.OnFailure(ctx, endpoint, err)
+				}
+			}
+		},
+		OnClose: func(conn *SSHConn, exit SSHExit) {
+			for _, h := range hooks {
+				if h.OnClose != nil {
+					h.OnClose(conn, exit)
+				}
+			}
+		},
+	}
+}
+
+// ListenerHooks are called at points in the lifecycle of the connections
+// of a Listener, see Listener.SetHooks. Nil hooks are skipped.
+// Hooks are called synchronously and must not block.
+type ListenerHooks struct {
+	// OnFDsReceived is called in ProxyModeFD when the server received
+	// stdin and stdout from Proxy, before the handshake with the client.
+	// The files are owned by the connection and must not be closed.
+	OnFDsReceived func(peer Peer, stdin, stdout *os.File)
+	// OnHandshake is called when conn completed the handshake,
+	// before it is returned by Accept.
+	OnHandshake func(conn *ServeConn)
+	// OnReject is called for connections rejected by the AdmissionPolicy.
+	OnReject func(peer Peer)
+	// OnClose is called once conn is closed.
+	OnClose func(conn *ServeConn, reason CloseReason)
+}
+
+// CombineListenerHooks returns ListenerHooks that call each of hooks in order,
+// e.g. to use the hooks of several integrations on one Listener.
+func CombineListenerHooks(hooks ...ListenerHooks) ListenerHooks {
+	return ListenerHooks{
+		OnFDsReceived: func(peer Peer, stdin, stdout *os.File) {
+			for _, h := range hooks {
+				if h.OnFDsReceived != nil {
+					h.OnFDsReceived(peer, stdin, stdout)
+				}
+			}
+		},
+		OnHandshake: func(conn *ServeConn) {
+			for _, h := range hooks {
+				if h.OnHandshake != nil {
+					h.OnHandshake(conn)
+				}
+			}
+		},
+		OnReject: func(peer Peer) {
+			for _, h := range hooks {
+				if h.OnReject != nil {
+					h.OnReject(peer)
+				}
+			}
+		},
+		OnClose: func(conn *ServeConn, reason CloseReason) {
+			for _, h := range hooks {
+				if h.OnClose != nil {
+					h.OnClose(conn, reason)
+				}
+			}
+		},
+	}
+}
+
+// SetHooks sets the hooks. It must be called before Accept.
+func (l *Listener) SetHooks(h ListenerHooks) {
+	l.hooks = h
+}
@@ -0,0 +1,18 @@
+// Package shellquote quotes words for POSIX shell command lines,
+// such as ssh's ProxyCommand and the command option in authorized_keys.
+package shellquote
+
+import (
+	"regexp"
+	"strings"
+)
+
+var safe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// Quote quotes s for use as a single word in a POSIX shell command line.
+func Quote(s string) string {
+	if safe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,14 @@
+package shellquote
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuote(t *testing.T) {
+	assert.Equal(t, "user@host:22", Quote("user@host:22"))
+	assert.Equal(t, "'/id 1'", Quote("/id 1"))
+	assert.Equal(t, `'it'\''s'`, Quote("it's"))
+	assert.Equal(t, "''", Quote(""))
+}
@@ -0,0 +1,135 @@
+package netssh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/problame/go-netssh/internal/shellquote"
+)
+
+// jumpHostUsesDefaults is true iff the hop can be expressed in ProxyJump syntax.
+func (e Endpoint) jumpHostUsesDefaults() bool {
+	return len(e.identityFiles()) == 0 && e.CertificateFile == "" && !e.IdentitiesOnly && len(e.PrivateKeys) == 0 &&
+		e.SSHCommand == "" && len(e.Options) == 0 && !e.ForwardAgent
+}
+
+// proxyJumpSpec returns the hop in ProxyJump's [user@]host[:port] syntax.
+func (e Endpoint) proxyJumpSpec() string {
+	var spec strings.Builder
+	if e.User != "" {
+		spec.WriteString(e.User)
+		spec.WriteString("@")
+	}
+	if strings.Contains(e.Host, ":") {
+		fmt.Fprintf(&spec, "[%s]", e.Host)
+	} else {
+		spec.WriteString(e.Host)
+	}
+	if e.Port != 0 {
+		fmt.Fprintf(&spec, ":%d", e.Port)
+	}
+	return spec.String()
+}
+
+func (e Endpoint) viaArgs() []string {
+	if len(e.Via) == 0 {
+		return nil
+	}
+
+	useProxyJump := true
+	for _, hop := range e.Via {
+		useProxyJump = useProxyJump && hop.jumpHostUsesDefaults()
+	}
+	if useProxyJump {
+		specs := make([]string, len(e.Via))
+		for i, hop := range e.Via {
+			specs[i] = hop.proxyJumpSpec()
+		}
+		return []string{"-o", "ProxyJump=" + strings.Join(specs, ",")}
+	}
+
+	// The last hop forwards our connection to e.Host, the preceding
+	// hops become its own jump hosts, which recursively builds the chain.
+	hop := e.Via[len(e.Via)-1]
+	hop.Via = e.Via[:len(e.Via)-1]
+	cmd, args, _ := hop.CmdArgs()
+	destination := args[len(args)-1]
+	args = args[:len(args)-1]
+
+	// ssh performs %-expansion on the ProxyCommand, so everything except
+	// for the -W argument, which is meant to be expanded, must be escaped.
+	// The resulting string is executed by the user's shell.
+	words := make([]string, 0, len(args)+4)
+	words = append(words, shellquote.Quote(escapePercent(cmd)))
+	for _, arg := range args {
+		words = append(words, shellquote.Quote(escapePercent(arg)))
+	}
+	words = append(words, "-W", "'[%h]:%p'", shellquote.Quote(escapePercent(destination)))
+	return []string{"-o", "ProxyCommand=" + strings.Join(words, " ")}
+}
+
+func escapePercent(s string) string {
+	return strings.Replace(s, "%", "%%", -1)
+}
+
+// JumpHostError is returned by Dial if the ssh process failed
+// because a jump host in Endpoint.Via could not be reached.
+type JumpHostError struct {
+	// Hop is the index of the failed jump host in Endpoint.Via.
+	Hop      int
+	Endpoint Endpoint
+	Err      *SSHError
+}
+
+func (e *JumpHostError) Error() string {
+	return fmt.Sprintf("jump host %d (%s): %s", e.Hop, e.Endpoint.Host, e.Err)
+}
+
+func (e *JumpHostError) Unwrap() error {
+	return e.Err
+}
+
+// jumpHostError attributes err to a hop in e.Via by scanning the ssh
+// process's stderr for the hop's host name. This is best-effort: ssh only
+// mentions the host for some failures (connection refused, name resolution,
+// authentication), in all other cases err is returned as is.
+// If several hops are mentioned, the first one in the chain is the culprit.
+func (e Endpoint) jumpHostError(err *SSHError) error {
+	exitErr, ok := err.RWCError.(*exec.ExitError)
+	if !ok || len(e.Via) == 0 {
+		return err
+	}
+	if hop := jumpHostInStderr(e.Via, exitErr.Stderr); hop >= 0 {
+		return &JumpHostError{hop, e.Via[hop], err}
+	}
+	return err
+}
+
+func jumpHostInStderr(via []Endpoint, stderr []byte) int {
+	patterns := make([]*regexp.Regexp, len(via))
+	for i, hop := range via {
+		patterns[i] = regexp.MustCompile(`(^|[^A-Za-z0-9.-])` + regexp.QuoteMeta(hop.Host) + `($|[^A-Za-z0-9.-])`)
+	}
+	failed := -1
+	s := bufio.NewScanner(bytes.NewReader(stderr))
+	for s.Scan() {
+		line := s.Text()
+		// e.g. "Warning: Permanently added 'jump' (ED25519) to the list of known hosts."
+		if strings.HasPrefix(line, "Warning:") {
+			continue
+		}
+		for i := range via {
+			if via[i].Host == "" {
+				continue
+			}
+			if (failed == -1 || i < failed) && patterns[i].MatchString(line) {
+				failed = i
+			}
+		}
+	}
+	return failed
+}
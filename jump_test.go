@@ -0,0 +1,92 @@
+package netssh
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointCmdArgsVia(t *testing.T) {
+
+	t.Run("proxyjump", func(t *testing.T) {
+		e := Endpoint{
+			Host: "target", User: "u", Port: 22, IdentityFile: "/id",
+			Via: []Endpoint{
+				{Host: "jump1", User: "j1", Port: 2222},
+				{Host: "fe80::1"},
+			},
+		}
+		_, args, _ := e.CmdArgs()
+		assert.Equal(t, []string{
+			"-p", "22", "-T", "-i", "/id", "-o", "BatchMode=yes",
+			"-o", "ProxyJump=j1@jump1:2222,[fe80::1]",
+			"u@target",
+		}, args)
+	})
+
+	t.Run("proxycommand", func(t *testing.T) {
+		e := Endpoint{
+			Host: "target", User: "u", Port: 22, IdentityFile: "/id",
+			Via: []Endpoint{
+				{Host: "jump1", User: "j1", Port: 22, IdentityFile: "/id 1"},
+				{Host: "jump2", User: "j2", Port: 22, Options: []string{"ControlPath=/tmp/%r@%h"}},
+			},
+		}
+		_, args, _ := e.CmdArgs()
+		require.Len(t, args, 10)
+		assert.Equal(t, "ProxyCommand="+
+			"ssh -p 22 -T -o BatchMode=yes -o ControlPath=/tmp/%%r@%%h "+
+			"-o 'ProxyCommand=ssh -p 22 -T -i '\\''/id 1'\\'' -o BatchMode=yes -W '\\''[%%h]:%%p'\\'' j1@jump1' "+
+			"-W '[%h]:%p' j2@jump2",
+			args[8])
+		assert.Equal(t, "u@target", args[9])
+	})
+
+	t.Run("proxycommand without ports", func(t *testing.T) {
+		e := Endpoint{
+			Host: "target", User: "u",
+			Via: []Endpoint{
+				{Host: "jump1"},
+				{Host: "jump2"},
+				{Host: "jump3", ForwardAgent: true},
+			},
+		}
+		_, args, _ := e.CmdArgs()
+		require.Len(t, args, 6)
+		assert.Equal(t, "ProxyCommand="+
+			"ssh -T -o BatchMode=yes -o ForwardAgent=yes "+
+			"-o ProxyJump=jump1,jump2 "+
+			"-W '[%h]:%p' jump3",
+			args[4])
+		assert.Equal(t, "u@target", args[5])
+	})
+
+}
+
+func TestJumpHostInStderr(t *testing.T) {
+	via := []Endpoint{{Host: "jump1"}, {Host: "jump2"}}
+
+	tcs := []struct {
+		stderr string
+		hop    int
+	}{
+		{"ssh: connect to host jump1 port 22: Connection refused\nConnection closed by UNKNOWN port 65535\n", 0},
+		{"Warning: Permanently added 'jump1' (ED25519) to the list of known hosts.\nj2@jump2: Permission denied (publickey).\n", 1},
+		{"ssh: Could not resolve hostname jump2: Name or service not known\n", 1},
+		{"u@target: Permission denied (publickey).\n", -1},
+		{"ssh: connect to host jump10 port 22: Connection refused\n", -1},
+	}
+	for _, tc := range tcs {
+		assert.Equal(t, tc.hop, jumpHostInStderr(via, []byte(tc.stderr)), "%q", tc.stderr)
+	}
+
+	e := Endpoint{Host: "target", Via: via}
+	exitErr := &exec.ExitError{Stderr: []byte(tcs[1].stderr)}
+	err := e.jumpHostError(&SSHError{RWCError: exitErr})
+	jerr, ok := err.(*JumpHostError)
+	require.True(t, ok)
+	assert.Equal(t, 1, jerr.Hop)
+	assert.Equal(t, "jump2", jerr.Endpoint.Host)
+}
@@ -0,0 +1,114 @@
+package netssh
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// tempKeys is a private directory holding key material
+// that must outlive the ssh process's startup.
+type tempKeys struct {
+	dir string
+	n   int
+}
+
+func newTempKeys() (*tempKeys, error) {
+	dir, err := ioutil.TempDir("", "netssh-keys")
+	if err != nil {
+		return nil, err
+	}
+	return &tempKeys{dir: dir}, nil
+}
+
+// newName returns a path in the directory that has not been returned before.
+func (k *tempKeys) newName() string {
+	k.n++
+	return filepath.Join(k.dir, fmt.Sprintf("key%d", k.n))
+}
+
+// write creates a new file with mode 0600 at path.
+func (k *tempKeys) write(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil && !bytes.HasSuffix(data, []byte("\n")) {
+		// ssh rejects some key formats without trailing newline
+		_, err = f.Write([]byte("\n"))
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writePrivateKeys moves e.PrivateKeys to temporary identity files,
+// recursing into e.Via.
+func (k *tempKeys) writePrivateKeys(e Endpoint) (Endpoint, error) {
+	if len(e.PrivateKeys) > 0 {
+		identityFiles := make([]string, 0, len(e.IdentityFiles)+len(e.PrivateKeys))
+		identityFiles = append(identityFiles, e.IdentityFiles...)
+		for _, key := range e.PrivateKeys {
+			path := k.newName()
+			if err := k.write(path, key); err != nil {
+				return e, err
+			}
+			identityFiles = append(identityFiles, path)
+		}
+		e.IdentityFiles = identityFiles
+		e.PrivateKeys = nil
+	}
+	if len(e.Via) > 0 {
+		via := make([]Endpoint, len(e.Via))
+		for i, hop := range e.Via {
+			var err error
+			if via[i], err = k.writePrivateKeys(hop); err != nil {
+				return e, err
+			}
+		}
+		e.Via = via
+	}
+	return e, nil
+}
+
+// remove is a no-op for k == nil.
+func (k *tempKeys) remove() {
+	if k == nil {
+		return
+	}
+	os.RemoveAll(k.dir)
+}
+
+func endpointHasPrivateKeys(e Endpoint) bool {
+	if len(e.PrivateKeys) > 0 {
+		return true
+	}
+	for _, hop := range e.Via {
+		if endpointHasPrivateKeys(hop) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTempKeys returns a nil *tempKeys if e does not use PrivateKeys,
+// unless always is set.
+func writeTempKeys(e Endpoint, always bool) (*tempKeys, Endpoint, error) {
+	if !always && !endpointHasPrivateKeys(e) {
+		return nil, e, nil
+	}
+	keys, err := newTempKeys()
+	if err != nil {
+		return nil, e, err
+	}
+	e, err = keys.writePrivateKeys(e)
+	if err != nil {
+		keys.remove()
+		return nil, e, err
+	}
+	return keys, e, nil
+}
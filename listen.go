@@ -0,0 +1,261 @@
+package netssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// ListenConfig contains options for creating the server socket.
+// The zero value is valid and equivalent to calling Listen.
+type ListenConfig struct {
+	// Mode, if not zero, are the permission bits of the socket file.
+	// The socket is only reachable at its path once Mode and Owner are applied.
+	Mode os.FileMode
+	// Owner, if not nil, is the owner of the socket file.
+	Owner *SocketOwner
+	// RemoveStale removes a socket file left behind by a server that did
+	// not shut down cleanly. To tell stale sockets from those of running
+	// servers, the Listener holds an exclusive lock on the file at the
+	// socket's path + LockSuffix until it is closed. Listen fails if the
+	// lock is held by another process.
+	RemoveStale bool
+}
+
+// SocketOwner identifies the owner of a socket file.
+// Use -1 to leave UID or GID unchanged.
+type SocketOwner struct {
+	UID, GID int
+}
+
+// LockSuffix is appended to the socket path to get the path of the lock file
+// used by ListenConfig.RemoveStale.
+const LockSuffix = ".lock"
+
+// Listen creates the server socket at path, applying the options in c.
+func (c *ListenConfig) Listen(path string) (*Listener, error) {
+
+	var lock *os.File
+	if c.RemoveStale {
+		var err error
+		lock, err = lockSocket(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := removeStaleSocket(path); err != nil {
+			lock.Close()
+			return nil, err
+		}
+	}
+
+	l, err := c.listen(path)
+	if err != nil {
+		if lock != nil {
+			lock.Close()
+		}
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	return newListener(l, path, true, lock), nil
+}
+
+func (c *ListenConfig) listen(path string) (*net.UnixListener, error) {
+	if c.Mode == 0 && c.Owner == nil {
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		return l.(*net.UnixListener), nil
+	}
+
+	// Bind to a temporary name that nobody else can use and move it into
+	// place once the permissions are set. Changing umask instead would
+	// affect all goroutines.
+	tmpDir, err := ioutil.TempDir(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmp := filepath.Join(tmpDir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*net.UnixListener, error) {
+		l.Close()
+		return nil, err
+	}
+	if c.Owner != nil {
+		if err := os.Lchown(tmp, c.Owner.UID, c.Owner.GID); err != nil {
+			return fail(err)
+		}
+	}
+	if c.Mode != 0 {
+		if err := os.Chmod(tmp, c.Mode.Perm()); err != nil {
+			return fail(err)
+		}
+	}
+	// link(2) instead of rename(2) because it fails if path exists, like bind(2)
+	if err := os.Link(tmp, path); err != nil {
+		return fail(err)
+	}
+	return l, nil
+}
+
+// lockSocket locks the lock file for the socket at path, see ListenConfig.RemoveStale.
+func lockSocket(path string) (*os.File, error) {
+	lock, err := os.OpenFile(path+LockSuffix, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	unix.CloseOnExec(int(lock.Fd()))
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		lock.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, fmt.Errorf("netssh: socket %s is in use by another server", path)
+		}
+		return nil, err
+	}
+	return lock, nil
+}
+
+// removeStaleSocket removes the file at path if it is a socket.
+// The caller must hold the lock.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("netssh: refusing to remove %s: not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// ListenFromFile creates a Listener from f, which must be a listening
+// unix socket, e.g. inherited from the parent process.
+// Like net.FileListener, it duplicates f, so the caller should close f.
+// The socket file is not removed when the Listener is closed.
+func ListenFromFile(f *os.File) (*Listener, error) {
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	ul, ok := l.(*net.UnixListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("netssh: %s is not a unix socket", f.Name())
+	}
+	ul.SetUnlinkOnClose(false)
+	return newListener(ul, "", false, nil), nil
+}
+
+// listenFDsStart is SD_LISTEN_FDS_START in sd_listen_fds(3)
+const listenFDsStart = 3
+
+type systemdFD struct {
+	fd   int
+	name string
+}
+
+var systemd struct {
+	once sync.Once
+	fds  []systemdFD
+	err  error
+
+	mtx     sync.Mutex
+	adopted map[int]bool
+}
+
+// ListenFromSystemd creates a Listener from a socket passed by systemd
+// socket activation (LISTEN_FDS), see sd_listen_fds(3).
+// If name is empty, exactly one socket must have been passed.
+// Otherwise, the socket's FileDescriptorName= must match name.
+// Each socket can only be adopted once.
+// The socket file is not removed when the Listener is closed, it is owned by systemd.
+func ListenFromSystemd(name string) (*Listener, error) {
+	systemd.once.Do(func() {
+		systemd.fds, systemd.err = parseSystemdEnv(os.Getenv, os.Getpid())
+		for _, sfd := range systemd.fds {
+			// don't leak the sockets to child processes
+			unix.CloseOnExec(sfd.fd)
+		}
+	})
+	if systemd.err != nil {
+		return nil, systemd.err
+	}
+
+	var candidates []systemdFD
+	for _, sfd := range systemd.fds {
+		if name == "" || sfd.name == name {
+			candidates = append(candidates, sfd)
+		}
+	}
+	switch {
+	case len(candidates) == 0:
+		return nil, fmt.Errorf("netssh: no socket named %q passed by systemd", name)
+	case name == "" && len(candidates) > 1:
+		return nil, fmt.Errorf("netssh: systemd passed %d sockets, specify a name", len(candidates))
+	}
+	sfd := candidates[0]
+
+	systemd.mtx.Lock()
+	defer systemd.mtx.Unlock()
+	if systemd.adopted[sfd.fd] {
+		return nil, fmt.Errorf("netssh: socket %q passed by systemd is already in use", sfd.name)
+	}
+	f := os.NewFile(uintptr(sfd.fd), sfd.name)
+	l, err := ListenFromFile(f)
+	if err != nil {
+		return nil, err
+	}
+	// ListenFromFile duplicated the fd
+	f.Close()
+	if systemd.adopted == nil {
+		systemd.adopted = make(map[int]bool)
+	}
+	systemd.adopted[sfd.fd] = true
+	return l, nil
+}
+
+// parseSystemdEnv returns the fds passed to process pid, or an error
+// if there are none.
+func parseSystemdEnv(getenv func(string) string, pid int) ([]systemdFD, error) {
+	if getenv("LISTEN_PID") == "" {
+		return nil, fmt.Errorf("netssh: not started by systemd socket activation (LISTEN_PID not set)")
+	}
+	listenPid, err := strconv.Atoi(getenv("LISTEN_PID"))
+	if err != nil {
+		return nil, fmt.Errorf("netssh: invalid LISTEN_PID: %s", err)
+	}
+	if listenPid != pid {
+		return nil, fmt.Errorf("netssh: LISTEN_PID %d is not our pid %d", listenPid, pid)
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("netssh: invalid LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if s := getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+	fds := make([]systemdFD, n)
+	for i := range fds {
+		fds[i].fd = listenFDsStart + i
+		if i < len(names) {
+			fds[i].name = names[i]
+		} else {
+			fds[i].name = "unknown" // like sd_listen_fds_with_names(3)
+		}
+	}
+	return fds, nil
+}
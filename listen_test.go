@@ -0,0 +1,126 @@
+package netssh
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempSocketPath(t *testing.T) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "netssh-listen")
+	require.NoError(t, err)
+	return filepath.Join(dir, "s"), func() { os.RemoveAll(dir) }
+}
+
+func TestListenConfigModeAndOwner(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+
+	c := ListenConfig{Mode: 0660, Owner: &SocketOwner{os.Getuid(), os.Getgid()}}
+	l, err := c.Listen(path)
+	require.NoError(t, err)
+	fi, err := os.Lstat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSocket|0660, fi.Mode())
+	assert.Equal(t, path, l.Addr().String())
+
+	// the socket is reachable at path
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	conn.Close()
+
+	// no leftovers from the temporary name
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	require.NoError(t, l.Close())
+	_, err = os.Lstat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestListenConfigRemoveStale(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+
+	// simulate a server that crashed
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	_, err = Listen(path)
+	require.Error(t, err, "plain Listen must not remove the socket")
+
+	c := ListenConfig{RemoveStale: true}
+	l, err := c.Listen(path)
+	require.NoError(t, err)
+
+	_, err = c.Listen(path)
+	assert.Error(t, err, "must not remove the socket of a running server")
+	_, err = os.Lstat(path)
+	assert.NoError(t, err)
+
+	require.NoError(t, l.Close())
+
+	// not a socket
+	require.NoError(t, ioutil.WriteFile(path, []byte("data"), 0600))
+	_, err = c.Listen(path)
+	assert.Error(t, err)
+	_, err = os.Lstat(path)
+	assert.NoError(t, err)
+}
+
+func TestListenFromFile(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+
+	orig, err := Listen(path)
+	require.NoError(t, err)
+	defer orig.Close()
+	f, err := orig.File()
+	require.NoError(t, err)
+	l, err := ListenFromFile(f)
+	f.Close()
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	_, err = os.Lstat(path)
+	assert.NoError(t, err, "inherited socket must not be removed")
+
+	notUnix, err := ioutil.TempFile("", "netssh-listen")
+	require.NoError(t, err)
+	defer os.Remove(notUnix.Name())
+	defer notUnix.Close()
+	_, err = ListenFromFile(notUnix)
+	assert.Error(t, err)
+}
+
+func TestParseSystemdEnv(t *testing.T) {
+	pid := os.Getpid()
+	env := func(m map[string]string) func(string) string {
+		return func(k string) string { return m[k] }
+	}
+
+	_, err := parseSystemdEnv(env(nil), pid)
+	assert.Error(t, err)
+
+	_, err = parseSystemdEnv(env(map[string]string{
+		"LISTEN_PID": strconv.Itoa(pid + 1),
+		"LISTEN_FDS": "1",
+	}), pid)
+	assert.Error(t, err)
+
+	fds, err := parseSystemdEnv(env(map[string]string{
+		"LISTEN_PID":     strconv.Itoa(pid),
+		"LISTEN_FDS":     "2",
+		"LISTEN_FDNAMES": "netssh",
+	}), pid)
+	require.NoError(t, err)
+	assert.Equal(t, []systemdFD{{3, "netssh"}, {4, "unknown"}}, fds)
+}
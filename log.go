@@ -0,0 +1,77 @@
+package netssh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Keys of the attributes of log records. Records about a connection carry
+// LogKeyConn and LogKeyEndpoint, LogKeyPeer once the server knows the peer,
+// and LogKeyPhase, one of the Phase* constants or another step such as
+// "serve" or "relay".
+const (
+	// LogKeyConn is the connection ID, see SSHConn.ID and ServeConn.ID.
+	LogKeyConn = "conn"
+	// LogKeyPeer is Peer.ID.
+	LogKeyPeer = "peer"
+	// LogKeyEndpoint is the ssh destination for Dial and
+	// the server's socket path for Proxy and Listener.
+	LogKeyEndpoint = "endpoint"
+	// LogKeyPhase is the step of the connection's lifecycle.
+	LogKeyPhase = "phase"
+)
+
+// Steps outside of the connection setup for LogKeyPhase.
+const (
+	phaseAccept     = "accept"
+	phaseActivation = "activation"
+	phaseRelay      = "relay"
+	phaseServe      = "serve"
+	phaseClose      = "close"
+)
+
+// NewPrintfHandler returns a slog.Handler that formats records of all
+// levels like slog.TextHandler, without the time, and passes them to log.
+func NewPrintfHandler(log Logger) slog.Handler {
+	return slog.NewTextHandler(printfWriter{log}, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+}
+
+// printfWriter relies on slog.TextHandler writing each record with a single Write.
+type printfWriter struct {
+	log Logger
+}
+
+func (w printfWriter) Write(p []byte) (int, error) {
+	w.log.Printf("%s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
+
+// newConnID returns a random connection ID.
+func newConnID() string {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("netssh: cannot read random bytes: %s", err))
+	}
+	return hex.EncodeToString(buf[:])
+}
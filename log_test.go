@@ -0,0 +1,101 @@
+package netssh
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordHandler collects the attributes of all records.
+type recordHandler struct {
+	mtx     *sync.Mutex
+	attrs   []slog.Attr
+	records *[]map[string]string
+}
+
+func newRecordHandler() *recordHandler {
+	return &recordHandler{mtx: &sync.Mutex{}, records: &[]map[string]string{}}
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	rec := map[string]string{"msg": r.Message}
+	for _, a := range h.attrs {
+		rec[a.Key] = a.Value.String()
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		rec[a.Key] = a.Value.String()
+		return true
+	})
+	h.mtx.Lock()
+	*h.records = append(*h.records, rec)
+	h.mtx.Unlock()
+	return nil
+}
+
+func (h *recordHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	return &c
+}
+
+func (h *recordHandler) WithGroup(string) slog.Handler { panic("not used") }
+
+func (h *recordHandler) find(msg string) map[string]string {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for _, rec := range *h.records {
+		if rec["msg"] == msg {
+			return rec
+		}
+	}
+	return nil
+}
+
+func TestListenerLogAttributes(t *testing.T) {
+	l, cleanup := listenTemp(t)
+	defer cleanup()
+	h := newRecordHandler()
+	l.SetLogger(slog.New(h))
+
+	go func() {
+		c, resp := dialRelayClientAs(t, l.Addr().String(), Peer{KeyID: "backup"})
+		require.Equal(t, proxy_mode_ok_msg, resp)
+		c.handshake()
+	}()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	require.NotEmpty(t, conn.ID())
+	require.NoError(t, conn.Close())
+
+	for msg, phase := range map[string]string{
+		"handshake complete": PhaseBanner,
+		"connection closed":  phaseClose,
+	} {
+		rec := h.find(msg)
+		require.NotNil(t, rec, msg)
+		assert.Equal(t, conn.ID(), rec[LogKeyConn], msg)
+		assert.Equal(t, "key:backup", rec[LogKeyPeer], msg)
+		assert.Equal(t, l.Addr().String(), rec[LogKeyEndpoint], msg)
+		assert.Equal(t, phase, rec[LogKeyPhase], msg)
+	}
+}
+
+type printfLog []string
+
+func (l *printfLog) Printf(format string, args ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, args...))
+}
+
+func TestPrintfHandler(t *testing.T) {
+	var lines printfLog
+	log := slog.New(NewPrintfHandler(&lines)).With(LogKeyConn, "c1")
+	log.Debug("accepting", LogKeyPhase, phaseAccept)
+	assert.Equal(t, printfLog{`level=DEBUG msg=accepting conn=c1 phase=accept`}, lines)
+}
@@ -0,0 +1,278 @@
+// Package metrics exposes Prometheus collectors for netssh.
+//
+// DialCollector instruments Dialers through netssh.DialerHooks,
+// ListenerCollector instruments Listeners through netssh.ListenerHooks:
+//
+//	dc := metrics.NewDialCollector()
+//	prometheus.MustRegister(dc)
+//	dialer := &netssh.Dialer{Hooks: dc.Hooks()}
+//
+//	lc := metrics.NewListenerCollector()
+//	prometheus.MustRegister(lc)
+//	listener.SetHooks(lc.Hooks())
+//
+// Use netssh.CombineDialerHooks and netssh.CombineListenerHooks to combine
+// the hooks with those of other integrations.
+//
+// Package netssh itself does not depend on Prometheus.
+package metrics
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/problame/go-netssh"
+)
+
+const namespace = "netssh"
+
+// DialCollector counts Dial attempts and failures and observes their duration,
+// see DialCollector.Hooks.
+type DialCollector struct {
+	attempts prometheus.Counter
+	failures *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func NewDialCollector() *DialCollector {
+	return &DialCollector{
+		attempts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "dial",
+			Name:      "attempts_total",
+			Help:      "Number of Dial attempts.",
+		}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "dial",
+			Name:      "failures_total",
+			Help:      "Number of failed Dial attempts by reason.",
+		}, []string{"reason"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "dial",
+			Name:      "duration_seconds",
+			Help:      "Duration of Dial, including ssh connection setup and the netssh handshake.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		}, []string{"result"}),
+	}
+}
+
+type dialStartKey struct{}
+
+// Hooks returns the hooks to use as netssh.Dialer.Hooks.
+func (c *DialCollector) Hooks() netssh.DialerHooks {
+	return netssh.DialerHooks{
+		OnDial:          c.onDial,
+		OnHandshakeDone: c.onHandshakeDone,
+		OnFailure:       c.onFailure,
+	}
+}
+
+func (c *DialCollector) onDial(ctx context.Context, endpoint netssh.Endpoint) context.Context {
+	c.attempts.Inc()
+	return context.WithValue(ctx, dialStartKey{}, time.Now())
+}
+
+func (c *DialCollector) onHandshakeDone(ctx context.Context, conn *netssh.SSHConn) {
+	c.observe(ctx, "success")
+}
+
+func (c *DialCollector) onFailure(ctx context.Context, endpoint netssh.Endpoint, err error) {
+	c.failures.WithLabelValues(FailureReason(err)).Inc()
+	c.observe(ctx, "failure")
+}
+
+func (c *DialCollector) observe(ctx context.Context, result string) {
+	if pre, ok := ctx.Value(dialStartKey{}).(time.Time); ok {
+		c.duration.WithLabelValues(result).Observe(time.Since(pre).Seconds())
+	}
+}
+
+func (c *DialCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.attempts.Describe(ch)
+	c.failures.Describe(ch)
+	c.duration.Describe(ch)
+}
+
+func (c *DialCollector) Collect(ch chan<- prometheus.Metric) {
+	c.attempts.Collect(ch)
+	c.failures.Collect(ch)
+	c.duration.Collect(ch)
+}
+
+// sshErrorReasons map OpenSSH error messages to reasons, first match wins.
+var sshErrorReasons = []struct {
+	substr, reason string
+}{
+	{"Permission denied", "auth"},
+	{"Host key verification failed", "host_key"},
+	{"REMOTE HOST IDENTIFICATION HAS CHANGED", "host_key"},
+	{"Could not resolve hostname", "dns"},
+	{"Connection refused", "connection_refused"},
+	{"Connection timed out", "connect_timeout"},
+	{"No route to host", "no_route"},
+	{"Connection closed by", "connection_closed"},
+	{"Connection reset by", "connection_closed"},
+}
+
+// FailureReason classifies an error returned by Dial for the reason label
+// of netssh_dial_failures_total.
+func FailureReason(err error) string {
+	switch err := err.(type) {
+	case nil:
+		return ""
+	case netssh.BusyError:
+		return "busy"
+	case netssh.ProtocolError:
+		return "protocol"
+	case *netssh.JumpHostError:
+		return "jump_host_" + sshErrorReason(err.Err)
+	case *netssh.SSHError:
+		return sshErrorReason(err)
+	}
+	switch err {
+	case context.Canceled:
+		return "canceled"
+	case context.DeadlineExceeded:
+		return "timeout"
+	}
+	return "other"
+}
+
+func sshErrorReason(err *netssh.SSHError) string {
+	exitErr, ok := err.RWCError.(*exec.ExitError)
+	if !ok {
+		return "ssh_io"
+	}
+	stderr := string(exitErr.Stderr)
+	for _, r := range sshErrorReasons {
+		if strings.Contains(stderr, r.substr) {
+			return r.reason
+		}
+	}
+	return "ssh_other"
+}
+
+// ListenerCollector counts the connections of one or more Listeners,
+// see ListenerCollector.Hooks.
+type ListenerCollector struct {
+	accepted  prometheus.Counter
+	rejected  prometheus.Counter
+	closed    *prometheus.CounterVec
+	handshake prometheus.Histogram
+	active    *prometheus.Desc
+	bytes     *prometheus.Desc
+
+	mtx sync.Mutex
+	// conns are the active connections, their bytes are added to
+	// closedBytes once they are closed
+	conns                          map[*netssh.ServeConn]struct{}
+	closedBytesRead, closedWritten int64
+}
+
+func NewListenerCollector() *ListenerCollector {
+	return &ListenerCollector{
+		accepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "listener",
+			Name:      "accepted_total",
+			Help:      "Number of connections that completed the handshake.",
+		}),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "listener",
+			Name:      "rejected_total",
+			Help:      "Number of connections rejected by the admission policy.",
+		}),
+		closed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "listener",
+			Name:      "closed_total",
+			Help:      "Number of closed connections by close reason.",
+		}, []string{"reason"}),
+		handshake: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "listener",
+			Name:      "handshake_duration_seconds",
+			Help:      "Time from accepting a connection to the completed handshake.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		active: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "listener", "active_connections"),
+			"Number of open connections.", nil, nil),
+		bytes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "listener", "bytes_total"),
+			"Bytes transferred by connections, direction is from the server's perspective.",
+			[]string{"direction"}, nil),
+		conns: make(map[*netssh.ServeConn]struct{}),
+	}
+}
+
+// Hooks returns the hooks to pass to Listener.SetHooks.
+func (c *ListenerCollector) Hooks() netssh.ListenerHooks {
+	return netssh.ListenerHooks{
+		OnHandshake: c.onHandshake,
+		OnReject:    c.onReject,
+		OnClose:     c.onClose,
+	}
+}
+
+func (c *ListenerCollector) onHandshake(conn *netssh.ServeConn) {
+	c.accepted.Inc()
+	c.handshake.Observe(conn.Stats().HandshakeDuration.Seconds())
+	c.mtx.Lock()
+	c.conns[conn] = struct{}{}
+	c.mtx.Unlock()
+}
+
+func (c *ListenerCollector) onReject(peer netssh.Peer) {
+	c.rejected.Inc()
+}
+
+func (c *ListenerCollector) onClose(conn *netssh.ServeConn, reason netssh.CloseReason) {
+	c.closed.WithLabelValues(reason.String()).Inc()
+	stats := conn.Stats()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.conns[conn]; !ok {
+		return // closed during the handshake
+	}
+	delete(c.conns, conn)
+	c.closedBytesRead += stats.BytesRead
+	c.closedWritten += stats.BytesWritten
+}
+
+func (c *ListenerCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.accepted.Describe(ch)
+	c.rejected.Describe(ch)
+	c.closed.Describe(ch)
+	c.handshake.Describe(ch)
+	ch <- c.active
+	ch <- c.bytes
+}
+
+func (c *ListenerCollector) Collect(ch chan<- prometheus.Metric) {
+	c.accepted.Collect(ch)
+	c.rejected.Collect(ch)
+	c.closed.Collect(ch)
+	c.handshake.Collect(ch)
+
+	c.mtx.Lock()
+	active := len(c.conns)
+	read, written := c.closedBytesRead, c.closedWritten
+	for conn := range c.conns {
+		stats := conn.Stats()
+		read += stats.BytesRead
+		written += stats.BytesWritten
+	}
+	c.mtx.Unlock()
+	ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(active))
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.CounterValue, float64(read), "read")
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.CounterValue, float64(written), "write")
+}
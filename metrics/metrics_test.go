@@ -0,0 +1,114 @@
+package metrics_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/problame/go-netssh"
+	"github.com/problame/go-netssh/metrics"
+	"github.com/problame/go-netssh/netsshtest"
+)
+
+func TestMain(m *testing.M) {
+	netsshtest.Main()
+	os.Exit(m.Run())
+}
+
+func TestCollectors(t *testing.T) {
+	s, err := netsshtest.NewServer()
+	require.NoError(t, err)
+	defer s.Close()
+	lc := metrics.NewListenerCollector()
+	s.SetHooks(lc.Hooks())
+	dc := metrics.NewDialCollector()
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(lc))
+	require.NoError(t, reg.Register(dc))
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+		conn.Write([]byte("bye"))
+		conn.Close()
+	}()
+
+	d := &netssh.Dialer{Hooks: dc.Hooks()}
+	conn, err := d.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{}))
+	require.NoError(t, err)
+	_, err = conn.Write(make([]byte, 1000))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+	_, err = io.Copy(ioutil.Discard, conn)
+	require.NoError(t, err)
+	<-served
+	require.NoError(t, conn.Close())
+
+	assert.Equal(t, 1.0, value(t, reg, "netssh_dial_attempts_total", ""))
+	assert.Equal(t, 1.0, value(t, reg, "netssh_listener_accepted_total", ""))
+	assert.Equal(t, 0.0, value(t, reg, "netssh_listener_active_connections", ""))
+	assert.Equal(t, 1.0, value(t, reg, "netssh_listener_closed_total", "normal"))
+	assert.Equal(t, 1000.0, value(t, reg, "netssh_listener_bytes_total", "read"))
+	assert.Equal(t, 3.0, value(t, reg, "netssh_listener_bytes_total", "write"))
+
+	_, err = d.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{AuthFailure: true}))
+	require.Error(t, err)
+	assert.Equal(t, 2.0, value(t, reg, "netssh_dial_attempts_total", ""))
+	assert.Equal(t, 1.0, value(t, reg, "netssh_dial_failures_total", "auth"))
+}
+
+// value returns the value of the counter or gauge name, with the
+// only label's value being label.
+func value(t *testing.T, g prometheus.Gatherer, name, label string) float64 {
+	mfs, err := g.Gather()
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if len(m.GetLabel()) > 0 && m.GetLabel()[0].GetValue() != label {
+				continue
+			}
+			if m.Counter != nil {
+				return m.Counter.GetValue()
+			}
+			return m.Gauge.GetValue()
+		}
+	}
+	return 0
+}
+
+func TestFailureReason(t *testing.T) {
+	sshErr := func(stderr string) *netssh.SSHError {
+		return &netssh.SSHError{RWCError: &exec.ExitError{Stderr: []byte(stderr)}}
+	}
+	tests := []struct {
+		err    error
+		reason string
+	}{
+		{netssh.BusyError{}, "busy"},
+		{netssh.ProtocolError{What: "x"}, "protocol"},
+		{context.DeadlineExceeded, "timeout"},
+		{sshErr("ssh: Could not resolve hostname foo: Name or service not known"), "dns"},
+		{sshErr("Host key verification failed."), "host_key"},
+		{sshErr("something else"), "ssh_other"},
+		{&netssh.JumpHostError{Err: sshErr("Connection refused")}, "jump_host_connection_refused"},
+		{io.ErrUnexpectedEOF, "other"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.reason, metrics.FailureReason(test.err), "%s", test.err)
+	}
+}
@@ -0,0 +1,246 @@
+package netssh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMaxMsgSize is used if MsgConfig.MaxSize is zero.
+const DefaultMaxMsgSize = 1 << 20
+
+const (
+	msgHeaderLen   = 4
+	msgChecksumLen = 4
+)
+
+var msgChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// MsgConfig configures a MsgConn. Both sides of the connection must use
+// the same Checksum setting.
+type MsgConfig struct {
+	// MaxSize is the maximum size of a message in bytes, for both directions.
+	// DefaultMaxMsgSize is used if zero.
+	MaxSize int
+	// Checksum appends a CRC-32C of each message, which RecvMsg verifies.
+	// The transports of this package are reliable, so this only guards
+	// against bugs in custom transports or the peer.
+	Checksum bool
+}
+
+// MsgTooLargeError is returned by SendMsg for messages larger than MsgConfig.MaxSize.
+type MsgTooLargeError struct {
+	Size, MaxSize int
+}
+
+func (e MsgTooLargeError) Error() string {
+	return fmt.Sprintf("netssh: message of %d bytes exceeds maximum of %d bytes", e.Size, e.MaxSize)
+}
+
+// MsgConn sends and receives messages over a byte stream such as SSHConn or
+// ServeConn. Each message is sent as a 4 byte big endian length, the payload,
+// and, if MsgConfig.Checksum is set, the CRC-32C of the payload.
+//
+// MsgConn implements net.PacketConn for code that wants datagram semantics,
+// with the remote address of the underlying connection as the only peer.
+//
+// SendMsg and RecvMsg are safe to call concurrently with each other, and
+// concurrent calls of the same method are serialized.
+//
+// Deadlines are those of the underlying connection. If a read deadline
+// expires in the middle of a message, the next RecvMsg continues with that
+// message. If a write deadline expires in the middle of a message, the
+// stream cannot be resynchronized and subsequent SendMsg calls fail.
+type MsgConn struct {
+	conn    net.Conn
+	maxSize int
+	sum     bool
+
+	rmtx sync.Mutex
+	r    msgReadState
+
+	wmtx sync.Mutex
+	wbuf []byte
+	werr error // sticky
+}
+
+// msgReadState is the progress of reading a message, preserved across
+// RecvMsg calls that return a timeout.
+type msgReadState struct {
+	partialReader
+	hdr [msgHeaderLen]byte
+	// body is nil until hdr is complete, then it holds payload and checksum.
+	body []byte
+	buf  []byte // reused for body
+}
+
+var _ net.PacketConn = (*MsgConn)(nil)
+
+// NewMsgConn returns a MsgConn that owns conn.
+// conn must not be used directly afterwards.
+func NewMsgConn(conn net.Conn, config MsgConfig) *MsgConn {
+	maxSize := config.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMsgSize
+	}
+	c := &MsgConn{conn: conn, maxSize: maxSize, sum: config.Checksum}
+	c.r.r = conn
+	return c
+}
+
+func (c *MsgConn) trailerLen() int {
+	if c.sum {
+		return msgChecksumLen
+	}
+	return 0
+}
+
+// SendMsg sends p as a single message.
+// Messages larger than MsgConfig.MaxSize fail with MsgTooLargeError
+// without affecting the connection.
+func (c *MsgConn) SendMsg(p []byte) error {
+	if len(p) > c.maxSize {
+		return MsgTooLargeError{len(p), c.maxSize}
+	}
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+	if c.werr != nil {
+		return c.werr
+	}
+
+	// a single Write so that a failure before any progress leaves the stream intact
+	c.wbuf = append(c.wbuf[:0], 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(c.wbuf, uint32(len(p)))
+	c.wbuf = append(c.wbuf, p...)
+	if c.sum {
+		c.wbuf = binary.BigEndian.AppendUint32(c.wbuf, crc32.Checksum(p, msgChecksumTable))
+	}
+	n, err := c.conn.Write(c.wbuf)
+	if err != nil && n > 0 {
+		c.werr = err
+	}
+	return err
+}
+
+// RecvMsg receives the next message.
+// It returns io.EOF if the peer closed the connection between messages.
+func (c *MsgConn) RecvMsg() ([]byte, error) {
+	c.rmtx.Lock()
+	defer c.rmtx.Unlock()
+	payload, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, len(payload))
+	copy(msg, payload)
+	return msg, nil
+}
+
+// recv returns the payload of the next message, which is valid until the
+// next call. c.rmtx must be held.
+func (c *MsgConn) recv() ([]byte, error) {
+	r := &c.r
+	if r.body == nil {
+		if err := r.readFull(r.hdr[:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(r.hdr[:])
+		if uint64(size) > uint64(c.maxSize) {
+			r.err = ProtocolError{fmt.Sprintf("received message of %d bytes exceeds maximum of %d bytes", size, c.maxSize)}
+			return nil, r.err
+		}
+		bodyLen := int(size) + c.trailerLen()
+		if cap(r.buf) < bodyLen {
+			r.buf = make([]byte, bodyLen)
+		}
+		r.body = r.buf[:bodyLen]
+	}
+	if err := r.readFull(r.body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	body := r.body
+	r.body = nil
+
+	payload := body[:len(body)-c.trailerLen()]
+	if c.sum {
+		want := binary.BigEndian.Uint32(body[len(payload):])
+		if got := crc32.Checksum(payload, msgChecksumTable); got != want {
+			// the framing is intact, so the next message can still be received
+			return nil, ProtocolError{fmt.Sprintf("message checksum mismatch: %08x != %08x", got, want)}
+		}
+	}
+	return payload, nil
+}
+
+// partialReader reads fixed-size parts of a stream, such as headers,
+// across calls that fail with a timeout.
+type partialReader struct {
+	r   io.Reader
+	n   int   // bytes of the current part read so far
+	err error // sticky
+}
+
+// readFull reads into p starting at n and resets n once p is full, i.e.,
+// p must be the same buffer until readFull succeeds.
+// EOF after a partial read is io.ErrUnexpectedEOF and sticky.
+func (r *partialReader) readFull(p []byte) error {
+	if r.err != nil {
+		return r.err
+	}
+	for r.n < len(p) {
+		n, err := r.r.Read(p[r.n:])
+		r.n += n
+		if err == io.EOF && r.n > 0 && r.n < len(p) {
+			r.err = io.ErrUnexpectedEOF
+			return r.err
+		}
+		if err != nil && r.n < len(p) {
+			return err
+		}
+	}
+	r.n = 0
+	return nil
+}
+
+// ReadFrom implements net.PacketConn by receiving the next message into p.
+// Like with UDP, the part of the message that does not fit into p is discarded.
+func (c *MsgConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	c.rmtx.Lock()
+	defer c.rmtx.Unlock()
+	payload, err := c.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(p, payload), c.conn.RemoteAddr(), nil
+}
+
+// WriteTo implements net.PacketConn by sending p as a message.
+// addr must be nil or the remote address of the underlying connection.
+func (c *MsgConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if remote := c.conn.RemoteAddr(); addr != nil && (addr.Network() != remote.Network() || addr.String() != remote.String()) {
+		return 0, fmt.Errorf("netssh: cannot send to %s, only to %s", addr, remote)
+	}
+	if err := c.SendMsg(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the underlying connection.
+func (c *MsgConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *MsgConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *MsgConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *MsgConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *MsgConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *MsgConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
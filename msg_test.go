@@ -0,0 +1,121 @@
+package netssh
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMsgPipe(config MsgConfig) (*MsgConn, *MsgConn) {
+	a, b := net.Pipe()
+	return NewMsgConn(a, config), NewMsgConn(b, config)
+}
+
+func TestMsgConn(t *testing.T) {
+	for _, sum := range []bool{false, true} {
+		a, b := newMsgPipe(MsgConfig{MaxSize: 100, Checksum: sum})
+		msgs := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("x"), 100)}
+		go func() {
+			for _, msg := range msgs {
+				a.SendMsg(msg)
+			}
+			a.Close()
+		}()
+		for _, want := range msgs {
+			got, err := b.RecvMsg()
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		}
+		_, err := b.RecvMsg()
+		assert.Equal(t, io.EOF, err)
+	}
+}
+
+func TestMsgConnMaxSize(t *testing.T) {
+	a, b := newMsgPipe(MsgConfig{MaxSize: 4})
+	err := a.SendMsg([]byte("hello"))
+	assert.Equal(t, MsgTooLargeError{5, 4}, err)
+
+	// the peer's limit is enforced on receipt
+	large := NewMsgConn(a.conn, MsgConfig{})
+	go large.SendMsg([]byte("hello"))
+	_, err = b.RecvMsg()
+	_, ok := err.(ProtocolError)
+	assert.True(t, ok, "%T %s", err, err)
+	_, err2 := b.RecvMsg()
+	assert.Equal(t, err, err2)
+}
+
+func TestMsgConnChecksumMismatch(t *testing.T) {
+	a, b := net.Pipe()
+	receiver := NewMsgConn(b, MsgConfig{Checksum: true})
+	go func() {
+		// "hi" with a wrong checksum, then "ok" with the right one
+		a.Write([]byte{0, 0, 0, 2, 'h', 'i', 0, 0, 0, 0})
+		NewMsgConn(a, MsgConfig{Checksum: true}).SendMsg([]byte("ok"))
+	}()
+	_, err := receiver.RecvMsg()
+	_, ok := err.(ProtocolError)
+	assert.True(t, ok, "%T %s", err, err)
+	msg, err := receiver.RecvMsg()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ok"), msg)
+}
+
+func TestMsgConnReadDeadlineResumes(t *testing.T) {
+	a, b := net.Pipe()
+	receiver := NewMsgConn(b, MsgConfig{})
+	// net.Pipe's Write returns once the bytes have been read
+	go a.Write([]byte{0, 0, 0, 5, 'h', 'e'})
+	require.NoError(t, receiver.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err := receiver.RecvMsg()
+	netErr, ok := err.(net.Error)
+	require.True(t, ok, "%T %s", err, err)
+	assert.True(t, netErr.Timeout())
+
+	go a.Write([]byte("llo"))
+	require.NoError(t, receiver.SetReadDeadline(time.Time{}))
+	msg, err := receiver.RecvMsg()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), msg)
+}
+
+func TestMsgConnUnexpectedEOF(t *testing.T) {
+	a, b := net.Pipe()
+	receiver := NewMsgConn(b, MsgConfig{})
+	go func() {
+		a.Write([]byte{0, 0, 0, 5, 'h', 'e'})
+		a.Close()
+	}()
+	_, err := receiver.RecvMsg()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestMsgConnPacketConn(t *testing.T) {
+	a, b := newMsgPipe(MsgConfig{})
+	go func() {
+		n, err := a.WriteTo([]byte("hello"), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, n)
+		_, err = a.WriteTo([]byte("world"), a.RemoteAddr())
+		assert.NoError(t, err)
+	}()
+
+	buf := make([]byte, 3)
+	n, addr, err := b.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, b.RemoteAddr(), addr)
+	assert.Equal(t, "hel", string(buf[:n]))
+	// the rest of the message was discarded
+	n, _, err = b.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "wor", string(buf[:n]))
+
+	_, err = a.WriteTo([]byte("x"), &net.UDPAddr{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,254 @@
+// Package netsshtest runs netssh.Dial, netssh.Proxy and netssh.Listener
+// end to end without sshd.
+//
+// A Server listens on a temporary socket and hands out Endpoints whose
+// SSHCommand is the test binary itself. When started that way, Main acts as a
+// fake ssh command that runs the forced command locally, i.e. calls
+// netssh.Proxy with its stdio relayed to the dialing process, just like a
+// real ssh connection to an authorized_keys entry invoking Proxy would.
+//
+// Test packages must call Main from their TestMain:
+//
+//	func TestMain(m *testing.M) {
+//		netsshtest.Main()
+//		os.Exit(m.Run())
+//	}
+package netsshtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/problame/go-netssh"
+	"github.com/problame/go-netssh/faultinject"
+)
+
+const (
+	envSocket   = "NETSSHTEST_SOCKET"
+	envBehavior = "NETSSHTEST_BEHAVIOR"
+)
+
+// Behavior controls the fake ssh command.
+type Behavior struct {
+	// AuthFailure makes the fake ssh command fail like ssh does if
+	// the server rejects all identities.
+	AuthFailure bool
+	// HostKeyFailure makes the fake ssh command fail like ssh does if
+	// the server's host key does not match known_hosts.
+	HostKeyFailure bool
+	// ConnectDelay delays running the forced command, simulating a slow connection setup.
+	ConnectDelay time.Duration
+	// ExitStatus, if not zero, replaces the exit status of the forced command,
+	// which is 0 if Proxy succeeded and 1 otherwise.
+	ExitStatus int
+	// ProxyMode is passed to the Proxier run by the fake ssh command.
+	ProxyMode netssh.ProxyMode
+	// WaitTimeout and ServerCommand are passed to the Proxier.
+	WaitTimeout   time.Duration
+	ServerCommand []string
+	// Handler is the name of a handler registered with Handle that
+	// is passed to the Proxier.
+	Handler string
+	// Faults, if not nil, are injected into the fake ssh connection, below
+	// the netssh handshake. The Read direction carries the data sent by
+	// the dialing side, the Write direction the data sent by the server,
+	// e.g., a corrupted banner is a Corrupt fault in direction Write.
+	Faults *faultinject.Config
+	// AuditFile, if not empty, is the path of a netssh.AuditFile
+	// that is passed to the Proxier as AuditLog.
+	AuditFile string
+}
+
+var handlers = map[string]func(context.Context, *netssh.ServeConn) error{}
+
+// Handle registers a handler for use as Behavior.Handler.
+// It must be called before Main.
+func Handle(name string, handler func(context.Context, *netssh.ServeConn) error) {
+	handlers[name] = handler
+}
+
+// Main runs the fake ssh command and exits if the process was started as
+// such. Otherwise, it returns immediately.
+func Main() {
+	socket := os.Getenv(envSocket)
+	if socket == "" {
+		return
+	}
+	var b Behavior
+	if err := json.Unmarshal([]byte(os.Getenv(envBehavior)), &b); err != nil {
+		fmt.Fprintf(os.Stderr, "netsshtest: invalid %s: %s\n", envBehavior, err)
+		os.Exit(255)
+	}
+	os.Exit(fakeSSH(socket, b))
+}
+
+func fakeSSH(socket string, b Behavior) int {
+	destination := "netsshtest"
+	if len(os.Args) > 1 {
+		destination = os.Args[len(os.Args)-1]
+	}
+
+	// messages as printed by OpenSSH
+	switch {
+	case b.HostKeyFailure:
+		fmt.Fprintf(os.Stderr, "Host key verification failed.\n")
+		return 255
+	case b.AuthFailure:
+		fmt.Fprintf(os.Stderr, "%s: Permission denied (publickey).\n", destination)
+		return 255
+	}
+
+	time.Sleep(b.ConnectDelay)
+
+	// Like a real ssh connection, the relay breaks if the process dies.
+	var faults faultinject.Config
+	if b.Faults != nil {
+		faults = *b.Faults
+	}
+	relayDone := relay(faults)
+
+	status := 0
+	proxier := netssh.Proxier{
+		Mode:          b.ProxyMode,
+		WaitTimeout:   b.WaitTimeout,
+		ServerCommand: b.ServerCommand,
+	}
+	if b.Handler != "" {
+		proxier.Handler = handlers[b.Handler]
+		if proxier.Handler == nil {
+			fmt.Fprintf(os.Stderr, "netsshtest: unknown handler %q\n", b.Handler)
+			return 255
+		}
+	}
+	if b.AuditFile != "" {
+		proxier.AuditLog = &netssh.AuditFile{Path: b.AuditFile}
+	}
+	if err := proxier.Proxy(context.Background(), socket); err != nil {
+		status = 1
+	}
+	relayDone()
+	if b.ExitStatus != 0 {
+		status = b.ExitStatus
+	}
+	return status
+}
+
+// relay replaces os.Stdin and os.Stdout with pipes that Proxy will
+// pass to the server, and relays between them and the original stdio
+// through a faultinject.Conn. The returned function must be called after
+// Proxy returned and waits until the server's output is relayed.
+func relay(config faultinject.Config) (done func()) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		panic(err)
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		panic(err)
+	}
+	conn := faultinject.Wrap(&stdio{os.Stdin, os.Stdout}, config)
+	os.Stdin, os.Stdout = stdinR, stdoutW
+
+	go func() {
+		io.Copy(stdinW, conn)
+		stdinW.Close()
+	}()
+	stdoutRelayed := make(chan struct{})
+	go func() {
+		// Leave closing stdout to process exit, the dialing side
+		// relies on EOF on stdout implying that ssh exited.
+		defer close(stdoutRelayed)
+		io.Copy(conn, stdoutR)
+	}()
+
+	return func() {
+		// the server closed its copies, close ours so that the relays see EOF
+		stdinR.Close()
+		stdoutW.Close()
+		<-stdoutRelayed
+	}
+}
+
+// stdio is the fake ssh's connection to the dialing side.
+type stdio struct {
+	in, out *os.File
+}
+
+func (s *stdio) Read(p []byte) (int, error)  { return s.in.Read(p) }
+func (s *stdio) Write(p []byte) (int, error) { return s.out.Write(p) }
+func (s *stdio) CloseWrite() error           { return s.out.Close() }
+func (s *stdio) Close() error {
+	s.in.Close()
+	return s.out.Close()
+}
+func (s *stdio) LocalAddr() net.Addr                { return stdioAddr{} }
+func (s *stdio) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (s *stdio) SetDeadline(t time.Time) error      { return nil }
+func (s *stdio) SetReadDeadline(t time.Time) error  { return nil }
+func (s *stdio) SetWriteDeadline(t time.Time) error { return nil }
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "netsshtest" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// Server is a netssh.Listener on a temporary socket.
+type Server struct {
+	*netssh.Listener
+	dir string
+}
+
+// NewServer creates a Listener on a socket in a new temporary directory.
+func NewServer() (*Server, error) {
+	dir, err := ioutil.TempDir("", "netsshtest")
+	if err != nil {
+		return nil, err
+	}
+	l, err := netssh.Listen(filepath.Join(dir, "server.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &Server{l, dir}, nil
+}
+
+// Socket returns the path of the server's socket.
+func (s *Server) Socket() string {
+	return filepath.Join(s.dir, "server.sock")
+}
+
+// Endpoint returns an Endpoint that connects to s using the fake ssh command.
+func (s *Server) Endpoint(b Behavior) netssh.Endpoint {
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+	behavior, err := json.Marshal(b)
+	if err != nil {
+		panic(err) // Behavior only contains marshalable types
+	}
+	return netssh.Endpoint{
+		Host:       "netsshtest",
+		User:       "test",
+		Port:       22,
+		SSHCommand: executable,
+		Env: []string{
+			envSocket + "=" + s.Socket(),
+			envBehavior + "=" + string(behavior),
+		},
+	}
+}
+
+// Close closes the Listener and removes the temporary directory.
+func (s *Server) Close() error {
+	err := s.Listener.Close()
+	os.RemoveAll(s.dir)
+	return err
+}
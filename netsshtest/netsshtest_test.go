@@ -0,0 +1,800 @@
+package netsshtest_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ftrvxmtrx/fd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/problame/go-netssh"
+	"github.com/problame/go-netssh/netsshtest"
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Args) == 3 && os.Args[1] == "echo-server" {
+		os.Exit(echoServer(os.Args[2]))
+	}
+	netsshtest.Handle("echo", echo)
+	netsshtest.Main()
+	os.Exit(m.Run())
+}
+
+func newServer(t *testing.T) *netsshtest.Server {
+	s, err := netsshtest.NewServer()
+	require.NoError(t, err)
+	return s
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, mode := range []netssh.ProxyMode{netssh.ProxyModeAuto, netssh.ProxyModeFD, netssh.ProxyModeRelay} {
+		t.Run(mode.String(), func(t *testing.T) {
+			testRoundTrip(t, mode)
+		})
+	}
+}
+
+func testRoundTrip(t *testing.T, mode netssh.ProxyMode) {
+	s := newServer(t)
+	defer s.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		conn, err := s.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		defer conn.Close()
+		if mode != netssh.ProxyModeAuto && conn.ProxyMode() != mode {
+			served <- fmt.Errorf("unexpected proxy mode %s", conn.ProxyMode())
+			return
+		}
+		// echo until EOF
+		_, err = io.Copy(conn, conn)
+		served <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := netssh.Dial(ctx, s.Endpoint(netsshtest.Behavior{ProxyMode: mode}))
+	require.NoError(t, err)
+
+	// larger than a relay frame and the pipe buffers
+	msg := bytes.Repeat([]byte("hello"), 100000)
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(msg)
+		if err == nil {
+			err = conn.CloseWrite()
+		}
+		writeErr <- err
+	}()
+	resp, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	require.NoError(t, <-writeErr)
+	assert.True(t, bytes.Equal(msg, resp))
+	assert.NoError(t, <-served)
+	assert.NoError(t, conn.Close())
+	ws := conn.Cmd().ProcessState.Sys().(syscall.WaitStatus)
+	assert.Equal(t, 0, ws.ExitStatus())
+}
+
+func TestSSHFailures(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	tcs := []struct {
+		behavior netsshtest.Behavior
+		stderr   string
+	}{
+		{netsshtest.Behavior{AuthFailure: true}, "test@netsshtest: Permission denied (publickey)."},
+		{netsshtest.Behavior{HostKeyFailure: true}, "Host key verification failed."},
+	}
+	for _, tc := range tcs {
+		_, err := netssh.Dial(context.Background(), s.Endpoint(tc.behavior))
+		sshErr, ok := err.(*netssh.SSHError)
+		require.True(t, ok, "%T %s", err, err)
+		assert.Equal(t, "ssh: '"+tc.stderr+"' (exit status 255)", sshErr.Error())
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	go func() {
+		conn, err := s.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := netssh.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{ExitStatus: 3}))
+	require.NoError(t, err)
+	// EOF implies that the server and the fake ssh command closed their ends of stdout
+	_, err = io.Copy(ioutil.Discard, conn)
+	require.NoError(t, err)
+	conn.Close()
+	ws := conn.Cmd().ProcessState.Sys().(syscall.WaitStatus)
+	assert.Equal(t, 3, ws.ExitStatus())
+}
+
+func TestConnectDelay(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := netssh.Dial(ctx, s.Endpoint(netsshtest.Behavior{ConnectDelay: 10 * time.Second}))
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func echo(ctx context.Context, conn *netssh.ServeConn) error {
+	_, err := io.Copy(conn, conn)
+	return err
+}
+
+// echoServer is the ServerCommand in TestServerCommand.
+// It serves a single connection. TestWaitForServer runs it in-process.
+func echoServer(socket string) int {
+	l, err := netssh.Listen(socket)
+	if err != nil {
+		return 1
+	}
+	defer l.Close()
+	timer := time.AfterFunc(10*time.Second, func() { os.Exit(1) })
+	defer timer.Stop()
+	conn, err := l.Accept()
+	if err != nil {
+		return 1
+	}
+	echo(context.Background(), conn)
+	conn.Close()
+	return 0
+}
+
+func testEcho(t *testing.T, endpoint netssh.Endpoint) {
+	testEchoContext(t, context.Background(), endpoint)
+}
+
+func testEchoContext(t *testing.T, ctx context.Context, endpoint netssh.Endpoint) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	conn, err := netssh.Dial(ctx, endpoint)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+	resp, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(resp))
+	assert.NoError(t, conn.Close())
+	ws := conn.Cmd().ProcessState.Sys().(syscall.WaitStatus)
+	assert.Equal(t, 0, ws.ExitStatus())
+}
+
+// legacyServer serves one echo connection on socket like a Listener
+// that predates the proxy mode negotiation, i.e., it expects the fds right
+// away and drops connections that start with anything else.
+func legacyServer(t *testing.T, socket string) (done <-chan struct{}) {
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		defer l.Close()
+		for {
+			control, err := l.Accept()
+			if err != nil {
+				return
+			}
+			files, err := fd.Get(control.(*net.UnixConn), 2, nil)
+			if err != nil || len(files) != 2 {
+				control.Close()
+				continue
+			}
+			stdin, stdout := files[0], files[1]
+			stdout.Write(append([]byte("SSHCON_HELO"), make([]byte, 31-len("SSHCON_HELO"))...))
+			begin := make([]byte, 31)
+			if _, err := io.ReadFull(stdin, begin); err == nil {
+				io.Copy(stdout, stdin)
+			}
+			stdin.Close()
+			stdout.Close()
+			control.Write([]byte{0})
+			control.Close()
+			return
+		}
+	}()
+	return served
+}
+
+func TestLegacyServer(t *testing.T) {
+	for _, mode := range []netssh.ProxyMode{netssh.ProxyModeAuto, netssh.ProxyModeFD} {
+		t.Run(mode.String(), func(t *testing.T) {
+			s := newStoppedServer(t)
+			defer s.Close()
+			done := legacyServer(t, s.Socket())
+			testEcho(t, s.Endpoint(netsshtest.Behavior{ProxyMode: mode}))
+			<-done
+		})
+	}
+	t.Run("trace carrier", func(t *testing.T) {
+		s := newStoppedServer(t)
+		defer s.Close()
+		done := legacyServer(t, s.Socket())
+		// not sent without NegotiateOptions, the server would echo it
+		ctx := netssh.ContextWithDialTrace(context.Background(), &netssh.DialTrace{
+			Carrier: map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		})
+		testEchoContext(t, ctx, s.Endpoint(netsshtest.Behavior{}))
+		<-done
+	})
+}
+
+func newStoppedServer(t *testing.T) *netsshtest.Server {
+	s := newServer(t)
+	// removes the socket
+	require.NoError(t, s.Listener.Close())
+	return s
+}
+
+func TestServerDown(t *testing.T) {
+	s := newStoppedServer(t)
+	defer s.Close()
+
+	_, err := netssh.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{}))
+	_, ok := err.(netssh.ProtocolError)
+	assert.True(t, ok, "%T %s", err, err)
+}
+
+func TestWaitForServer(t *testing.T) {
+	s := newStoppedServer(t)
+	defer s.Close()
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		echoServer(s.Socket())
+	}()
+	testEcho(t, s.Endpoint(netsshtest.Behavior{WaitTimeout: 5 * time.Second}))
+}
+
+func TestServerCommand(t *testing.T) {
+	s := newStoppedServer(t)
+	defer s.Close()
+
+	executable, err := os.Executable()
+	require.NoError(t, err)
+	testEcho(t, s.Endpoint(netsshtest.Behavior{
+		ServerCommand: []string{executable, "echo-server", s.Socket()},
+	}))
+}
+
+func TestHandler(t *testing.T) {
+	s := newStoppedServer(t)
+	defer s.Close()
+
+	testEcho(t, s.Endpoint(netsshtest.Behavior{Handler: "echo"}))
+}
+
+func TestBusy(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	s.SetAdmissionPolicy(netssh.AdmissionPolicy{MaxConnsPerPeer: 1})
+
+	release := make(chan struct{})
+	go func() {
+		conn, err := s.Accept()
+		if err == nil {
+			<-release
+			conn.Close()
+		}
+	}()
+
+	e := s.Endpoint(netsshtest.Behavior{})
+	first, err := netssh.Dial(context.Background(), e)
+	require.NoError(t, err)
+	defer first.Close()
+
+	_, err = netssh.Dial(context.Background(), e)
+	busy, ok := err.(netssh.BusyError)
+	require.True(t, ok, "%T %s", err, err)
+	assert.True(t, busy.Temporary())
+	close(release)
+}
+
+func TestSSHConnStats(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	go func() {
+		conn, err := s.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	pre := time.Now()
+	conn, err := netssh.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{}))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+	_, err = io.Copy(ioutil.Discard, conn)
+	require.NoError(t, err)
+
+	stats := conn.Stats()
+	assert.Equal(t, conn.Cmd().Process.Pid, stats.PID)
+	assert.False(t, stats.ProcessStarted.Before(pre))
+	assert.True(t, stats.HandshakeDuration > 0)
+	assert.Equal(t, int64(5), stats.BytesWritten)
+	assert.Equal(t, int64(5), stats.BytesRead)
+}
+
+func TestHooks(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	var events []string
+	var mtx sync.Mutex
+	event := func(format string, args ...interface{}) {
+		mtx.Lock()
+		events = append(events, fmt.Sprintf(format, args...))
+		mtx.Unlock()
+	}
+	s.SetHooks(netssh.CombineListenerHooks(
+		netssh.ListenerHooks{
+			OnFDsReceived: func(peer netssh.Peer, stdin, stdout *os.File) {
+				event("fds %s %s", stdin.Name(), stdout.Name())
+			},
+			OnHandshake: func(conn *netssh.ServeConn) { event("handshake") },
+		},
+		netssh.ListenerHooks{
+			OnClose: func(conn *netssh.ServeConn, reason netssh.CloseReason) { event("close %s", reason) },
+		},
+	))
+	go func() {
+		conn, err := s.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	exited := make(chan struct{})
+	type dialKey struct{}
+	d := netssh.Dialer{Hooks: netssh.CombineDialerHooks(
+		netssh.DialerHooks{
+			OnDial: func(ctx context.Context, e netssh.Endpoint) context.Context {
+				return context.WithValue(ctx, dialKey{}, "ctx")
+			},
+			OnStart: func(argv []string) { event("start %s", argv[0]) },
+			OnClose: func(conn *netssh.SSHConn, exit netssh.SSHExit) {
+				event("exit %d closed=%t signaled=%t", exit.Status, exit.Closed, exit.Signaled)
+				close(exited)
+			},
+		},
+		netssh.DialerHooks{
+			OnHandshakeDone: func(ctx context.Context, conn *netssh.SSHConn) {
+				event("dial handshake %s", ctx.Value(dialKey{}))
+			},
+			OnFailure: func(ctx context.Context, e netssh.Endpoint, err error) {
+				event("failure %T %s", err, ctx.Value(dialKey{}))
+			},
+		},
+	), CloseGracePeriod: 10 * time.Second}
+	endpoint := s.Endpoint(netsshtest.Behavior{ProxyMode: netssh.ProxyModeFD})
+	conn, err := d.Dial(context.Background(), endpoint)
+	require.NoError(t, err)
+	// Close makes the server close the connection, which lets ssh exit
+	// within the grace period
+	require.NoError(t, conn.Close())
+	<-exited
+
+	_, err = d.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{AuthFailure: true}))
+	require.Error(t, err)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	// the order of client and server events is not deterministic
+	assert.ElementsMatch(t, []string{
+		"start " + endpoint.SSHCommand,
+		"fds netssh-proxy-stdin netssh-proxy-stdout",
+		"handshake",
+		"dial handshake ctx",
+		"close normal",
+		"exit 0 closed=true signaled=false",
+		"start " + endpoint.SSHCommand,
+		"failure *netssh.SSHError ctx",
+	}, events)
+}
+
+func TestSSHExit(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	serverConns := make(chan *netssh.ServeConn, 1)
+	go func() {
+		for {
+			conn, err := s.Accept()
+			if err != nil {
+				return
+			}
+			serverConns <- conn
+		}
+	}()
+	exits := make(chan netssh.SSHExit, 1)
+	d := netssh.Dialer{Hooks: netssh.DialerHooks{
+		OnClose: func(conn *netssh.SSHConn, exit netssh.SSHExit) { exits <- exit },
+	}}
+	endpoint := s.Endpoint(netsshtest.Behavior{})
+
+	t.Run("on its own", func(t *testing.T) {
+		conn, err := d.Dial(context.Background(), endpoint)
+		require.NoError(t, err)
+		require.NoError(t, (<-serverConns).Close())
+		exit := <-exits
+		assert.Equal(t, netssh.SSHExit{}, exit)
+		require.NoError(t, conn.Close())
+		assert.Len(t, exits, 0, "reported once")
+	})
+
+	t.Run("signaled", func(t *testing.T) {
+		conn, err := d.Dial(context.Background(), endpoint)
+		require.NoError(t, err)
+		serverConn := <-serverConns // not closed until ssh was signaled
+		defer serverConn.Close()
+		require.NoError(t, conn.Close())
+		exit := <-exits
+		assert.Error(t, exit.Err)
+		assert.Equal(t, -1, exit.Status)
+		assert.True(t, exit.Closed)
+		assert.True(t, exit.Signaled)
+	})
+
+	t.Run("close in hook", func(t *testing.T) {
+		closed := make(chan error, 1)
+		d := netssh.Dialer{Hooks: netssh.DialerHooks{
+			OnClose: func(conn *netssh.SSHConn, exit netssh.SSHExit) { closed <- conn.Close() },
+		}}
+		_, err := d.Dial(context.Background(), endpoint)
+		require.NoError(t, err)
+		require.NoError(t, (<-serverConns).Close())
+		select {
+		case err := <-closed:
+			assert.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Close in OnClose did not return")
+		}
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	for _, mode := range []netssh.ProxyMode{netssh.ProxyModeFD, netssh.ProxyModeRelay} {
+		t.Run(mode.String(), func(t *testing.T) {
+			testAuditLog(t, mode)
+		})
+	}
+}
+
+func testAuditLog(t *testing.T, mode netssh.ProxyMode) {
+	s := newServer(t)
+	defer s.Close()
+	go func() {
+		conn, err := s.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	dir, err := ioutil.TempDir("", "netsshtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	audit := filepath.Join(dir, "audit.log")
+
+	conn, err := netssh.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{ProxyMode: mode, AuditFile: audit}))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+	_, err = io.Copy(ioutil.Discard, conn)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	content, err := ioutil.ReadFile(audit)
+	require.NoError(t, err)
+	var rec netssh.AuditRecord
+	require.NoError(t, json.Unmarshal(content, &rec))
+	assert.Equal(t, mode.String(), rec.Mode)
+	assert.Equal(t, s.Socket(), rec.Server)
+	assert.NotEmpty(t, rec.ConnID)
+	assert.NotEmpty(t, rec.User)
+	assert.Equal(t, 0, rec.ExitStatus)
+	assert.Empty(t, rec.Error)
+	assert.False(t, rec.End.Before(rec.Start))
+	require.NotNil(t, rec.BytesFromClient)
+	require.NotNil(t, rec.BytesToClient)
+	if mode == netssh.ProxyModeRelay {
+		// includes the handshake
+		assert.True(t, *rec.BytesFromClient > 5)
+		assert.True(t, *rec.BytesToClient > 5)
+	} else {
+		assert.Equal(t, int64(5), *rec.BytesFromClient)
+		assert.Equal(t, int64(5), *rec.BytesToClient)
+	}
+}
+
+func TestMsgConn(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	config := netssh.MsgConfig{MaxSize: 1 << 16, Checksum: true}
+	go func() {
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		mc := netssh.NewMsgConn(conn, config)
+		defer mc.Close()
+		for {
+			msg, err := mc.RecvMsg()
+			if err != nil {
+				return
+			}
+			if mc.SendMsg(msg) != nil {
+				return
+			}
+		}
+	}()
+
+	conn, err := netssh.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{ProxyMode: netssh.ProxyModeRelay}))
+	require.NoError(t, err)
+	mc := netssh.NewMsgConn(conn, config)
+	defer mc.Close()
+
+	require.NoError(t, mc.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = mc.RecvMsg()
+	netErr, ok := err.(net.Error)
+	require.True(t, ok, "%T %s", err, err)
+	assert.True(t, netErr.Timeout())
+	require.NoError(t, mc.SetReadDeadline(time.Time{}))
+
+	for _, msg := range [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("x"), 1<<16)} {
+		require.NoError(t, mc.SendMsg(msg))
+		resp, err := mc.RecvMsg()
+		require.NoError(t, err)
+		assert.Equal(t, msg, resp)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, mode := range []netssh.ProxyMode{netssh.ProxyModeFD, netssh.ProxyModeRelay} {
+		t.Run(mode.String(), func(t *testing.T) {
+			testCompression(t, mode)
+		})
+	}
+}
+
+func testCompression(t *testing.T, mode netssh.ProxyMode) {
+	s := newServer(t)
+	defer s.Close()
+	require.NoError(t, s.SetCompression(netssh.CompressionPolicy{Send: netssh.CompressionLZ4}))
+
+	type result struct {
+		send, recv string
+		stats      netssh.ConnStats
+		err        error
+	}
+	served := make(chan result, 1)
+	go func() {
+		conn, err := s.Accept()
+		if err != nil {
+			served <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		_, err = io.Copy(conn, conn)
+		send, recv := conn.Compression()
+		served <- result{send, recv, conn.Stats(), err}
+	}()
+
+	d := netssh.Dialer{Compression: &netssh.CompressionPolicy{Send: netssh.CompressionZstd, Level: 3}}
+	conn, err := d.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{ProxyMode: mode}))
+	require.NoError(t, err)
+	defer conn.Close()
+	send, recv := conn.Compression()
+	assert.Equal(t, netssh.CompressionZstd, send)
+	assert.Equal(t, netssh.CompressionLZ4, recv)
+
+	msg := bytes.Repeat([]byte("hello"), 100000)
+	go func() {
+		conn.Write(msg)
+		conn.CloseWrite()
+	}()
+	resp, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(msg, resp))
+
+	stats := conn.Stats()
+	read, written := stats.CompressionRatio()
+	assert.True(t, read > 10, "%v", read)
+	assert.True(t, written > 10, "%v", written)
+
+	r := <-served
+	require.NoError(t, r.err)
+	assert.Equal(t, netssh.CompressionLZ4, r.send)
+	assert.Equal(t, netssh.CompressionZstd, r.recv)
+	assert.Equal(t, stats.WireBytesWritten, r.stats.WireBytesRead)
+	assert.Equal(t, stats.WireBytesRead, r.stats.WireBytesWritten)
+	assert.Equal(t, int64(len(msg)), r.stats.BytesRead)
+}
+
+func TestCompressionDeclined(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	require.NoError(t, s.SetCompression(netssh.CompressionPolicy{Accept: []string{netssh.CompressionNone}}))
+	go func() {
+		conn, err := s.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	d := netssh.Dialer{Compression: &netssh.CompressionPolicy{Send: netssh.CompressionZstd}}
+	conn, err := d.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{}))
+	require.NoError(t, err)
+	defer conn.Close()
+	send, recv := conn.Compression()
+	assert.Equal(t, netssh.CompressionNone, send)
+	assert.Equal(t, netssh.CompressionNone, recv)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+	resp, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(resp))
+}
+
+func TestEncryption(t *testing.T) {
+	for _, mode := range []netssh.ProxyMode{netssh.ProxyModeFD, netssh.ProxyModeRelay} {
+		t.Run(mode.String(), func(t *testing.T) {
+			testEncryption(t, mode)
+		})
+	}
+}
+
+func testEncryption(t *testing.T, mode netssh.ProxyMode) {
+	serverPub, serverKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	clientPub, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	s := newServer(t)
+	defer s.Close()
+	require.NoError(t, s.SetEncryption(netssh.EncryptionPolicy{Key: serverKey, Required: true}))
+	require.NoError(t, s.SetCompression(netssh.CompressionPolicy{Send: netssh.CompressionLZ4}))
+
+	type result struct {
+		clientKey ed25519.PublicKey
+		err       error
+	}
+	served := make(chan result, 1)
+	go func() {
+		conn, err := s.Accept()
+		if err != nil {
+			served <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		_, err = io.Copy(conn, conn)
+		served <- result{conn.ClientKey(), err}
+	}()
+
+	d := netssh.Dialer{
+		ClientKey:   clientKey,
+		Compression: &netssh.CompressionPolicy{Send: netssh.CompressionZstd},
+	}
+	e := s.Endpoint(netsshtest.Behavior{ProxyMode: mode})
+	e.ServerKey = serverPub
+	conn, err := d.Dial(context.Background(), e)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.True(t, conn.Encrypted())
+	send, recv := conn.Compression()
+	assert.Equal(t, netssh.CompressionZstd, send)
+	assert.Equal(t, netssh.CompressionLZ4, recv)
+
+	msg := bytes.Repeat([]byte("hello"), 100000)
+	go func() {
+		conn.Write(msg)
+		conn.CloseWrite()
+	}()
+	resp, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(msg, resp))
+
+	r := <-served
+	require.NoError(t, r.err)
+	assert.Equal(t, clientPub, r.clientKey)
+}
+
+func TestEncryptionFailures(t *testing.T) {
+	serverPub, serverKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	s := newServer(t)
+	defer s.Close()
+	require.NoError(t, s.SetEncryption(netssh.EncryptionPolicy{Key: serverKey, Required: true}))
+	go func() {
+		for {
+			conn, err := s.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	e := s.Endpoint(netsshtest.Behavior{})
+	e.ServerKey = otherPub
+	_, err = netssh.Dial(context.Background(), e)
+	assert.Equal(t, netssh.ServerKeyMismatchError{Key: serverPub}, err)
+
+	// the server requires encryption, plain clients don't wait for a reply
+	e.ServerKey = nil
+	conn, err := netssh.Dial(context.Background(), e)
+	require.NoError(t, err)
+	resp, _ := ioutil.ReadAll(conn)
+	assert.Empty(t, resp)
+	conn.Close()
+	d := netssh.Dialer{Compression: &netssh.CompressionPolicy{}}
+	_, err = d.Dial(context.Background(), e)
+	_, ok := err.(netssh.ProtocolError)
+	assert.True(t, ok, "%T %s", err, err)
+
+	// Proxier.Handler does not support encryption
+	stopped := newStoppedServer(t)
+	defer stopped.Close()
+	e = stopped.Endpoint(netsshtest.Behavior{Handler: "echo"})
+	e.ServerKey = serverPub
+	_, err = netssh.Dial(context.Background(), e)
+	_, ok = err.(netssh.ProtocolError)
+	assert.True(t, ok, "%T %s", err, err)
+}
+
+func TestCompressionHandler(t *testing.T) {
+	s := newStoppedServer(t)
+	defer s.Close()
+
+	d := netssh.Dialer{Compression: &netssh.CompressionPolicy{Send: netssh.CompressionZstd}}
+	conn, err := d.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{Handler: "echo"}))
+	require.NoError(t, err)
+	defer conn.Close()
+	send, recv := conn.Compression()
+	assert.Equal(t, netssh.CompressionZstd, send)
+	assert.Equal(t, netssh.CompressionNone, recv)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+	resp, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(resp))
+}
@@ -0,0 +1,131 @@
+package netssh
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Peer describes the client of a connection as reported by Proxy.
+// The information is only as trustworthy as the authorized_keys entry
+// and the environment of the Proxy process.
+type Peer struct {
+	// KeyID and Service are set through Proxier, typically from the
+	// command line in the authorized_keys entry.
+	KeyID   string `json:"key_id,omitempty"`
+	Service string `json:"service,omitempty"`
+	// SSHConnection is the SSH_CONNECTION environment variable of Proxy:
+	// client address, client port, server address, server port.
+	SSHConnection string `json:"ssh_connection,omitempty"`
+}
+
+// ClientAddr returns the client's address and port from SSHConnection,
+// or empty strings if not available.
+func (p Peer) ClientAddr() (host, port string) {
+	fields := strings.Fields(p.SSHConnection)
+	if len(fields) != 4 {
+		return "", ""
+	}
+	return fields[0], fields[1]
+}
+
+// ID identifies the peer for AdmissionPolicy.MaxConnsPerPeer:
+// KeyID if set, otherwise the client's address.
+func (p Peer) ID() string {
+	if p.KeyID != "" {
+		return "key:" + p.KeyID
+	}
+	if host, _ := p.ClientAddr(); host != "" {
+		return "addr:" + host
+	}
+	return ""
+}
+
+// peerInfo is what Proxy sends to the server.
+type peerInfo struct {
+	Peer
+	// ConnID is generated by Proxy, see ServeConn.ID.
+	// It is empty if sent by older versions.
+	ConnID string `json:"conn_id,omitempty"`
+	// ProxyStarted is when Proxy was called, see PhaseProxy.
+	// It is zero if sent by older versions.
+	ProxyStarted time.Time `json:"proxy_started"`
+}
+
+// maxJSONMessageLen limits the allocation in readJSONMessage.
+const maxJSONMessageLen = 1 << 16
+
+func writePeerInfo(w io.Writer, info peerInfo) error {
+	return writeJSONMessage(w, info)
+}
+
+func readPeerInfo(r io.Reader) (info peerInfo, err error) {
+	err = readJSONMessage(r, &info, "peer info")
+	return info, err
+}
+
+// writeJSONMessage sends v as [length uint32, big endian][JSON].
+func writeJSONMessage(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err = w.Write(buf)
+	return err
+}
+
+// readJSONMessage reads a message sent by writeJSONMessage into v.
+// what describes the message in errors.
+func readJSONMessage(r io.Reader, v interface{}, what string) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxJSONMessageLen {
+		return ProtocolError{fmt.Sprintf("%s too large: %d bytes", what, n)}
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return ProtocolError{fmt.Sprintf("invalid %s: %s", what, err)}
+	}
+	return nil
+}
+
+func (p *Proxier) peer() Peer {
+	return Peer{
+		KeyID:         p.KeyID,
+		Service:       p.Service,
+		SSHConnection: os.Getenv("SSH_CONNECTION"),
+	}
+}
+
+// Peer returns the client of f as reported by Proxy.
+func (f *ServeConn) Peer() Peer {
+	return f.peer
+}
+
+type peerAddr struct {
+	Peer
+}
+
+func (peerAddr) Network() string { return go_network }
+
+func (a peerAddr) String() string {
+	host, port := a.ClientAddr()
+	if host == "" {
+		return "???"
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,23 @@
+package netssh
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerPID returns the pid of the process that connected conn, or 0.
+func peerPID(conn *net.UnixConn) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var pid int
+	raw.Control(func(fd uintptr) {
+		cred, err := unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+		if err == nil {
+			pid = int(cred.Pid)
+		}
+	})
+	return pid
+}
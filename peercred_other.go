@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package netssh
+
+import "net"
+
+func peerPID(conn *net.UnixConn) int {
+	return 0
+}
@@ -0,0 +1,200 @@
+package netssh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// In ProxyModeRelay, the proxy writes stdin to the control connection
+// verbatim and half-closes it on EOF.
+// The server's writes to the proxy are framed so that the proxy can tell
+// the end of the stream and the server's feedback apart:
+//
+//	[type byte][payload length uint32, big endian][payload]
+const (
+	relayFrameData = 1 + iota
+	relayFrameEOF
+	relayFrameExit // payload is the single feedback byte
+)
+
+const relayFrameHeaderLen = 5
+
+// maxRelayFramePayload limits the allocation in the proxy.
+const maxRelayFramePayload = 1 << 16
+
+type relayTransport struct {
+	control *net.UnixConn
+	mtx     sync.Mutex
+	eof     bool
+	err     error // sticky after a partially written frame
+}
+
+func newRelayTransport(control *net.UnixConn) *relayTransport {
+	return &relayTransport{control: control}
+}
+
+func (t *relayTransport) Read(p []byte) (int, error) {
+	return t.control.Read(p)
+}
+
+func (t *relayTransport) Write(p []byte) (n int, err error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.eof {
+		return 0, os.ErrClosed
+	}
+	if t.err != nil {
+		return 0, t.err
+	}
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxRelayFramePayload {
+			chunk = chunk[:maxRelayFramePayload]
+		}
+		if err := t.writeFrame(relayFrameData, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// writeFrame must be called with t.mtx held.
+// It does not return partial writes. If part of the frame was written,
+// the frame stream is corrupt and the error is returned for all further frames.
+func (t *relayTransport) writeFrame(typ byte, payload []byte) error {
+	if t.err != nil {
+		return t.err
+	}
+	var hdr [relayFrameHeaderLen]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+	bufs := net.Buffers{hdr[:], payload}
+	n, err := bufs.WriteTo(t.control)
+	if err != nil && n > 0 {
+		t.err = err
+	}
+	return err
+}
+
+func (t *relayTransport) CloseWrite() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.eof {
+		return nil
+	}
+	t.eof = true
+	return t.writeFrame(relayFrameEOF, nil)
+}
+
+func (t *relayTransport) SetReadDeadline(d time.Time) error {
+	return t.control.SetReadDeadline(d)
+}
+
+func (t *relayTransport) SetWriteDeadline(d time.Time) error {
+	return t.control.SetWriteDeadline(d)
+}
+
+func (t *relayTransport) spliceReader() io.Reader { return nil }
+func (t *relayTransport) spliceWriter() io.Writer { return nil }
+
+func (t *relayTransport) closeWithFeedback(feedback byte, _ ConnStats) error {
+	t.mtx.Lock()
+	t.eof = true
+	t.writeFrame(relayFrameExit, []byte{feedback})
+	t.mtx.Unlock()
+	return t.control.Close()
+}
+
+// proxyRelay is the proxy side of relayTransport.
+// proxyRelay returns the server's feedback and the bytes relayed.
+func proxyRelay(log *slog.Logger, conn *net.UnixConn) (feedback byte, stats *sessionStats, err error) {
+
+	log = log.With(LogKeyPhase, phaseRelay)
+	// os.Stdin and os.Stdout are not pollable, see comment at top of serve.go,
+	// so reads and writes fail with EAGAIN if checkFDPassing or proxyFDs
+	// put them in non-blocking mode before falling back to relaying
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		if err := unix.SetNonblock(int(f.Fd()), false); err != nil {
+			log.Error("cannot set blocking mode", "file", f.Name(), "err", err)
+			return 0, nil, err
+		}
+	}
+	log.Debug("relaying stdin and stdout")
+	var fromClient int64
+	go func() {
+		_, err := io.Copy(conn, &countingReader{os.Stdin, &fromClient})
+		if err != nil {
+			log.Error("cannot relay stdin", "err", err)
+		}
+		conn.CloseWrite()
+	}()
+
+	var toClient int64
+	stats = &sessionStats{}
+	done := func() *sessionStats {
+		stats.BytesRead = atomic.LoadInt64(&fromClient)
+		stats.BytesWritten = toClient
+		return stats
+	}
+	var hdr [relayFrameHeaderLen]byte
+	buf := make([]byte, 0, 32*1024)
+	for {
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			log.Error("cannot read frame header", "err", err)
+			return 0, done(), err
+		}
+		n := binary.BigEndian.Uint32(hdr[1:])
+		if n > maxRelayFramePayload {
+			return 0, done(), ProtocolError{fmt.Sprintf("relay frame too large: %d bytes", n)}
+		}
+		if cap(buf) < int(n) {
+			buf = make([]byte, n)
+		}
+		payload := buf[:n]
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			log.Error("cannot read frame payload", "err", err)
+			return 0, done(), err
+		}
+		switch hdr[0] {
+		case relayFrameData:
+			written, err := os.Stdout.Write(payload)
+			toClient += int64(written)
+			if err != nil {
+				log.Error("cannot relay stdout", "err", err)
+				return 0, done(), err
+			}
+		case relayFrameEOF:
+			os.Stdout.Close()
+		case relayFrameExit:
+			if n != 1 {
+				return 0, done(), ProtocolError{fmt.Sprintf("invalid exit frame length %d", n)}
+			}
+			return payload[0], done(), nil
+		default:
+			return 0, done(), ProtocolError{fmt.Sprintf("unknown relay frame type %d", hdr[0])}
+		}
+	}
+}
+
+// countingReader atomically adds the bytes read from r to n.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,94 @@
+package netssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ftrvxmtrx/fd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestRelayTransportPartialFrame(t *testing.T) {
+	a, b := socketPair(t)
+	defer a.Close()
+	defer b.Close()
+	tr := newRelayTransport(a.(*net.UnixConn))
+
+	// nobody reads b, so the frame doesn't fit into the socket buffers
+	require.NoError(t, tr.SetWriteDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err := tr.Write(bytes.Repeat([]byte{'x'}, 16<<20))
+	require.Error(t, err)
+
+	require.NoError(t, tr.SetWriteDeadline(time.Time{}))
+	_, err2 := tr.Write([]byte("hello"))
+	assert.Equal(t, err, err2, "the frame stream is corrupt")
+}
+
+// stdioPipe returns a pipe in blocking mode whose end for Proxy is
+// an *os.File that is not pollable, like os.Stdin and os.Stdout.
+func stdioPipe(t *testing.T, proxyReads bool) (proxyEnd *os.File, other *os.File) {
+	var fds [2]int
+	require.NoError(t, unix.Pipe2(fds[:], unix.O_CLOEXEC))
+	if proxyReads {
+		return os.NewFile(uintptr(fds[0]), "stdin"), os.NewFile(uintptr(fds[1]), "client")
+	}
+	return os.NewFile(uintptr(fds[1]), "stdout"), os.NewFile(uintptr(fds[0]), "client")
+}
+
+func TestProxyRelayFallbackAfterFailedFDPassing(t *testing.T) {
+	l, cleanup := listenTemp(t)
+	defer cleanup()
+
+	// checkFDPassing succeeds, but the server's fd.Get of stdin and stdout
+	// never happens, so Proxy falls back to relaying
+	putFDs = func(*net.UnixConn, ...*os.File) error { return errors.New("blocked by seccomp") }
+	defer func() { putFDs = fd.Put }()
+	stdin, clientIn := stdioPipe(t, true)
+	defer clientIn.Close()
+	stdout, clientOut := stdioPipe(t, false)
+	defer clientOut.Close()
+	origStdin, origStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdin, stdout
+	defer func() { os.Stdin, os.Stdout = origStdin, origStdout }()
+
+	proxied := make(chan error, 1)
+	go func() {
+		p := Proxier{Mode: ProxyModeAuto}
+		proxied <- p.Proxy(context.Background(), l.Addr().String())
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if l.isClosed() {
+					return
+				}
+				continue // the connection that failed to pass fds
+			}
+			io.Copy(conn, conn)
+			conn.Close()
+			return
+		}
+	}()
+
+	banner := make([]byte, len(banner_msg))
+	_, err := io.ReadFull(clientOut, banner)
+	require.NoError(t, err)
+	require.Equal(t, banner_msg, banner)
+	_, err = clientIn.Write(append(append([]byte{}, begin_msg...), "hello"...))
+	require.NoError(t, err)
+	require.NoError(t, clientIn.Close())
+	resp := make([]byte, len("hello"))
+	_, err = io.ReadFull(clientOut, resp)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(resp))
+	assert.NoError(t, <-proxied)
+}
@@ -1,120 +1,433 @@
-// Minimum Go Version
+// Deadlines on stdin and stdout
 //
-// We require Go 1.11 in order to support deadlines:
 // This package uses two *os.File (stdin, stdout) to implement a net.Conn interface.
-// As such, we need to support deadlines, and Go 1.10 introduced
-// deadlines for certain types of *os.File (https://golang.org/doc/go1.10#os).
-// However, apart from OS/FS constraints, deadlines on *os.File only work if
-// the underlying FD can be added to Go's event pool mechanism, which generally
-// requires the FD to be non-blocking at the time the *os.File is created.
+// As such, we need to support deadlines. Apart from OS/FS constraints,
+// deadlines on *os.File only work if the underlying FD can be added to Go's
+// event pool mechanism, which requires the FD to be non-blocking at the time
+// the *os.File is created (https://golang.org/doc/go1.11#os).
 // This is the case for os.Open and so on, but not for os.Std{in,out,err},
 // which are created using os.NewFile from the existing FDs 0, 1 and 2.
 // Those are blocking by default, and Go does not change them to non-blocking
 // because the parent process might be a terminal and not expect the tty to
 // change to non-blocking mode after the Go process exits.
-//
-// Hence, in Go 1.10, deadline operations on os.Std{in,out,err} fail with
-// os.ErrDeadline.
-// Go 1.11 improves the behavior of os.NewFile such that iff the FD passed to
-// os.NewFile is already non-blocking, the *os.File / FD is part of the event
-// loop, which makes deadlines work iff the OS supports it at all (this is the
-// case for stdin, stdout, stderr, which are pipes in our specific use case).
+// Deadline operations on such files fail with os.ErrNoDeadline.
 // See https://github.com/golang/go/issues/24842#issuecomment-381268558
 //
 // How do we deal with this issue in package netssh?
-// We require Go 1.11 via build tag to get the os.NewFile behavior described
-// above and set os.Std{in,out} to non-blocking before sending it over the unix
-// control socket.
+// We set os.Std{in,out} to non-blocking before sending them over the unix
+// control socket, which makes deadlines work on the receiving side because
+// they are pipes in our specific use case.
 // See usage of github.com/ftrvxmtrx/fd in functions Proxy and Listener.Accept.
 package netssh
 
-// better build errors than a build tag...
-import _ "github.com/theckman/goconstraint/go1.11/gte"
-
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/ftrvxmtrx/fd"
 	"golang.org/x/sys/unix"
 )
 
+// ProxyMode determines how Proxy hands the ssh connection to the server.
+//
+// Proxy and Listener negotiate the mode. Versions of this package that
+// predate the negotiation only support ProxyModeFD, and they interoperate
+// with current versions in both directions: Listener accepts fds passed
+// without negotiation, and Proxy passes them that way if the Listener drops
+// the connection in response to the negotiation.
+type ProxyMode int
+
+const (
+	// ProxyModeAuto uses ProxyModeFD if stdin and stdout are pipes that
+	// can be set to non-blocking mode and falls back to ProxyModeRelay
+	// otherwise, or if passing the fds fails.
+	ProxyModeAuto ProxyMode = iota
+	// ProxyModeFD passes stdin and stdout to the server using SCM_RIGHTS,
+	// the server then reads and writes them directly.
+	ProxyModeFD
+	// ProxyModeRelay makes Proxy copy between stdin / stdout and the server
+	// socket. Use it where fd passing or non-blocking stdio is not possible,
+	// e.g. under seccomp policies or if stdio are ttys.
+	ProxyModeRelay
+)
+
+func (m ProxyMode) String() string {
+	switch m {
+	case ProxyModeAuto:
+		return "auto"
+	case ProxyModeFD:
+		return "fd"
+	case ProxyModeRelay:
+		return "relay"
+	default:
+		return fmt.Sprintf("ProxyMode(%d)", int(m))
+	}
+}
+
+var proxy_mode_fd_msg = mustMessage("SSHCON_PROXY_FD")
+var proxy_mode_relay_msg = mustMessage("SSHCON_PROXY_RELAY")
+var proxy_mode_ok_msg = mustMessage("SSHCON_PROXY_OK")
+var proxy_mode_unsupported_msg = mustMessage("SSHCON_PROXY_UNSUPPORTED")
+var proxy_busy_msg = mustMessage("SSHCON_PROXY_BUSY")
+
+// Proxier contains options for Proxy.
+// The zero value is valid and equivalent to calling Proxy.
+type Proxier struct {
+	Mode ProxyMode
+
+	// The following fields control what Proxy does if the server is not
+	// running, i.e., if the server socket does not exist or refuses
+	// connections. By default, Proxy fails immediately.
+
+	// WaitTimeout, if > 0, makes Proxy wait up to WaitTimeout
+	// for the server to accept connections.
+	WaitTimeout time.Duration
+	// ServerCommand, if not empty, is started to launch the server, after which
+	// Proxy waits up to WaitTimeout (or DefaultActivationTimeout if zero).
+	// The command must daemonize or at least not exit while serving.
+	ServerCommand []string
+	// Handler, if not nil, serves the connection in the Proxy process
+	// instead of the server, inetd-style. Handler takes precedence over
+	// WaitTimeout and ServerCommand.
+	// Proxy closes conn after Handler returns and returns Handler's error.
+	Handler func(ctx context.Context, conn *ServeConn) error
+
+	// KeyID and Service are passed to the server, see Peer.
+	KeyID   string
+	Service string
+
+	// AuditLog, if not nil, receives an AuditRecord as a JSON line when
+	// Proxy returns, written with a single Write. See AuditFile and
+	// NewSyslogAuditWriter, and io.MultiWriter for several destinations.
+	AuditLog io.Writer
+}
+
 // The process calling Proxy must exit with non-zero exit status if it returns err != nil
 // and a zero exit status if err == nil.
 func Proxy(ctx context.Context, server string) (err error) {
+	var p Proxier
+	return p.Proxy(ctx, server)
+}
+
+var errFDPassingFailed = errors.New("passing stdin and stdout fds failed")
 
-	log := contextLog(ctx)
+// putFDs is fd.Put, replaced by tests.
+var putFDs = fd.Put
 
-	trySendProxyError := func() {
-		log.Printf("writing proxy error to stdout")
+// Proxy is like the package-level Proxy function, but uses the options in p.
+func (p *Proxier) Proxy(ctx context.Context, server string) (err error) {
+
+	started := time.Now()
+	peer := peerInfo{Peer: p.peer(), ConnID: newConnID(), ProxyStarted: started}
+	log := contextLog(ctx).With(
+		slog.String(LogKeyConn, peer.ConnID),
+		slog.String(LogKeyPeer, peer.ID()),
+		slog.String(LogKeyEndpoint, server),
+	)
+	audit := newAuditRecord(started, server, peer)
+	if p.AuditLog != nil {
+		defer func() {
+			if err := writeAuditRecord(p.AuditLog, audit, err); err != nil {
+				log.Error("cannot write audit record", "err", err)
+			}
+		}()
+	}
+
+	trySendProxyError := func(err error) {
+		msg := proxy_error_msg
+		if err == errServerBusy {
+			msg = busy_msg
+		}
+		log.Debug("writing proxy error to stdout", "msg", bytes.TrimRight(msg, "\x00"))
 		var buf bytes.Buffer
-		buf.Write(proxy_error_msg)
-		_, err := io.Copy(os.Stdout, &buf)
+		buf.Write(msg)
+		_, err = io.Copy(os.Stdout, &buf)
 		if err != nil {
-			log.Printf("error writing proxy error: %s", err)
+			log.Error("cannot write proxy error", "err", err)
 		}
 		os.Stdout.Sync()
 	}
 
-	log.Printf("connecting to server")
-	conn, err := net.Dial("unix", server)
+	mode := p.Mode
+	if mode == ProxyModeAuto {
+		mode = ProxyModeFD
+		if err := checkFDPassing(); err != nil {
+			log.Info("falling back to relay mode", "err", err)
+			mode = ProxyModeRelay
+		}
+	}
+
+	conn, err := connectServer(log, server, mode, peer)
+	if err != nil && isServerDown(err) {
+		log.Info("server is down", "err", err)
+		if p.Handler != nil {
+			return p.serveInline(ctx, log, peer, audit)
+		}
+		connectErr := err
+		conn, err = p.activate(ctx, log, server, mode, peer)
+		if err != nil && err != errLegacyServer && err != errServerBusy {
+			err = fmt.Errorf("server is down (%w) and activation failed: %w", connectErr, err)
+		}
+	}
+	if err == errLegacyServer {
+		log.Info("server predates proxy mode negotiation, passing fds right away")
+		var c net.Conn
+		if c, err = net.Dial("unix", server); err == nil {
+			conn = c.(*net.UnixConn)
+		}
+	}
 	if err != nil {
-		log.Printf("error: %s", err)
-		trySendProxyError()
+		log.Error("cannot connect to server", "err", err)
+		trySendProxyError(err)
 		return err
 	}
 	defer conn.Close()
 
+	audit.Mode = mode.String()
+	var feedback byte
+	var stats *sessionStats
+	switch mode {
+	case ProxyModeFD:
+		feedback, stats, err = proxyFDs(log, conn)
+		if err == errFDPassingFailed && p.Mode == ProxyModeAuto {
+			log.Info("falling back to relay mode")
+			conn.Close()
+			conn, err = connectServer(log, server, ProxyModeRelay, peer)
+			if err != nil {
+				log.Error("cannot connect to server", "err", err)
+				trySendProxyError(err)
+				return err
+			}
+			defer conn.Close()
+			audit.Mode = ProxyModeRelay.String()
+			feedback, stats, err = proxyRelay(log, conn)
+		} else if err == errFDPassingFailed {
+			trySendProxyError(err)
+		}
+	case ProxyModeRelay:
+		feedback, stats, err = proxyRelay(log, conn)
+	default:
+		err = fmt.Errorf("invalid proxy mode %s", mode)
+	}
+	audit.setStats(stats)
+	if err != nil {
+		return err
+	}
+
+	if feedback == proxyFeedbackShutdown {
+		log.Info("server shut down", LogKeyPhase, phaseClose)
+		return errors.New("server shut down")
+	}
+	if feedback != 0 {
+		log.Warn("server indicates abnormal termination", LogKeyPhase, phaseClose)
+		return errors.New("server indicates abnormal termination")
+	}
+	log.Debug("server indicates normal termination", LogKeyPhase, phaseClose)
+	return nil
+}
+
+// checkFDPassing returns an error if stdin or stdout are unsuitable for
+// ProxyModeFD. As a side effect, it puts them in non-blocking mode.
+func checkFDPassing() error {
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		var st unix.Stat_t
+		if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+			return err
+		}
+		if t := st.Mode & unix.S_IFMT; t != unix.S_IFIFO && t != unix.S_IFSOCK {
+			return fmt.Errorf("%s is not a pipe or socket", f.Name())
+		}
+		// See comment at top of file
+		if err := unix.SetNonblock(int(f.Fd()), true); err != nil {
+			return fmt.Errorf("cannot set %s to nonblocking mode: %s", f.Name(), err)
+		}
+	}
+	return nil
+}
+
+// errLegacyServer is returned by connectServer if the server closed the
+// connection instead of answering the proxy mode message, which servers
+// that predate the proxy mode negotiation do. Such servers expect
+// the fds right away, see readProxyModeMessage.
+var errLegacyServer = errors.New("server does not support proxy mode negotiation")
+
+// connectServer connects to the server, negotiates the proxy mode and
+// sends the peer info. It returns errServerBusy if the server rejects the
+// connection and errLegacyServer if the server is too old to negotiate.
+func connectServer(log *slog.Logger, server string, mode ProxyMode, peer peerInfo) (*net.UnixConn, error) {
+	log = log.With(LogKeyPhase, PhaseProxy)
+	log.Debug("connecting to server")
+	conn, err := net.Dial("unix", server)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*net.UnixConn, error) {
+		defer conn.Close()
+		closed := errors.Is(err, unix.EPIPE) || errors.Is(err, unix.ECONNRESET)
+		if closed {
+			// a busy server may reply and close the connection before reading from it
+			reply := make([]byte, len(proxy_busy_msg))
+			if _, rerr := io.ReadFull(conn, reply); rerr == nil && bytes.Equal(reply, proxy_busy_msg) {
+				return nil, errServerBusy
+			}
+		}
+		if err == io.EOF || closed {
+			if mode == ProxyModeRelay {
+				return nil, fmt.Errorf("server does not support %s mode", mode)
+			}
+			return nil, errLegacyServer
+		}
+		return nil, err
+	}
+
+	msg := proxy_mode_fd_msg
+	if mode == ProxyModeRelay {
+		msg = proxy_mode_relay_msg
+	}
+	log.Debug("requesting proxy mode", "mode", mode)
+	var buf bytes.Buffer
+	buf.Write(msg)
+	if _, err := io.Copy(conn, &buf); err != nil {
+		return fail(err)
+	}
+	if err := writePeerInfo(conn, peer); err != nil {
+		return fail(err)
+	}
+	buf.Reset()
+	if _, err := io.CopyN(&buf, conn, int64(len(proxy_mode_ok_msg))); err != nil {
+		return fail(err)
+	}
+	if bytes.Equal(buf.Bytes(), proxy_busy_msg) {
+		conn.Close()
+		return nil, errServerBusy
+	}
+	if !bytes.Equal(buf.Bytes(), proxy_mode_ok_msg) {
+		conn.Close()
+		return nil, fmt.Errorf("server does not support %s mode", mode)
+	}
+	return conn.(*net.UnixConn), nil
+}
+
+// proxyFDs returns the server's feedback and the stats sent by the server, if any.
+func proxyFDs(log *slog.Logger, conn *net.UnixConn) (feedback byte, stats *sessionStats, err error) {
+	log = log.With(LogKeyPhase, PhaseFDPassing)
+
 	// See comment at top of file
 	if err := unix.SetNonblock(int(os.Stdin.Fd()), true); err != nil {
-		log.Printf("error setting stdin to nonblocking mode: %s", err)
-		return err
+		log.Error("cannot set stdin to nonblocking mode", "err", err)
+		return 0, nil, err
 	}
 	if err := unix.SetNonblock(int(os.Stdout.Fd()), true); err != nil {
-		log.Printf("error setting stdout to nonblocking mode: %s", err)
-		return err
+		log.Error("cannot set stdout to nonblocking mode", "err", err)
+		return 0, nil, err
 	}
 
-	log.Printf("passing stdin and stdout fds to server")
-	err = fd.Put(conn.(*net.UnixConn), os.Stdin, os.Stdout)
+	log.Debug("passing stdin and stdout fds to server")
+	err = putFDs(conn, os.Stdin, os.Stdout)
 	if err != nil {
-		log.Printf("error: %s", err)
-		trySendProxyError()
-		return err
+		log.Error("cannot pass fds", "err", err)
+		return 0, nil, errFDPassingFailed
 	}
 
-	log.Printf("wait for end of connection")
-	var dummy [1]byte
-	n, err := conn.Read(dummy[:])
-	if err != io.EOF {
-		log.Printf("error waiting for exit code: %s", err)
-		return err
+	log = log.With(LogKeyPhase, phaseServe)
+	log.Debug("waiting for end of connection")
+	var buf [1]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		log.Error("cannot read feedback", "err", err)
+		return 0, nil, err
 	}
-	if n != len(dummy) || dummy[0] != 0 {
-		log.Printf("server indicates abnormal termination")
-		return errors.New("server indicates abnormal termination")
+	stats = &sessionStats{}
+	if err := readJSONMessage(conn, stats, "session stats"); err != nil {
+		// older servers close the connection after the feedback
+		if err != io.EOF {
+			log.Warn("cannot read session stats", "err", err)
+		}
+		stats = nil
 	}
-
-	log.Printf("server indicates normal termination")
-	return nil
+	return buf[0], stats, nil
 }
 
 type ServeConn struct {
-	stdin, stdout *os.File
-	control       *net.UnixConn
-	dlt 			*time.Timer
+	t             serveTransport
+	mode          ProxyMode
 	proxyFeedback byte
+
+	// l is nil for connections served by Proxier.Handler
+	l        *Listener
+	accepted time.Time
+	peer     Peer
+	// release, if not nil, frees the connection's AdmissionPolicy slot
+	release func()
+
+	shaper      shaper
+	stats       *connStats   // nil during the handshake
+	compression *compression // nil if not compressed
+	tls         *tls.Conn    // nil if not encrypted
+	clientKey   ed25519.PublicKey
+
+	// id and log are set once the peer info is received
+	id  string
+	log *slog.Logger
+
+	phases  phases
+	carrier map[string]string
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// serveTransport is the server side of the connection to Proxy.
+type serveTransport interface {
+	io.ReadWriter
+	CloseWrite() error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	// closeWithFeedback closes the transport and makes Proxy
+	// exit with non-zero status if feedback != 0.
+	// stats are reported to Proxy for its AuditRecord if necessary.
+	closeWithFeedback(feedback byte, stats ConnStats) error
+	// spliceReader and spliceWriter return the fds for spliceCopy, or nil.
+	spliceReader() io.Reader
+	spliceWriter() io.Writer
+}
+
+// ID returns the connection ID generated by Proxy, see LogKeyConn.
+// A random ID is used if Proxy is an older version.
+func (f *ServeConn) ID() string {
+	return f.id
+}
+
+func (f *ServeConn) logger() *slog.Logger {
+	if f.log == nil {
+		return discardLogger
+	}
+	return f.log
+}
+
+// ProxyMode returns the mode that Proxy uses for this connection,
+// either ProxyModeFD or ProxyModeRelay.
+// Connections served by Proxier.Handler use ProxyModeFD.
+func (f *ServeConn) ProxyMode() ProxyMode {
+	return f.mode
 }
 
 // Read implements io.Reader.
 // It returns *IOError for any non-nil error that is != io.EOF.
 func (f *ServeConn) Read(p []byte) (n int, err error) {
-	n, err = f.stdin.Read(p)
+	began := time.Now()
+	n, err = f.compression.reader(f.reader()).Read(f.shaper.limitRead(p))
+	f.shaper.afterRead(n)
+	f.stats.read(int64(n), began)
 	if err != nil && err != io.EOF {
 		err = &IOError{err}
 	}
@@ -124,32 +437,110 @@ func (f *ServeConn) Read(p []byte) (n int, err error) {
 // Write implements io.Writer.
 // It returns *IOError for any error != nil.
 func (f *ServeConn) Write(p []byte) (n int, err error) {
-	n, err = f.stdout.Write(p)
+	began := time.Now()
+	n, err = f.shaper.writeShaped(p, f.compression.writer(f.writer()).Write)
+	f.stats.write(int64(n), began)
 	if err != nil {
 		err = &IOError{err}
 	}
 	return n, err
 }
 
+// ReadFrom implements io.ReaderFrom, see SSHConn.ReadFrom.
+// Data is only spliced in ProxyModeFD without compression and encryption.
+func (f *ServeConn) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var handled bool
+	var err error
+	began := time.Now()
+	if w := f.t.spliceWriter(); w != nil && !f.shaper.limited() && f.compression == nil && f.tls == nil {
+		n, handled, err = spliceCopy(w, r)
+	}
+	if !handled {
+		return io.Copy(writerOnly{f}, r)
+	}
+	f.stats.write(n, began)
+	if err != nil {
+		return n, &IOError{err}
+	}
+	return n, nil
+}
+
+// WriteTo implements io.WriterTo, see SSHConn.ReadFrom.
+func (f *ServeConn) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	var handled bool
+	var err error
+	began := time.Now()
+	if r := f.t.spliceReader(); r != nil && !f.shaper.limited() && f.compression == nil && f.tls == nil {
+		n, handled, err = spliceCopy(w, r)
+	}
+	if !handled {
+		return io.Copy(w, readerOnly{f})
+	}
+	f.stats.read(n, began)
+	if err != nil {
+		return n, &IOError{err}
+	}
+	return n, nil
+}
+
+// Close closes the connection, Proxy exits with zero exit status.
+// It is safe to call Close concurrently with other methods and
+// multiple times, only the first call has an effect.
 func (f *ServeConn) Close() (err error) {
-	f.stdin.Close()
-	f.stdout.Close()
-	var buf bytes.Buffer
-	buf.Write(([]byte{f.proxyFeedback}))
-	io.Copy(f.control, &buf)
-	return f.control.Close()
+	return f.closeWithFeedback(f.proxyFeedback)
+}
+
+func (f *ServeConn) closeWithFeedback(feedback byte) error {
+	f.closeOnce.Do(func() {
+		f.shaper.close()
+		f.closeErr = f.t.closeWithFeedback(feedback, f.Stats())
+		f.logger().Debug("connection closed", LogKeyPhase, phaseClose,
+			"reason", closeReasonFromFeedback(feedback), "err", f.closeErr)
+		if f.release != nil {
+			f.release()
+		}
+		if f.l != nil {
+			f.l.untrack(f)
+			if f.l.hooks.OnClose != nil {
+				f.l.hooks.OnClose(f, closeReasonFromFeedback(feedback))
+			}
+		}
+	})
+	return f.closeErr
 }
 
 func (f *ServeConn) CloseWrite() error {
-	return f.stdout.Close()
+	if f.tls != nil {
+		f.tls.CloseWrite()
+	}
+	return f.t.CloseWrite()
+}
+
+// reader and writer return the stream below compression.
+func (f *ServeConn) reader() io.Reader {
+	if f.tls != nil {
+		return f.tls
+	}
+	return f.t
+}
+
+func (f *ServeConn) writer() io.Writer {
+	if f.tls != nil {
+		return f.tls
+	}
+	return f.t
 }
 
 func (f *ServeConn) SetReadDeadline(t time.Time) error {
-	return f.stdin.SetReadDeadline(t)
+	f.shaper.setDeadlines(&t, nil)
+	return f.t.SetReadDeadline(t)
 }
 
 func (f *ServeConn) SetWriteDeadline(t time.Time) error {
-	return f.stdout.SetReadDeadline(t)
+	f.shaper.setDeadlines(nil, &t)
+	return f.t.SetWriteDeadline(t)
 }
 
 func (f *ServeConn) SetDeadline(t time.Time) error {
@@ -171,70 +562,612 @@ func (serveAddr) Network() string { return go_network }
 func (serveAddr) String() string  { return "???" }
 
 func (f *ServeConn) LocalAddr() net.Addr  { return serveAddr{} }
-func (f *ServeConn) RemoteAddr() net.Addr { return serveAddr{} }
+func (f *ServeConn) RemoteAddr() net.Addr { return peerAddr{f.peer} }
+
+// fdTransport uses the stdin and stdout fds passed by Proxy in ProxyModeFD.
+// control is nil if the connection is served by Proxier.Handler.
+type fdTransport struct {
+	stdin, stdout *os.File
+	control       *net.UnixConn
+}
+
+func (t *fdTransport) Read(p []byte) (int, error)  { return t.stdin.Read(p) }
+func (t *fdTransport) Write(p []byte) (int, error) { return t.stdout.Write(p) }
+func (t *fdTransport) CloseWrite() error           { return t.stdout.Close() }
+func (t *fdTransport) spliceReader() io.Reader     { return t.stdin }
+func (t *fdTransport) spliceWriter() io.Writer     { return t.stdout }
+
+func (t *fdTransport) SetReadDeadline(d time.Time) error {
+	return t.stdin.SetReadDeadline(d)
+}
+
+func (t *fdTransport) SetWriteDeadline(d time.Time) error {
+	return t.stdout.SetWriteDeadline(d)
+}
+
+func (t *fdTransport) closeWithFeedback(feedback byte, stats ConnStats) error {
+	t.stdin.Close()
+	t.stdout.Close()
+	if t.control == nil {
+		// served by Proxier.Handler
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.Write(([]byte{feedback}))
+	writeJSONMessage(&buf, sessionStats{stats.BytesRead, stats.BytesWritten})
+	io.Copy(t.control, &buf)
+	return t.control.Close()
+}
 
 type Listener struct {
-	l *net.UnixListener
-	log Logger
+	l   *net.UnixListener
+	log *slog.Logger
+
+	closeOnce sync.Once
+	closeErr  error
+	closed    chan struct{} // closed by Close
+
+	mtx          sync.Mutex
+	conns        map[*ServeConn]struct{}
+	shutdown     chan struct{} // closed by Shutdown
+	shuttingDown bool
+	idle         chan struct{} // closed once conns is empty after Shutdown
+
+	// path is removed on Close if unlink is set
+	path   string
+	unlink bool
+	// lock, if not nil, is the lock file held while listening, see ListenConfig.RemoveStale
+	lock *os.File
+
+	admission   *admission // nil if all connections are admitted
+	hooks       ListenerHooks
+	compression CompressionPolicy
+	encryption  *serverEncryption // nil if encryption is not supported
+	// handshakeTimeout limits the handshake of each connection if > 0
+	handshakeTimeout time.Duration
+
+	// Connections are accepted by acceptLoop and handshaked concurrently,
+	// such that slow or queued clients don't block others.
+	startLoop sync.Once
+	accepted  chan acceptResult
+	loopDone  chan struct{} // closed if acceptLoop exits, loopErr is set
+	loopErr   error
 }
 
-func (l *Listener) SetLog(log Logger) {
+// SetLogger sets the logger. It must be called before Accept.
+// Records about connections carry the attributes described at LogKeyConn.
+func (l *Listener) SetLogger(log *slog.Logger) {
 	l.log = log
 }
 
+// SetLog is SetLogger with a NewPrintfHandler for log.
+func (l *Listener) SetLog(log Logger) {
+	l.SetLogger(slog.New(NewPrintfHandler(log)))
+}
+
+// SetAdmissionPolicy sets the policy for connections accepted after the call.
+// It must be called before Accept.
+func (l *Listener) SetAdmissionPolicy(p AdmissionPolicy) {
+	l.admission = newAdmission(p)
+	l.handshakeTimeout = p.handshakeTimeout()
+}
+
+// SetCompression sets the policy for compression requested by clients
+// through Dialer.Compression. It must be called before Accept.
+// Without a call, clients may send compressed data, but the server doesn't.
+func (l *Listener) SetCompression(p CompressionPolicy) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	l.compression = p
+	return nil
+}
+
+func (l *Listener) logger() *slog.Logger {
+	log := l.log
+	if log == nil {
+		log = discardLogger
+	}
+	return log.With(LogKeyEndpoint, l.Addr().String())
+}
+
+type acceptResult struct {
+	conn *ServeConn
+	err  error
+}
+
+// Accept returns the next connection that completed the handshake with Dial.
+// Errors of individual connections are returned, too,
+// see Server.Serve for telling them apart from those of the Listener.
+// Connections rejected by the AdmissionPolicy are logged but not returned.
 func (l *Listener) Accept() (*ServeConn, error) {
+	l.startLoop.Do(func() {
+		go l.acceptLoop()
+	})
+	select {
+	case r := <-l.accepted:
+		return r.conn, r.err
+	case <-l.loopDone:
+		return nil, l.loopErr
+	}
+}
+
+// failed returns true if the Listener does not accept connections anymore.
+func (l *Listener) failed() bool {
+	select {
+	case <-l.loopDone:
+		return true
+	default:
+		return false
+	}
+}
 
-	var log Logger = discardLog{}
-	if l.log != nil {
-		log = l.log
+func (l *Listener) acceptLoop() {
+	log := l.logger()
+	var backoff time.Duration
+	for {
+		log.Debug("accepting", LogKeyPhase, phaseAccept)
+		unixconn, err := l.l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() && !l.isClosed() {
+				// e.g. EMFILE
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > time.Second {
+					backoff = time.Second
+				}
+				log.Warn("accept error, retrying", LogKeyPhase, phaseAccept, "err", err, "backoff", backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			l.loopErr = err
+			close(l.loopDone)
+			return
+		}
+		backoff = 0
+		go l.handshake(log, unixconn.(*net.UnixConn))
+	}
+}
+
+// handshake delivers the connection from control or the error to Accept.
+func (l *Listener) handshake(log *slog.Logger, control *net.UnixConn) {
+	started := time.Now()
+
+	// abort the handshake if the Listener is closed meanwhile
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-l.closed:
+			cancel()
+			control.Close()
+		case <-ctx.Done():
+		}
+	}()
+	conn, err := l.acceptConn(ctx, log, control, started)
+	cancel()
+	if err == errServerBusy {
+		return // logged by acceptTransport
+	}
+
+	select {
+	case l.accepted <- acceptResult{conn, err}:
+	case <-l.closed:
+		if conn != nil {
+			conn.closeWithFeedback(proxyFeedbackShutdown)
+		}
 	}
+}
+
+func (l *Listener) acceptConn(ctx context.Context, log *slog.Logger, control *net.UnixConn, started time.Time) (*ServeConn, error) {
 
-	log.Printf("accepting")
-	unixconn, err := l.l.Accept()
+	conn, log, err := acceptTransport(ctx, log, control, l.admission, l.hooks, l.handshakeTimeout)
 	if err != nil {
+		if err != errServerBusy {
+			log.Error("handshake failed", "err", err)
+		}
+		control.Close()
 		return nil, err
 	}
 
-	log.Printf("receive stdin and stdout fds")
-	files, err := fd.Get(unixconn.(*net.UnixConn), 2, []string{"netssh-proxy-stdin", "netssh-proxy-stdout"})
+	err = serverHandshake(log, conn, l.compression, l.encryption)
+	// the deadlines set by acceptTransport are for the handshake only
+	conn.t.SetReadDeadline(time.Time{})
+	conn.t.SetWriteDeadline(time.Time{})
+	control.SetDeadline(time.Time{})
 	if err != nil {
-		unixconn.Close()
+		conn.Close()
 		return nil, err
 	}
+	conn.stats = newConnStats(started, peerPID(control))
+
+	if err := l.track(conn); err != nil {
+		log.Info("closing connection", LogKeyPhase, phaseClose, "err", err)
+		conn.closeWithFeedback(proxyFeedbackShutdown)
+		return nil, err
+	}
+	log.Debug("handshake complete", LogKeyPhase, PhaseBanner, "handshake_duration", conn.stats.handshakeDuration)
+	if l.hooks.OnHandshake != nil {
+		l.hooks.OnHandshake(conn)
+	}
 
-	log.Printf("buidling fdrwc")
-	conn := &ServeConn{files[0], files[1], unixconn.(*net.UnixConn), nil, 0}
+	return conn, nil
+
+}
 
+// serverHandshake is the server side of the handshake in Dial.
+// enc is nil if encryption is not supported.
+func serverHandshake(log *slog.Logger, conn *ServeConn, policy CompressionPolicy, enc *serverEncryption) error {
+	log = log.With(LogKeyPhase, PhaseBanner)
+	start := time.Now()
 	var buf bytes.Buffer
 	buf.Write(banner_msg)
 	if _, err := io.Copy(conn, &buf); err != nil {
-		log.Printf("error sending confirm message: %s", err)
-		conn.Close()
-		return nil, err
+		log.Error("cannot send banner", "err", err)
+		return err
 	}
 	buf.Reset()
 	if _, err := io.CopyN(&buf, conn, int64(len(begin_msg))); err != nil {
-		log.Printf("error reading begin message: %s", err)
-		conn.Close()
+		log.Error("cannot read begin message", "err", err)
+		return err
+	}
+	switch {
+	case bytes.Equal(buf.Bytes(), begin_msg):
+		if enc != nil && enc.required {
+			// the client does not expect a beginReply
+			err := ProtocolError{"client did not request encryption"}
+			log.Error("handshake failed", "err", err)
+			return err
+		}
+	case bytes.Equal(buf.Bytes(), begin_opts_msg):
+		if err := beginWithOptions(log, conn, policy, enc); err != nil {
+			return err
+		}
+	default:
+		err := ProtocolError{fmt.Sprintf("unknown begin message: %v", buf.Bytes())}
+		log.Error("handshake failed", "err", err)
+		return err
+	}
+	conn.phases.done(PhaseBanner, start)
+	return nil
+}
+
+// beginWithOptions handles begin_opts_msg.
+func beginWithOptions(log *slog.Logger, conn *ServeConn, policy CompressionPolicy, enc *serverEncryption) error {
+	var opts beginOptions
+	if err := readJSONMessage(conn, &opts, "begin options"); err != nil {
+		log.Error("cannot read begin options", "err", err)
+		return err
+	}
+	conn.carrier = opts.TraceCarrier
+	var reply beginReply
+	if opts.Compression != nil {
+		reply.Compression = policy.choose(*opts.Compression)
+	} else {
+		reply.Compression = compressionChoice{ToServer: CompressionNone, ToClient: CompressionNone}
+	}
+	reply.Encryption = opts.Encryption && enc != nil
+	if !opts.Encryption && enc != nil && enc.required {
+		reply.Error = "encryption is required"
+	}
+	var buf bytes.Buffer
+	if err := writeJSONMessage(&buf, reply); err != nil {
+		return err
+	}
+	if _, err := io.Copy(conn, &buf); err != nil {
+		log.Error("cannot send begin reply", "err", err)
+		return err
+	}
+	if reply.Error != "" {
+		err := ProtocolError{reply.Error}
+		log.Error("handshake failed", "err", err)
+		return err
+	}
+	if opts.Encryption && !reply.Encryption {
+		// the client fails the handshake
+		err := ProtocolError{"client requested encryption, which is not configured"}
+		log.Error("handshake failed", "err", err)
+		return err
+	}
+
+	var r io.Reader = conn.t
+	var w io.Writer = conn.t
+	if reply.Encryption {
+		tlsConn, clientKey, err := serverTLS(conn.t, conn.t, enc)
+		if err != nil {
+			log.Error("handshake failed", "err", err)
+			return err
+		}
+		conn.tls, conn.clientKey = tlsConn, clientKey
+		r, w = tlsConn, tlsConn
+	}
+	c := reply.Compression
+	comp, err := newCompression(r, w, c.ToClient, c.ToServer, policy.Level)
+	if err != nil {
+		log.Error("cannot set up compression", "err", err)
+		return err
+	}
+	conn.compression = comp
+	log.Debug("negotiated options", "encrypted", reply.Encryption,
+		"compression_send", c.ToClient, "compression_recv", c.ToServer)
+	return nil
+}
+
+// acceptTransport performs the server side of connectServer.
+// admission may be nil. If timeout is > 0, the deadlines of control and
+// the returned connection's transport are set such that the handshake
+// completes within timeout, not counting the time spent waiting for
+// admission. The caller must clear them. The returned logger carries the
+// connection's attributes once they are known, also if err != nil.
+func acceptTransport(ctx context.Context, log *slog.Logger, control *net.UnixConn, admission *admission, hooks ListenerHooks, timeout time.Duration) (*ServeConn, *slog.Logger, error) {
+	var phases phases
+	start := time.Now()
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = start.Add(timeout)
+		control.SetDeadline(deadline)
+	}
+	var buf bytes.Buffer
+	endHandshake := func() {}
+	if admission != nil {
+		// The peer is not yet known, but the connection counts towards MaxConns.
+		// Proxies that predate proxy mode negotiation see a closed connection.
+		var err error
+		endHandshake, err = admission.beginHandshake()
+		if err != nil {
+			log.Info("rejected connection", LogKeyPhase, PhaseAdmission, "pending_handshakes", true)
+			buf.Write(proxy_busy_msg)
+			io.Copy(control, &buf)
+			if hooks.OnReject != nil {
+				hooks.OnReject(Peer{})
+			}
+			return nil, log, err
+		}
+		defer endHandshake()
+	}
+	log.Debug("negotiating proxy mode", LogKeyPhase, PhaseProxyMode)
+	msg, legacyFiles, err := readProxyModeMessage(control)
+	if err != nil {
+		return nil, log, err
+	}
+	closeLegacyFiles := func() {
+		for _, f := range legacyFiles {
+			f.Close()
+		}
+	}
+	var mode ProxyMode
+	var info peerInfo
+	switch {
+	case legacyFiles != nil:
+		log.Debug("proxy predates proxy mode negotiation, received fds", LogKeyPhase, PhaseProxyMode)
+		if len(legacyFiles) != 2 {
+			closeLegacyFiles()
+			return nil, log, fmt.Errorf("expected 2 fds from proxy, got %d", len(legacyFiles))
+		}
+		mode = ProxyModeFD
+	case bytes.Equal(msg, proxy_mode_fd_msg):
+		mode = ProxyModeFD
+	case bytes.Equal(msg, proxy_mode_relay_msg):
+		mode = ProxyModeRelay
+	default:
+		err := ProtocolError{fmt.Sprintf("unknown proxy mode message: %v", msg)}
+		buf.Write(proxy_mode_unsupported_msg)
+		io.Copy(control, &buf)
+		return nil, log, err
+	}
+	if legacyFiles == nil {
+		if info, err = readPeerInfo(control); err != nil {
+			return nil, log, err
+		}
+	}
+	peer := info.Peer
+	if info.ConnID == "" {
+		info.ConnID = newConnID()
+	}
+	log = log.With(slog.String(LogKeyConn, info.ConnID), slog.String(LogKeyPeer, peer.ID()))
+	if !info.ProxyStarted.IsZero() {
+		phases = append(phases, Phase{Name: PhaseProxy, Start: info.ProxyStarted, End: start})
+	}
+	start = phases.done(PhaseProxyMode, start)
+
+	var release func()
+	if admission != nil {
+		endHandshake()
+		release, err = admission.admit(ctx, peer)
+		if err == errServerBusy {
+			log.Info("rejected connection", LogKeyPhase, PhaseAdmission)
+			buf.Reset()
+			if legacyFiles != nil {
+				// tell Dial directly, like a current Proxy does
+				buf.Write(busy_msg)
+				io.Copy(legacyFiles[1], &buf)
+			} else {
+				buf.Write(proxy_busy_msg)
+				io.Copy(control, &buf)
+			}
+			if hooks.OnReject != nil {
+				hooks.OnReject(peer)
+			}
+		}
+		if err != nil {
+			closeLegacyFiles()
+			return nil, log, err
+		}
+		if timeout > 0 {
+			// waiting for admission doesn't count towards the handshake
+			deadline = deadline.Add(time.Since(start))
+			control.SetDeadline(deadline)
+		}
+		start = phases.done(PhaseAdmission, start)
+	}
+	var conn *ServeConn
+	if legacyFiles != nil {
+		conn = &ServeConn{t: &fdTransport{legacyFiles[0], legacyFiles[1], control}, mode: mode}
+	} else {
+		conn, err = acceptProxyMode(log, control, mode)
+	}
+	if err != nil {
+		if release != nil {
+			release()
+		}
+		return nil, log, err
+	}
+	if timeout > 0 {
+		// non-pollable fds don't support deadlines, control still has one
+		conn.t.SetReadDeadline(deadline)
+		conn.t.SetWriteDeadline(deadline)
+	}
+	if mode == ProxyModeFD {
+		phases.done(PhaseFDPassing, start)
+		if hooks.OnFDsReceived != nil {
+			t := conn.t.(*fdTransport)
+			hooks.OnFDsReceived(peer, t.stdin, t.stdout)
+		}
+	}
+	conn.id = info.ConnID
+	conn.log = log
+	conn.peer = peer
+	conn.release = release
+	conn.phases = phases
+	return conn, log, nil
+}
+
+// readProxyModeMessage reads the proxy mode message sent by connectServer.
+// Proxies that predate the proxy mode negotiation pass stdin and stdout
+// right away, using a single SCM_RIGHTS message without peer info, in which
+// case the received files are returned instead.
+func readProxyModeMessage(control *net.UnixConn) (msg []byte, legacyFiles []*os.File, err error) {
+	msg = make([]byte, len(proxy_mode_fd_msg))
+	oob := make([]byte, unix.CmsgSpace(2*4))
+	n, oobn, _, _, err := control.ReadMsgUnix(msg, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+	if oobn > 0 {
+		files, err := parseUnixRights(oob[:oobn], []string{"netssh-proxy-stdin", "netssh-proxy-stdout"})
+		if err == nil && files == nil {
+			files = []*os.File{}
+		}
+		return nil, files, err
+	}
+	if n == 0 {
+		return nil, nil, io.EOF
+	}
+	if _, err := io.ReadFull(control, msg[n:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	return msg, nil, nil
+}
+
+// receiveFDs receives stdin and stdout as sent by fd.Put in proxyFDs.
+// Unlike fd.Get, it respects control's deadlines.
+func receiveFDs(control *net.UnixConn) ([]*os.File, error) {
+	var buf [1]byte // fd.Put sends a single byte along with the fds
+	oob := make([]byte, unix.CmsgSpace(2*4))
+	n, oobn, _, _, err := control.ReadMsgUnix(buf[:], oob)
+	if err != nil {
 		return nil, err
 	}
+	if n == 0 && oobn == 0 {
+		return nil, io.EOF
+	}
+	return parseUnixRights(oob[:oobn], []string{"netssh-proxy-stdin", "netssh-proxy-stdout"})
+}
 
-	return conn, nil
+// parseUnixRights returns the fds in the control messages oob as files,
+// like fd.Get does.
+func parseUnixRights(oob []byte, names []string) ([]*os.File, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	for i := range msgs {
+		fds, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		for _, fd := range fds {
+			var name string
+			if len(files) < len(names) {
+				name = names[len(files)]
+			}
+			files = append(files, os.NewFile(uintptr(fd), name))
+		}
+	}
+	return files, nil
+}
+
+func acceptProxyMode(log *slog.Logger, control *net.UnixConn, mode ProxyMode) (*ServeConn, error) {
+	var buf bytes.Buffer
+	buf.Write(proxy_mode_ok_msg)
+	if _, err := io.Copy(control, &buf); err != nil {
+		return nil, err
+	}
 
+	switch mode {
+	case ProxyModeFD:
+		log.Debug("receiving stdin and stdout fds", LogKeyPhase, PhaseFDPassing)
+		files, err := receiveFDs(control)
+		if err != nil || len(files) != 2 {
+			for _, f := range files {
+				f.Close()
+			}
+			if err == nil {
+				err = fmt.Errorf("expected 2 fds from proxy, got %d", len(files))
+			}
+			return nil, err
+		}
+		return &ServeConn{t: &fdTransport{files[0], files[1], control}, mode: mode}, nil
+	default:
+		log.Debug("relaying through control connection", LogKeyPhase, PhaseProxyMode)
+		return &ServeConn{t: newRelayTransport(control), mode: mode}, nil
+	}
 }
 
+// Close stops listening. The socket file is removed if it was created
+// by Listen or ListenConfig.Listen, unless disabled using SetUnlinkOnClose.
+// Established connections are not affected, see Shutdown.
 func (l *Listener) Close() error {
-	return l.l.Close()
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.closeErr = l.l.Close()
+		if l.unlink && l.path != "" {
+			os.Remove(l.path)
+		}
+		if l.lock != nil {
+			l.lock.Close()
+		}
+	})
+	return l.closeErr
+}
+
+// SetUnlinkOnClose sets whether Close removes the socket file,
+// e.g. to hand the socket over to a new server process.
+// It has no effect for Listeners created by ListenFromFile or ListenFromSystemd.
+func (l *Listener) SetUnlinkOnClose(unlink bool) {
+	l.unlink = unlink
+}
+
+// File returns a copy of the listening socket, e.g. to pass it to a
+// child process that uses ListenFromFile.
+func (l *Listener) File() (*os.File, error) {
+	return l.l.File()
 }
 
 func (l *Listener) Addr() net.Addr {
+	if l.path != "" {
+		return &net.UnixAddr{Name: l.path, Net: "unix"}
+	}
 	return l.l.Addr()
 }
 
 func Listen(unixSockPath string) (*Listener, error) {
-	unixlistener, err := net.Listen("unix", unixSockPath)
-	if err != nil {
-		return nil, err
-	}
-	return &Listener{unixlistener.(*net.UnixListener), nil}, nil
+	var c ListenConfig
+	return c.Listen(unixSockPath)
 }
@@ -0,0 +1,222 @@
+package netssh
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime"
+	"sync"
+)
+
+// Handler serves a connection accepted by Server.
+// The connection is closed after ServeNetSSH returns.
+// ctx is cancelled when the Server shuts down or ServeNetSSH returns.
+type Handler interface {
+	ServeNetSSH(ctx context.Context, conn *ServeConn)
+}
+
+// HandlerFunc adapts a function to the Handler interface.
+type HandlerFunc func(ctx context.Context, conn *ServeConn)
+
+func (f HandlerFunc) ServeNetSSH(ctx context.Context, conn *ServeConn) {
+	f(ctx, conn)
+}
+
+// ErrServerClosed is returned by Server.Serve after Server.Shutdown
+// was called or the Listener was closed.
+var ErrServerClosed = errors.New("netssh: server closed")
+
+// proxyFeedbackAbnormal is sent to Proxy for connections whose handler panicked.
+const proxyFeedbackAbnormal byte = 1
+
+// Server accepts connections from Listeners and serves each
+// in its own goroutine.
+type Server struct {
+	Handler Handler
+	// MaxConns, if > 0, limits the number of connections served concurrently.
+	// Server stops accepting while at the limit, i.e., further connections
+	// wait after the handshake until a handler becomes available.
+	// See AdmissionPolicy for rejecting connections instead.
+	MaxConns int
+	// Logger receives errors from accepting and serving connections.
+	// Nothing is logged if Logger and Log are nil.
+	Logger *slog.Logger
+	// Log is used with a NewPrintfHandler if Logger is nil.
+	Log Logger
+
+	mtx          sync.Mutex
+	listeners    map[*Listener]struct{}
+	shuttingDown bool
+	sem          chan struct{}
+	handlers     sync.WaitGroup
+}
+
+func (s *Server) log() *slog.Logger {
+	switch {
+	case s.Logger != nil:
+		return s.Logger
+	case s.Log != nil:
+		return slog.New(NewPrintfHandler(s.Log))
+	default:
+		return discardLogger
+	}
+}
+
+// Serve accepts connections from l until l is closed or Shutdown is called,
+// after which it returns ErrServerClosed. Errors of individual connections
+// are logged and do not stop Serve.
+// Handlers' contexts are derived from ctx.
+func (s *Server) Serve(ctx context.Context, l *Listener) error {
+	s.mtx.Lock()
+	if s.shuttingDown {
+		s.mtx.Unlock()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[*Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	if s.sem == nil && s.MaxConns > 0 {
+		s.sem = make(chan struct{}, s.MaxConns)
+	}
+	sem := s.sem
+	s.mtx.Unlock()
+	defer func() {
+		s.mtx.Lock()
+		delete(s.listeners, l)
+		s.mtx.Unlock()
+	}()
+
+	log := s.log()
+	for {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-l.closed:
+				return ErrServerClosed
+			}
+		}
+		conn, err := l.Accept()
+		if err != nil {
+			if sem != nil {
+				<-sem
+			}
+			if l.isClosed() {
+				return ErrServerClosed
+			}
+			if l.failed() {
+				return err
+			}
+			log.Warn("netssh: handshake error", LogKeyEndpoint, l.Addr().String(), "err", err)
+			continue
+		}
+		// Add must not race with Wait in Shutdown
+		s.mtx.Lock()
+		if s.shuttingDown {
+			s.mtx.Unlock()
+			conn.closeWithFeedback(proxyFeedbackShutdown)
+			if sem != nil {
+				<-sem
+			}
+			return ErrServerClosed
+		}
+		s.handlers.Add(1)
+		s.mtx.Unlock()
+		go func() {
+			defer s.handlers.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			s.serveConn(ctx, conn)
+		}()
+	}
+}
+
+func (s *Server) serveConn(ctx context.Context, conn *ServeConn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-conn.ShuttingDown():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	log := s.log().With(
+		slog.String(LogKeyConn, conn.ID()),
+		slog.String(LogKeyPeer, conn.Peer().ID()),
+		slog.String(LogKeyPhase, phaseServe),
+	)
+	if conn.l != nil {
+		log = log.With(LogKeyEndpoint, conn.l.Addr().String())
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Error("netssh: panic serving connection", "panic", r, "stack", string(buf))
+			conn.closeWithFeedback(proxyFeedbackAbnormal)
+			return
+		}
+		if err := conn.Close(); err != nil {
+			log.Error("netssh: error closing connection", "err", err)
+		}
+	}()
+	s.Handler.ServeNetSSH(ctx, conn)
+}
+
+// Shutdown shuts down all Listeners passed to Serve, see Listener.Shutdown,
+// and waits for the handlers to return or ctx to be done.
+// The returned error joins the errors of the Listeners and ctx.Err()
+// if handlers were still running when ctx was done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mtx.Lock()
+	s.shuttingDown = true
+	listeners := make([]*Listener, 0, len(s.listeners))
+	for l := range s.listeners {
+		listeners = append(listeners, l)
+	}
+	s.mtx.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *Listener) {
+			defer wg.Done()
+			errs <- l.Shutdown(ctx)
+		}(l)
+	}
+	wg.Wait()
+	close(errs)
+	var joined []error
+	for err := range errs {
+		if err != nil {
+			joined = append(joined, err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if !containsError(joined, ctx.Err()) {
+			joined = append(joined, ctx.Err())
+		}
+	}
+	return errors.Join(joined...)
+}
+
+func containsError(errs []error, err error) bool {
+	for _, e := range errs {
+		if e == err {
+			return true
+		}
+	}
+	return false
+}
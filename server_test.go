@@ -0,0 +1,125 @@
+package netssh
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serveTemp(t *testing.T, s *Server) (l *Listener, served chan error, cleanup func()) {
+	l, cleanup = listenTemp(t)
+	served = make(chan error, 1)
+	go func() {
+		served <- s.Serve(context.Background(), l)
+	}()
+	return l, served, cleanup
+}
+
+func TestServerPanic(t *testing.T) {
+	s := &Server{Handler: HandlerFunc(func(ctx context.Context, conn *ServeConn) {
+		var buf [1]byte
+		conn.Read(buf[:])
+		if buf[0] == 'p' {
+			panic("test")
+		}
+		conn.Write(buf[:])
+	})}
+	l, served, cleanup := serveTemp(t, s)
+	defer cleanup()
+
+	c := dialRelayClient(t, l.Addr().String())
+	c.conn.Write([]byte("p"))
+	assert.Equal(t, proxyFeedbackAbnormal, c.feedback())
+
+	c = dialRelayClient(t, l.Addr().String())
+	c.conn.Write([]byte("x"))
+	typ, payload := c.readFrame()
+	assert.Equal(t, relayFrameData, int(typ))
+	assert.Equal(t, "x", string(payload))
+	assert.Equal(t, byte(0), c.feedback())
+
+	require.NoError(t, s.Shutdown(context.Background()))
+	assert.Equal(t, ErrServerClosed, <-served)
+}
+
+func TestServerMaxConns(t *testing.T) {
+	release := make(chan struct{})
+	s := &Server{
+		MaxConns: 1,
+		Handler: HandlerFunc(func(ctx context.Context, conn *ServeConn) {
+			conn.Write([]byte("x"))
+			<-release
+		}),
+	}
+	l, _, cleanup := serveTemp(t, s)
+	defer cleanup()
+
+	first := dialRelayClient(t, l.Addr().String())
+	first.readFrame()
+	second := dialRelayClient(t, l.Addr().String())
+	second.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := second.conn.Read(make([]byte, 1))
+	require.Error(t, err, "second connection must wait for a handler")
+	second.conn.SetReadDeadline(time.Time{})
+
+	release <- struct{}{}
+	assert.Equal(t, byte(0), first.feedback())
+	typ, payload := second.readFrame()
+	assert.Equal(t, relayFrameData, int(typ))
+	assert.Equal(t, "x", string(payload))
+	close(release)
+	assert.Equal(t, byte(0), second.feedback())
+}
+
+func TestServerShutdownCancelsContext(t *testing.T) {
+	s := &Server{Handler: HandlerFunc(func(ctx context.Context, conn *ServeConn) {
+		<-ctx.Done()
+	})}
+	l, served, cleanup := serveTemp(t, s)
+	defer cleanup()
+
+	c := dialRelayClient(t, l.Addr().String())
+	for len(l.Conns()) == 0 {
+		// Accept has not yet received the begin message
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	assert.Equal(t, byte(0), c.feedback())
+	assert.Equal(t, ErrServerClosed, <-served)
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	release := make(chan struct{})
+	returned := make(chan struct{})
+	s := &Server{Handler: HandlerFunc(func(ctx context.Context, conn *ServeConn) {
+		defer close(returned)
+		<-release
+	})}
+	l, served, cleanup := serveTemp(t, s)
+	defer cleanup()
+
+	dialRelayClient(t, l.Addr().String())
+	for len(l.Conns()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	assert.Equal(t, "context deadline exceeded", err.Error())
+	select {
+	case <-returned:
+		t.Fatal("handler returned before release")
+	default:
+	}
+	close(release)
+	<-returned
+	assert.Equal(t, ErrServerClosed, <-served)
+
+	// nothing left to wait for
+	require.NoError(t, s.Shutdown(context.Background()))
+}
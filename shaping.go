@@ -0,0 +1,205 @@
+package netssh
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// NewBandwidthLimiter returns a limiter for SetReadLimiter and SetWriteLimiter
+// that allows bytesPerSecond with bursts of up to burst bytes.
+// The limits can be adjusted at runtime using the limiter's SetLimit and
+// SetBurst methods. Use the same limiter for multiple connections
+// to limit their combined bandwidth.
+func NewBandwidthLimiter(bytesPerSecond float64, burst int) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// shapingTimeoutError is returned if a Write would have to wait for the
+// limiter beyond the write deadline.
+type shapingTimeoutError struct{}
+
+func (shapingTimeoutError) Error() string   { return "bandwidth limit: i/o timeout" }
+func (shapingTimeoutError) Timeout() bool   { return true }
+func (shapingTimeoutError) Temporary() bool { return true }
+
+// shaper applies bandwidth limits to a connection.
+// The zero value does not limit.
+type shaper struct {
+	mtx                         sync.Mutex
+	read, write                 *rate.Limiter
+	readDeadline, writeDeadline time.Time
+	closed                      chan struct{}
+}
+
+func (s *shaper) setLimiters(read, write **rate.Limiter) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if read != nil {
+		s.read = *read
+	}
+	if write != nil {
+		s.write = *write
+	}
+}
+
+func (s *shaper) setDeadlines(read, write *time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if read != nil {
+		s.readDeadline = *read
+	}
+	if write != nil {
+		s.writeDeadline = *write
+	}
+}
+
+// done returns a channel that is closed by close.
+func (s *shaper) done() <-chan struct{} {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed == nil {
+		s.closed = make(chan struct{})
+	}
+	return s.closed
+}
+
+// close interrupts waiting for the limiters.
+func (s *shaper) close() {
+	s.done()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+}
+
+// chunkSize returns the largest number of bytes <= n that l can grant at once.
+func chunkSize(l *rate.Limiter, n int) int {
+	if l.Limit() == rate.Inf {
+		return n
+	}
+	if b := l.Burst(); b < n {
+		if b < 1 {
+			return 1
+		}
+		return b
+	}
+	return n
+}
+
+// wait waits until l grants n bytes. If that is later than deadline,
+// it returns shapingTimeoutError without consuming the bytes if strict is set,
+// and otherwise waits until deadline and leaves the debt with l.
+func (s *shaper) wait(l *rate.Limiter, n int, deadline time.Time, strict bool) error {
+	now := time.Now()
+	r := l.ReserveN(now, n)
+	if !r.OK() {
+		// burst was lowered concurrently, don't shape this time
+		return nil
+	}
+	delay := r.DelayFrom(now)
+	if delay == 0 {
+		return nil
+	}
+	if !deadline.IsZero() && now.Add(delay).After(deadline) {
+		if strict {
+			r.CancelAt(now)
+			return shapingTimeoutError{}
+		}
+		delay = deadline.Sub(now)
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.done():
+		// the subsequent I/O fails
+	}
+	return nil
+}
+
+// limitRead returns the prefix of p that may be read.
+func (s *shaper) limitRead(p []byte) []byte {
+	s.mtx.Lock()
+	l := s.read
+	s.mtx.Unlock()
+	if l == nil {
+		return p
+	}
+	return p[:chunkSize(l, len(p))]
+}
+
+// afterRead accounts for n bytes read.
+// Reads are shaped after the fact to avoid charging for bytes that
+// were not available, but never wait beyond the read deadline.
+func (s *shaper) afterRead(n int) {
+	s.mtx.Lock()
+	l, deadline := s.read, s.readDeadline
+	s.mtx.Unlock()
+	if l == nil || n == 0 {
+		return
+	}
+	s.wait(l, n, deadline, false)
+}
+
+// writeShaped writes p using write, waiting for the write limiter
+// before each chunk.
+func (s *shaper) writeShaped(p []byte, write func([]byte) (int, error)) (n int, err error) {
+	s.mtx.Lock()
+	l := s.write
+	s.mtx.Unlock()
+	if l == nil {
+		return write(p)
+	}
+	for len(p) > 0 {
+		s.mtx.Lock()
+		deadline := s.writeDeadline
+		s.mtx.Unlock()
+		chunk := p[:chunkSize(l, len(p))]
+		if err := s.wait(l, len(chunk), deadline, true); err != nil {
+			return n, err
+		}
+		m, err := write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// limited returns true if ReadFrom and WriteTo must not bypass Read and Write.
+func (s *shaper) limited() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.read != nil || s.write != nil
+}
+
+// SetReadLimiter limits the rate at which data is read from conn,
+// nil disables the limit. See NewBandwidthLimiter.
+func (conn *SSHConn) SetReadLimiter(l *rate.Limiter) {
+	conn.shaper.setLimiters(&l, nil)
+}
+
+// SetWriteLimiter limits the rate at which data is written to conn,
+// nil disables the limit. A Write that would have to wait for the limiter
+// beyond the write deadline fails with a timeout error.
+// See NewBandwidthLimiter.
+func (conn *SSHConn) SetWriteLimiter(l *rate.Limiter) {
+	conn.shaper.setLimiters(nil, &l)
+}
+
+// SetReadLimiter is like SSHConn.SetReadLimiter.
+func (f *ServeConn) SetReadLimiter(l *rate.Limiter) {
+	f.shaper.setLimiters(&l, nil)
+}
+
+// SetWriteLimiter is like SSHConn.SetWriteLimiter.
+func (f *ServeConn) SetWriteLimiter(l *rate.Limiter) {
+	f.shaper.setLimiters(nil, &l)
+}
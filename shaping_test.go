@@ -0,0 +1,90 @@
+package netssh
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func connectDrained(t *testing.T, l *Listener) *ServeConn {
+	client, conn := connect(t, l)
+	go io.Copy(ioutil.Discard, client.conn)
+	return conn
+}
+
+func TestShapingWrite(t *testing.T) {
+	l, cleanup := listenTemp(t)
+	defer cleanup()
+	conn := connectDrained(t, l)
+	defer conn.Close()
+
+	conn.SetWriteLimiter(NewBandwidthLimiter(100<<10, 10<<10))
+	pre := time.Now()
+	n, err := conn.Write(make([]byte, 50<<10))
+	require.NoError(t, err)
+	assert.Equal(t, 50<<10, n)
+	// the first 10KiB are the burst
+	assert.True(t, time.Since(pre) >= 350*time.Millisecond, "%s", time.Since(pre))
+}
+
+func TestShapingWriteDeadline(t *testing.T) {
+	l, cleanup := listenTemp(t)
+	defer cleanup()
+	conn := connectDrained(t, l)
+	defer conn.Close()
+
+	conn.SetWriteLimiter(NewBandwidthLimiter(1<<10, 1<<10))
+	require.NoError(t, conn.SetWriteDeadline(time.Now().Add(100*time.Millisecond)))
+	n, err := conn.Write(make([]byte, 10<<10))
+	assert.Equal(t, 1<<10, n)
+	netErr, ok := err.(net.Error)
+	require.True(t, ok, "%T %s", err, err)
+	assert.True(t, netErr.Timeout())
+}
+
+func TestShapingSharedLimiter(t *testing.T) {
+	l, cleanup := listenTemp(t)
+	defer cleanup()
+
+	limiter := NewBandwidthLimiter(200<<10, 8<<10)
+	var wg sync.WaitGroup
+	pre := time.Now()
+	for i := 0; i < 2; i++ {
+		conn := connectDrained(t, l)
+		defer conn.Close()
+		conn.SetWriteLimiter(limiter)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := conn.Write(make([]byte, 50<<10))
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	// (100KiB - 8KiB) / 200KiB/s
+	assert.True(t, time.Since(pre) >= 400*time.Millisecond, "%s", time.Since(pre))
+}
+
+func TestShapingRead(t *testing.T) {
+	l, cleanup := listenTemp(t)
+	defer cleanup()
+	client, conn := connect(t, l)
+	defer conn.Close()
+
+	go func() {
+		client.conn.Write(make([]byte, 30<<10))
+		client.conn.(*net.UnixConn).CloseWrite()
+	}()
+	conn.SetReadLimiter(NewBandwidthLimiter(100<<10, 10<<10))
+	pre := time.Now()
+	n, err := io.Copy(ioutil.Discard, conn)
+	require.NoError(t, err)
+	assert.Equal(t, int64(30<<10), n)
+	assert.True(t, time.Since(pre) >= 150*time.Millisecond, "%s", time.Since(pre))
+}
@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+package netssh
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSpliceSize is the maximum number of bytes moved per splice(2) call.
+const maxSpliceSize = 1 << 20
+
+// spliceable returns the RawConn of v if it refers to a file descriptor
+// that splice(2) supports: a pipe, a socket or a regular file not opened
+// in append mode. Other fds, e.g. ttys or character devices, are rejected
+// so that we never find out mid-transfer.
+func spliceable(v interface{}) (syscall.RawConn, bool) {
+	sc, ok := v.(syscall.Conn)
+	if !ok {
+		return nil, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+	supported := false
+	err = rc.Control(func(fd uintptr) {
+		var st unix.Stat_t
+		if unix.Fstat(int(fd), &st) != nil {
+			return
+		}
+		switch st.Mode & unix.S_IFMT {
+		case unix.S_IFIFO, unix.S_IFSOCK:
+			supported = true
+		case unix.S_IFREG:
+			flags, err := unix.FcntlInt(fd, unix.F_GETFL, 0)
+			supported = err == nil && flags&unix.O_APPEND == 0
+		}
+	})
+	return rc, err == nil && supported
+}
+
+// spliceCopy copies from src to dst through an intermediate pipe without
+// copying to userspace, like io.Copy with dst.ReadFrom or src.WriteTo.
+// If src is an *io.LimitedReader, at most N bytes are copied and N is updated.
+// handled is false if either side does not support splicing,
+// in which case nothing has been copied.
+func spliceCopy(dst io.Writer, src io.Reader) (written int64, handled bool, err error) {
+	limit := int64(-1)
+	lr, isLimited := src.(*io.LimitedReader)
+	if isLimited {
+		limit, src = lr.N, lr.R
+		if limit <= 0 {
+			return 0, true, nil
+		}
+	}
+	srcRC, ok := spliceable(src)
+	if !ok {
+		return 0, false, nil
+	}
+	dstRC, ok := spliceable(dst)
+	if !ok {
+		return 0, false, nil
+	}
+
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+
+	defer func() {
+		if isLimited {
+			lr.N -= written
+		}
+	}()
+
+	for limit != 0 {
+		max := maxSpliceSize
+		if limit > 0 && limit < int64(max) {
+			max = int(limit)
+		}
+
+		var inPipe int64
+		var serr error
+		rerr := srcRC.Read(func(fd uintptr) bool {
+			inPipe, serr = unix.Splice(int(fd), nil, p[1], nil, max, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+			return serr != unix.EAGAIN
+		})
+		if rerr != nil {
+			return written, true, rerr
+		}
+		if serr != nil {
+			return written, true, os.NewSyscallError("splice", serr)
+		}
+		if inPipe == 0 {
+			return written, true, nil // EOF
+		}
+
+		for inPipe > 0 {
+			var n int64
+			werr := dstRC.Write(func(fd uintptr) bool {
+				n, serr = unix.Splice(p[0], nil, int(fd), nil, int(inPipe), unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+				return serr != unix.EAGAIN
+			})
+			if werr != nil {
+				return written, true, werr
+			}
+			if serr != nil {
+				return written, true, os.NewSyscallError("splice", serr)
+			}
+			inPipe -= n
+			written += n
+			if limit > 0 {
+				limit -= n
+			}
+		}
+	}
+	return written, true, nil
+}
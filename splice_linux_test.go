@@ -0,0 +1,135 @@
+//go:build linux
+// +build linux
+
+package netssh
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempFileWithData(t testing.TB, size int) (*os.File, []byte) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	f, err := ioutil.TempFile("", "netssh-splice")
+	require.NoError(t, err)
+	os.Remove(f.Name())
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	return f, data
+}
+
+// pipeConn returns an SSHConn whose process side is the returned
+// (stdin reader, stdout writer) pair.
+func pipeConn(t testing.TB) (conn *SSHConn, stdinR, stdoutW *os.File) {
+	stdinR, stdinW, err := os.Pipe()
+	require.NoError(t, err)
+	stdoutR, stdoutW, err := os.Pipe()
+	require.NoError(t, err)
+	return &SSHConn{stdin: stdinW, stdout: stdoutR}, stdinR, stdoutW
+}
+
+func TestSplice(t *testing.T) {
+
+	t.Run("readfrom-limited-file", func(t *testing.T) {
+		conn, stdinR, _ := pipeConn(t)
+		f, data := tempFileWithData(t, 3<<20)
+		defer f.Close()
+
+		received := make(chan []byte)
+		go func() {
+			b, _ := ioutil.ReadAll(stdinR)
+			received <- b
+		}()
+		lr := &io.LimitedReader{R: f, N: 2 << 20}
+		n, err := conn.ReadFrom(lr)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2<<20), n)
+		assert.Equal(t, int64(0), lr.N)
+		conn.CloseWrite()
+		assert.True(t, bytes.Equal(data[:2<<20], <-received))
+	})
+
+	t.Run("writeto-file", func(t *testing.T) {
+		conn, _, stdoutW := pipeConn(t)
+		data := bytes.Repeat([]byte("netssh"), 100000)
+		go func() {
+			stdoutW.Write(data)
+			stdoutW.Close()
+		}()
+		f, _ := tempFileWithData(t, 0)
+		defer f.Close()
+		n, err := conn.WriteTo(f)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(data)), n)
+		_, err = f.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		written, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, written))
+	})
+
+	t.Run("pipes", func(t *testing.T) {
+		// SSHConn's stdin and stdout, see dial
+		stdout, stdin, err := os.Pipe()
+		require.NoError(t, err)
+		defer stdout.Close()
+		defer stdin.Close()
+		_, ok := spliceable(stdin)
+		assert.True(t, ok)
+		_, ok = spliceable(stdout)
+		assert.True(t, ok)
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		conn, stdinR, _ := pipeConn(t)
+		go func() {
+			conn.ReadFrom(bytes.NewReader([]byte("buffer")))
+			conn.CloseWrite()
+		}()
+		b, err := ioutil.ReadAll(stdinR)
+		require.NoError(t, err)
+		assert.Equal(t, "buffer", string(b))
+	})
+}
+
+func benchmarkSSHConnReadFrom(b *testing.B, splice bool) {
+	const size = 64 << 20
+	f, _ := tempFileWithData(b, size)
+	defer f.Close()
+	conn, stdinR, _ := pipeConn(b)
+	defer conn.stdin.Close()
+
+	// the sink is the same for both variants
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	require.NoError(b, err)
+	defer devnull.Close()
+	go io.Copy(devnull, stdinR)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := f.Seek(0, io.SeekStart)
+		require.NoError(b, err)
+		if splice {
+			_, err = conn.ReadFrom(f)
+		} else {
+			_, err = io.Copy(writerOnly{conn}, readerOnly{f})
+		}
+		require.NoError(b, err)
+	}
+}
+
+func BenchmarkSSHConnReadFrom(b *testing.B) {
+	b.Run("splice", func(b *testing.B) { benchmarkSSHConnReadFrom(b, true) })
+	b.Run("copy", func(b *testing.B) { benchmarkSSHConnReadFrom(b, false) })
+}
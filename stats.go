@@ -0,0 +1,128 @@
+package netssh
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats are statistics about an SSHConn or ServeConn, see their Stats methods.
+// Byte and call counters include data transferred by ReadFrom and WriteTo,
+// but not the handshake.
+type ConnStats struct {
+	BytesRead, BytesWritten int64
+	// Reads and Writes count the calls to Read and Write.
+	// ReadFrom and WriteTo count as one call.
+	Reads, Writes int64
+	// ReadBlocked and WriteBlocked are the total time spent in
+	// Read and Write, including waiting for bandwidth limiters.
+	ReadBlocked, WriteBlocked time.Duration
+	// HandshakeDuration is the time from starting the ssh process (SSHConn)
+	// or accepting the connection (ServeConn) to the completed handshake.
+	HandshakeDuration time.Duration
+	// ProcessStarted and PID identify the ssh process for SSHConn.
+	// For ServeConn, PID is the process running Proxy, if available,
+	// and ProcessStarted is zero.
+	ProcessStarted time.Time
+	PID            int
+	// LastActivity is the time of the last Read or Write that transferred
+	// data, or the end of the handshake.
+	LastActivity time.Time
+	// WireBytesRead and WireBytesWritten are BytesRead and BytesWritten
+	// as transferred after compression, see CompressionPolicy.
+	// They equal BytesRead and BytesWritten if a direction is not compressed.
+	WireBytesRead, WireBytesWritten int64
+}
+
+// CompressionRatio returns the ratios of BytesRead to WireBytesRead and
+// of BytesWritten to WireBytesWritten, 1 if no bytes were transferred.
+func (s ConnStats) CompressionRatio() (read, written float64) {
+	ratio := func(bytes, wire int64) float64 {
+		if bytes == 0 || wire == 0 {
+			return 1
+		}
+		return float64(bytes) / float64(wire)
+	}
+	return ratio(s.BytesRead, s.WireBytesRead), ratio(s.BytesWritten, s.WireBytesWritten)
+}
+
+// connStats is updated concurrently with atomic operations.
+// It must be allocated separately to guarantee 64-bit alignment of the counters.
+// A nil *connStats ignores updates, e.g. during the handshake.
+type connStats struct {
+	bytesRead, bytesWritten   int64
+	reads, writes             int64
+	readBlocked, writeBlocked int64 // nanoseconds
+	lastActivity              int64 // unix nanoseconds
+
+	// set before the connection is returned to the user
+	handshakeDuration time.Duration
+	processStarted    time.Time
+	pid               int
+}
+
+func newConnStats(started time.Time, pid int) *connStats {
+	now := time.Now()
+	return &connStats{
+		handshakeDuration: now.Sub(started),
+		lastActivity:      now.UnixNano(),
+		pid:               pid,
+	}
+}
+
+func (s *connStats) read(n int64, began time.Time) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.reads, 1)
+	s.account(&s.bytesRead, &s.readBlocked, n, began)
+}
+
+func (s *connStats) write(n int64, began time.Time) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.writes, 1)
+	s.account(&s.bytesWritten, &s.writeBlocked, n, began)
+}
+
+func (s *connStats) account(bytes, blocked *int64, n int64, began time.Time) {
+	now := time.Now()
+	atomic.AddInt64(blocked, int64(now.Sub(began)))
+	if n > 0 {
+		atomic.AddInt64(bytes, n)
+		atomic.StoreInt64(&s.lastActivity, now.UnixNano())
+	}
+}
+
+func (s *connStats) snapshot() ConnStats {
+	if s == nil {
+		return ConnStats{}
+	}
+	return ConnStats{
+		BytesRead:         atomic.LoadInt64(&s.bytesRead),
+		BytesWritten:      atomic.LoadInt64(&s.bytesWritten),
+		Reads:             atomic.LoadInt64(&s.reads),
+		Writes:            atomic.LoadInt64(&s.writes),
+		ReadBlocked:       time.Duration(atomic.LoadInt64(&s.readBlocked)),
+		WriteBlocked:      time.Duration(atomic.LoadInt64(&s.writeBlocked)),
+		HandshakeDuration: s.handshakeDuration,
+		ProcessStarted:    s.processStarted,
+		PID:               s.pid,
+		LastActivity:      time.Unix(0, atomic.LoadInt64(&s.lastActivity)),
+	}
+}
+
+// Stats returns statistics about conn.
+// It is safe to call Stats concurrently with I/O.
+func (conn *SSHConn) Stats() ConnStats {
+	s := conn.stats.snapshot()
+	conn.compression.stats(&s)
+	return s
+}
+
+// Stats is like SSHConn.Stats.
+func (f *ServeConn) Stats() ConnStats {
+	s := f.stats.snapshot()
+	f.compression.stats(&s)
+	return s
+}
@@ -0,0 +1,55 @@
+package netssh
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeConnStats(t *testing.T) {
+	l, cleanup := listenTemp(t)
+	defer cleanup()
+	client, conn := connect(t, l)
+	defer conn.Close()
+
+	initial := conn.Stats()
+	assert.True(t, initial.HandshakeDuration > 0)
+	assert.Zero(t, initial.BytesRead)
+	if runtime.GOOS == "linux" {
+		assert.Equal(t, os.Getpid(), initial.PID)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			conn.Stats() // concurrently with I/O
+		}
+	}()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		client.conn.Write([]byte("hello"))
+	}()
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	_, err = conn.Write(make([]byte, 100))
+	require.NoError(t, err)
+	wg.Wait()
+
+	stats := conn.Stats()
+	assert.Equal(t, int64(5), stats.BytesRead)
+	assert.Equal(t, int64(100), stats.BytesWritten)
+	assert.True(t, stats.Reads >= 1)
+	assert.Equal(t, int64(1), stats.Writes)
+	assert.True(t, stats.ReadBlocked >= 5*time.Millisecond, "%s", stats.ReadBlocked)
+	assert.True(t, stats.LastActivity.After(initial.LastActivity))
+}
@@ -0,0 +1,103 @@
+package netssh
+
+import (
+	"context"
+	"time"
+)
+
+// Phase is a step of the connection setup, see DialTrace and ServeConn.Phases.
+type Phase struct {
+	// Name is one of the Phase* constants.
+	Name       string
+	Start, End time.Time
+}
+
+// Phases of Dial, in order.
+const (
+	// PhaseSSHStart is starting the ssh process.
+	PhaseSSHStart = "ssh_start"
+	// PhaseConnect is the time from the started ssh process to receiving
+	// the banner: ssh's key exchange and authentication, Proxy and the
+	// server side phases up to PhaseBanner.
+	PhaseConnect = "connect"
+	// PhaseBegin is sending the begin message.
+	PhaseBegin = "begin"
+)
+
+// Phases of the server side, in order. The timestamps of PhaseProxy
+// are taken by Proxy and the server, which run on the same host.
+const (
+	// PhaseProxy is the time from the start of Proxy to the server accepting
+	// its connection, including the activation of the server by Proxy.
+	PhaseProxy = "proxy"
+	// PhaseProxyMode is reading the proxy mode and the peer info.
+	PhaseProxyMode = "proxy_mode"
+	// PhaseAdmission is waiting for the AdmissionPolicy.
+	// It is omitted if the Listener has no AdmissionPolicy.
+	PhaseAdmission = "admission"
+	// PhaseFDPassing is receiving stdin and stdout from Proxy in ProxyModeFD.
+	PhaseFDPassing = "fd_passing"
+	// PhaseBanner is sending the banner and waiting for the begin message.
+	PhaseBanner = "banner"
+)
+
+// phases records Phases, the zero value is ready to use.
+type phases []Phase
+
+// done appends the phase from start to now and returns now,
+// the start of the next phase.
+func (p *phases) done(name string, start time.Time) time.Time {
+	now := time.Now()
+	*p = append(*p, Phase{Name: name, Start: start, End: now})
+	return now
+}
+
+// DialTrace observes a single Dial, see ContextWithDialTrace.
+type DialTrace struct {
+	// Carrier, if not empty, is sent to the server with the options of Dial
+	// and available there through ServeConn.TraceCarrier, e.g. to propagate
+	// the trace context of a distributed trace. It is only sent if Dial
+	// negotiates options, see Dialer.NegotiateOptions, because servers
+	// without support for options would pass it on to the application.
+	Carrier map[string]string
+	// PhaseDone, if not nil, is called when a phase of Dial ends, with the
+	// error that ended it, if any. All calls happen before Dial returns.
+	PhaseDone func(p Phase, err error)
+}
+
+func (t *DialTrace) phaseDone(name string, start time.Time, err error) time.Time {
+	now := time.Now()
+	if t != nil && t.PhaseDone != nil {
+		t.PhaseDone(Phase{Name: name, Start: start, End: now}, err)
+	}
+	return now
+}
+
+func (t *DialTrace) carrier() map[string]string {
+	if t == nil {
+		return nil
+	}
+	return t.Carrier
+}
+
+// ContextWithDialTrace returns a context that makes Dial report to trace.
+func ContextWithDialTrace(ctx context.Context, trace *DialTrace) context.Context {
+	return context.WithValue(ctx, contextKeyDialTrace, trace)
+}
+
+func contextDialTrace(ctx context.Context) *DialTrace {
+	trace, _ := ctx.Value(contextKeyDialTrace).(*DialTrace)
+	return trace
+}
+
+// Phases returns the phases of the server side of the handshake, in order,
+// see the Phase* constants. PhaseProxy is missing if Proxy is an older
+// version. Connections served by Proxier.Handler only have PhaseBanner.
+func (f *ServeConn) Phases() []Phase {
+	return append([]Phase(nil), f.phases...)
+}
+
+// TraceCarrier returns DialTrace.Carrier as sent by the client, or nil.
+func (f *ServeConn) TraceCarrier() map[string]string {
+	return f.carrier
+}
@@ -0,0 +1,54 @@
+package netssh
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerHandshakeTraceCarrier(t *testing.T) {
+	l, cleanup := listenTemp(t)
+	defer cleanup()
+
+	carrier := map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+	go func() {
+		c, resp := dialRelayClientAs(t, l.Addr().String(), Peer{})
+		require.Equal(t, proxy_mode_ok_msg, resp)
+		typ, payload := c.readFrame()
+		require.Equal(t, relayFrameData, int(typ))
+		require.Equal(t, banner_msg, payload)
+		var buf bytes.Buffer
+		buf.Write(begin_opts_msg)
+		require.NoError(t, writeJSONMessage(&buf, beginOptions{TraceCarrier: carrier}))
+		_, err := c.conn.Write(buf.Bytes())
+		require.NoError(t, err)
+	}()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, carrier, conn.TraceCarrier())
+
+	var names []string
+	for _, p := range conn.Phases() {
+		names = append(names, p.Name)
+		assert.False(t, p.End.Before(p.Start), p.Name)
+	}
+	// the test client does not send ProxyStarted and uses ProxyModeRelay
+	assert.Equal(t, []string{PhaseProxyMode, PhaseBanner}, names)
+}
+
+func TestServerHandshakeUnknownBegin(t *testing.T) {
+	l, cleanup := listenTemp(t)
+	defer cleanup()
+
+	go func() {
+		c, _ := dialRelayClientAs(t, l.Addr().String(), Peer{})
+		c.readFrame()
+		c.conn.Write(mustMessage("SSHCON_FOO"))
+	}()
+	_, err := l.Accept()
+	_, ok := err.(ProtocolError)
+	assert.True(t, ok, "%T %s", err, err)
+}
@@ -0,0 +1,160 @@
+// Package tracing creates OpenTelemetry spans for the connection setup
+// of netssh, with one span per netssh.Phase.
+//
+// The client side is traced through netssh.DialerHooks, the server side
+// through netssh.ListenerHooks:
+//
+//	t := tracing.NewTracer(nil, nil)
+//	dialer := &netssh.Dialer{Hooks: t.DialerHooks()}
+//
+//	listener.SetHooks(t.Hooks())
+//
+// Use netssh.CombineDialerHooks and netssh.CombineListenerHooks to combine
+// the hooks with those of other integrations, such as package metrics.
+//
+// If the Dialer negotiates options with the server, the trace context is
+// sent to the server during the handshake (see netssh.DialTrace.Carrier and
+// netssh.Dialer.NegotiateOptions), so the server's spans join the trace
+// of the client.
+//
+// Package netssh itself does not depend on OpenTelemetry.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/problame/go-netssh"
+)
+
+const instrumentationName = "github.com/problame/go-netssh/tracing"
+
+// Tracer creates the spans, its methods are safe for concurrent use.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewTracer returns a Tracer that creates spans using tp and propagates the
+// trace context using propagator. If nil, the global TracerProvider and
+// TextMapPropagator from package otel are used.
+func NewTracer(tp trace.TracerProvider, propagator propagation.TextMapPropagator) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	if propagator == nil {
+		propagator = otel.GetTextMapPropagator()
+	}
+	return &Tracer{
+		tracer:     tp.Tracer(instrumentationName),
+		propagator: propagator,
+	}
+}
+
+type dialSpanKey struct{}
+
+// DialerHooks returns the hooks to use as netssh.Dialer.Hooks. Each Dial is
+// traced in a span named netssh.Dial with child spans for the phases of Dial.
+// The trace context is only sent to the server if the propagator produces one
+// and the Dialer negotiates options.
+func (t *Tracer) DialerHooks() netssh.DialerHooks {
+	return netssh.DialerHooks{
+		OnDial:          t.onDial,
+		OnHandshakeDone: t.onDialHandshakeDone,
+		OnFailure:       t.onDialFailure,
+	}
+}
+
+func (t *Tracer) onDial(ctx context.Context, endpoint netssh.Endpoint) context.Context {
+	ctx, span := t.tracer.Start(ctx, "netssh.Dial",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("netssh.endpoint.host", endpoint.Host),
+			attribute.String("netssh.endpoint.user", endpoint.User),
+			attribute.Int("netssh.endpoint.port", int(endpoint.Port)),
+			attribute.Int("netssh.endpoint.hops", len(endpoint.Via)),
+		))
+	carrier := propagation.MapCarrier{}
+	t.propagator.Inject(ctx, carrier)
+	dialTrace := &netssh.DialTrace{
+		Carrier: carrier,
+		PhaseDone: func(p netssh.Phase, err error) {
+			t.phaseSpan(ctx, p, err)
+		},
+	}
+	ctx = context.WithValue(ctx, dialSpanKey{}, span)
+	return netssh.ContextWithDialTrace(ctx, dialTrace)
+}
+
+func (t *Tracer) onDialHandshakeDone(ctx context.Context, conn *netssh.SSHConn) {
+	span, ok := ctx.Value(dialSpanKey{}).(trace.Span)
+	if !ok {
+		return
+	}
+	span.SetAttributes(
+		attribute.String("netssh.conn", conn.ID()),
+		attribute.Int("netssh.pid", conn.Stats().PID),
+	)
+	span.End()
+}
+
+func (t *Tracer) onDialFailure(ctx context.Context, endpoint netssh.Endpoint, err error) {
+	span, ok := ctx.Value(dialSpanKey{}).(trace.Span)
+	if !ok {
+		return
+	}
+	setError(span, err)
+	span.End()
+}
+
+// Hooks returns the hooks to pass to Listener.SetHooks. OnHandshake creates
+// a span named netssh.Accept with child spans for the phases of the
+// server side of the handshake.
+func (t *Tracer) Hooks() netssh.ListenerHooks {
+	return netssh.ListenerHooks{
+		OnHandshake: t.onHandshake,
+	}
+}
+
+func (t *Tracer) onHandshake(conn *netssh.ServeConn) {
+	phases := conn.Phases()
+	if len(phases) == 0 {
+		return
+	}
+	ctx := t.propagator.Extract(context.Background(), propagation.MapCarrier(conn.TraceCarrier()))
+	peer := conn.Peer()
+	ctx, span := t.tracer.Start(ctx, "netssh.Accept",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(phases[0].Start),
+		trace.WithAttributes(
+			attribute.String("netssh.conn", conn.ID()),
+			attribute.String("netssh.peer.key_id", peer.KeyID),
+			attribute.String("netssh.peer.service", peer.Service),
+			attribute.String("netssh.peer.ssh_connection", peer.SSHConnection),
+			attribute.String("netssh.proxy_mode", conn.ProxyMode().String()),
+			attribute.Int("netssh.pid", conn.Stats().PID),
+		))
+	for _, p := range phases {
+		t.phaseSpan(ctx, p, nil)
+	}
+	span.End(trace.WithTimestamp(phases[len(phases)-1].End))
+}
+
+func (t *Tracer) phaseSpan(ctx context.Context, p netssh.Phase, err error) {
+	_, span := t.tracer.Start(ctx, fmt.Sprintf("netssh.%s", p.Name), trace.WithTimestamp(p.Start))
+	if err != nil {
+		setError(span, err)
+	}
+	span.End(trace.WithTimestamp(p.End))
+}
+
+func setError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,84 @@
+package tracing_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/problame/go-netssh"
+	"github.com/problame/go-netssh/netsshtest"
+	"github.com/problame/go-netssh/tracing"
+)
+
+func TestMain(m *testing.M) {
+	netsshtest.Main()
+	os.Exit(m.Run())
+}
+
+func TestTracer(t *testing.T) {
+	for _, mode := range []netssh.ProxyMode{netssh.ProxyModeFD, netssh.ProxyModeRelay} {
+		t.Run(mode.String(), func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+			tracer := tracing.NewTracer(tp, propagation.TraceContext{})
+
+			s, err := netsshtest.NewServer()
+			require.NoError(t, err)
+			defer s.Close()
+			s.SetHooks(tracer.Hooks())
+
+			accepted := make(chan *netssh.ServeConn)
+			go func() {
+				conn, err := s.Accept()
+				if err != nil {
+					close(accepted)
+					return
+				}
+				accepted <- conn
+			}()
+			d := netssh.Dialer{Hooks: tracer.DialerHooks(), NegotiateOptions: true}
+			conn, err := d.Dial(context.Background(), s.Endpoint(netsshtest.Behavior{ProxyMode: mode}))
+			require.NoError(t, err)
+			defer conn.Close()
+			serveConn := <-accepted
+			require.NotNil(t, serveConn)
+			defer serveConn.Close()
+
+			spans := make(map[string]sdktrace.ReadOnlySpan)
+			for _, span := range recorder.Ended() {
+				spans[span.Name()] = span
+			}
+			dial := spans["netssh.Dial"]
+			require.NotNil(t, dial)
+			accept := spans["netssh.Accept"]
+			require.NotNil(t, accept)
+			assert.Equal(t, dial.SpanContext().TraceID(), accept.SpanContext().TraceID())
+			assert.Equal(t, dial.SpanContext().SpanID(), accept.Parent().SpanID())
+
+			for _, name := range []string{netssh.PhaseSSHStart, netssh.PhaseConnect, netssh.PhaseBegin} {
+				span := spans["netssh."+name]
+				require.NotNil(t, span, name)
+				assert.Equal(t, dial.SpanContext().SpanID(), span.Parent().SpanID(), name)
+			}
+			serverPhases := []string{netssh.PhaseProxy, netssh.PhaseProxyMode, netssh.PhaseBanner}
+			if mode == netssh.ProxyModeFD {
+				serverPhases = append(serverPhases, netssh.PhaseFDPassing)
+			}
+			for _, name := range serverPhases {
+				span := spans["netssh."+name]
+				require.NotNil(t, span, name)
+				assert.Equal(t, accept.SpanContext().SpanID(), span.Parent().SpanID(), name)
+			}
+			assert.Nil(t, spans["netssh."+netssh.PhaseAdmission])
+			if mode == netssh.ProxyModeRelay {
+				assert.Nil(t, spans["netssh."+netssh.PhaseFDPassing])
+			}
+		})
+	}
+}